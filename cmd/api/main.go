@@ -4,22 +4,37 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
-	amqp "github.com/rabbitmq/amqp091-go"
 
 	"github.com/henok3878/distributed-task-queue/internal/api"
+	"github.com/henok3878/distributed-task-queue/internal/backlog"
+	"github.com/henok3878/distributed-task-queue/internal/blob"
+	"github.com/henok3878/distributed-task-queue/internal/broker"
 	"github.com/henok3878/distributed-task-queue/internal/config"
+	"github.com/henok3878/distributed-task-queue/internal/envelope"
+	"github.com/henok3878/distributed-task-queue/internal/logging"
 	"github.com/henok3878/distributed-task-queue/internal/metrics"
+	"github.com/henok3878/distributed-task-queue/internal/migrate"
 	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/internal/store"
+	"github.com/henok3878/distributed-task-queue/internal/tracing"
+	"github.com/henok3878/distributed-task-queue/internal/webhook"
 )
 
 func main() {
 	_ = godotenv.Load()
 
+	// structured logs: LOG_FORMAT=text|json, LOG_LEVEL
+	if _, err := logging.FromEnv("dq-api"); err != nil {
+		log.Fatal("config:", err)
+	}
+
 	httpPort, err := config.GetFromEnv("HTTP_PORT")
 	if err != nil {
 		log.Fatal("config:", err)
@@ -30,40 +45,80 @@ func main() {
 		log.Fatal("config:", err)
 	}
 
-	amqpURL, err := rmq.URLFromEnv()
+	// load topology
+	topo, err := rmq.Load()
 	if err != nil {
 		log.Fatal("config:", err)
 	}
 
-	// load topology
-	topo, err := rmq.Load()
+	// tracing: OTEL_TRACES_EXPORTER=otlp|stdout (default none)
+	shutdown, err := tracing.FromEnv(context.Background(), "dq-api")
 	if err != nil {
 		log.Fatal("config:", err)
 	}
+	defer shutdown(context.Background())
 
-	// Postgres pool
-	db, err := pgxpool.New(context.Background(), dbDSN)
+	// Postgres pool, queries traced under the request span
+	pgCfg, err := pgxpool.ParseConfig(dbDSN)
+	if err != nil {
+		log.Fatal("config:", err)
+	}
+	pgCfg.ConnConfig.Tracer = tracing.PgxTracer{}
+	db, err := pgxpool.NewWithConfig(context.Background(), pgCfg)
 	if err != nil {
 		log.Fatal("pg connect:", err)
 	}
 	defer db.Close()
 
-	// RabbitMQ connection + channel
-	rmqConn, err := amqp.Dial(amqpURL)
-	if err != nil {
-		log.Fatal("amqp dial:", err)
+	// refuse to run against an older schema
+	if err := migrate.Check(context.Background(), db); err != nil {
+		log.Fatal("schema:", err)
 	}
-	defer rmqConn.Close()
 
-	rmqCh, err := rmqConn.Channel()
+	// broker: RabbitMQ (default) or Postgres, per BROKER
+	b, err := broker.FromEnv(db, topo, broker.ConsumeConfig{})
 	if err != nil {
-		log.Fatal("amqp channel:", err)
+		log.Fatal("broker:", err)
 	}
-	defer rmqCh.Close()
+	defer b.Close()
 
 	// register Prom metrics we defined
 	metrics.MustRegisterAll()
 
+	// queue depth and task backlog gauges
+	backlogEvery, err := backlog.IntervalFromEnv()
+	if err != nil {
+		log.Fatal("config:", err)
+	}
+	if backlogEvery > 0 {
+		c := &backlog.Collector{Store: store.NewPostgres(db), Broker: b, Topology: topo, Interval: backlogEvery}
+		go c.Run(context.Background())
+	}
+
+	// large payloads/results, when BLOB_STORE is set
+	blobs, err := blob.FromEnv()
+	if err != nil {
+		log.Fatal("config:", err)
+	}
+
+	// encryption at rest for encrypt types, when ENCRYPTION_KEYS is set
+	keys, err := envelope.FromEnv()
+	if err != nil {
+		log.Fatal("config:", err)
+	}
+
+	// completion webhooks, when WEBHOOK_SECRET is set
+	hooks, err := webhook.FromEnv(store.NewPostgres(db))
+	if err != nil {
+		log.Fatal("config:", err)
+	}
+	if hooks != nil {
+		hooks.Blobs = blobs
+		go hooks.Run(context.Background())
+	} else {
+		slog.Info("webhooks disabled: WEBHOOK_SECRET not set")
+	}
+
 	mux := http.NewServeMux()
 
 	// info
@@ -71,21 +126,33 @@ func main() {
 		_ = json.NewEncoder(w).Encode(map[string]string{"service": "distributed-task-queue"})
 	})
 
+	// task_events notifications for /tasks/{id}/wait and /stream
+	listener := store.NewListener(db)
+	go listener.Run(context.Background())
+
+	deps := api.Deps{
+		Store: store.NewPostgres(db), Broker: b, Topology: topo, Watcher: listener, Blobs: blobs, Keys: keys,
+		Webhooks:  hooks != nil,                       // otherwise callback_url is rejected: nothing would send it
+		ReadToken: os.Getenv("ENCRYPTION_READ_TOKEN"), // reveals encrypted results to task reads
+	}
+
 	// /healthz
-	api.RegisterHealth(mux, api.Deps{DB: db, RMQ: rmqCh, Topology: topo})
+	api.RegisterHealth(mux, deps)
 	// /enqueue
-	api.RegisterEnqueue(mux, api.Deps{DB: db, RMQ: rmqCh, Topology: topo})
-	// /tasks/{id}
-	api.RegisterTasks(mux, api.Deps{DB: db, RMQ: rmqCh, Topology: topo})
+	api.RegisterEnqueue(mux, deps)
+	// /tasks/{id}, /tasks/{id}/wait, /tasks/{id}/stream
+	api.RegisterTasks(mux, deps)
+	// /types registry
+	api.RegisterTypes(mux, deps)
 
 	// /metrics (Prometheus)
 	metrics.Expose(mux, "GET /metrics")
 
 	srv := &http.Server{
 		Addr:              httpPort,
-		Handler:           mux,
+		Handler:           api.RequestLog(mux), // request ids + access log
 		ReadHeaderTimeout: 2 * time.Second,
 	}
-	log.Println("api listening on", httpPort)
+	slog.Info("api listening", "addr", httpPort)
 	log.Fatal(srv.ListenAndServe())
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
+
+	"github.com/henok3878/distributed-task-queue/internal/config"
+	"github.com/henok3878/distributed-task-queue/internal/migrate"
+)
+
+// usage:
+//
+//	migrate [up]           apply every pending migration (default)
+//	migrate down [-n 1]    roll back the last n applied migrations
+//	migrate to <version>   migrate up or down to exactly version (0 = empty)
+//	migrate status         list migrations and when they were applied
+func main() {
+	_ = godotenv.Load()
+
+	cmd := "up"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	dbDSN, err := config.GetFromEnv("DB_DSN")
+	if err != nil {
+		log.Fatal("config:", err)
+	}
+	ctx := context.Background()
+	db, err := pgxpool.New(ctx, dbDSN)
+	if err != nil {
+		log.Fatal("pg connect:", err)
+	}
+	defer db.Close()
+
+	m, err := migrate.New(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logf := func(s string) { log.Println(s) }
+
+	switch cmd {
+	case "up":
+		err = m.Up(ctx, logf)
+	case "down":
+		fs := flag.NewFlagSet("down", flag.ExitOnError)
+		n := fs.Int("n", 1, "how many migrations to roll back")
+		_ = fs.Parse(args)
+		err = m.Down(ctx, *n, logf)
+	case "to":
+		if len(args) != 1 {
+			log.Fatal("usage: migrate to <version>")
+		}
+		v, perr := strconv.Atoi(args[0])
+		if perr != nil {
+			log.Fatalf("bad version %q", args[0])
+		}
+		err = m.To(ctx, v, logf)
+	case "status":
+		err = status(ctx, m)
+	default:
+		log.Fatalf("unknown command %q (up|down|to|status)", cmd)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func status(ctx context.Context, m *migrate.Migrator) error {
+	states, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+	for _, s := range states {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+		}
+		fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	return tw.Flush()
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/joho/godotenv"
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -10,29 +14,81 @@ import (
 	"github.com/henok3878/distributed-task-queue/internal/rmq"
 )
 
+// usage:
+//
+//	rmq-init [apply] [-migrate]      declare the topology (default)
+//	rmq-init plan                    show how the broker differs from the topology
+//	rmq-init definitions [-o file]   regenerate the broker definitions file
 func main() {
 	_ = godotenv.Load()
-	if err := ensureTopology(); err != nil {
-		log.Fatal(err)
+
+	cmd := "apply"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
 	}
-	log.Println("RabbitMQ topology ensured!")
-}
 
-func ensureTopology() error {
-	amqpURL, err := rmq.URLFromEnv()
-	if err != nil {
-		return fmt.Errorf("config: %w", err)
+	switch cmd {
+	case "apply":
+		fs := flag.NewFlagSet("apply", flag.ExitOnError)
+		migrate := fs.Bool("migrate", false, "recreate queues whose type/arguments differ, moving their messages through a temp queue")
+		_ = fs.Parse(args)
+		if err := ensureTopology(*migrate); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("RabbitMQ topology ensured!")
+	case "plan":
+		n, err := plan()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n > 0 {
+			os.Exit(2)
+		}
+	case "definitions":
+		fs := flag.NewFlagSet("definitions", flag.ExitOnError)
+		out := fs.String("o", "deploy/rabbitmq/definitions.json", "definitions file to update in place")
+		_ = fs.Parse(args)
+		if err := writeDefinitions(*out); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("definitions written to", *out)
+	default:
+		log.Fatalf("unknown command %q (apply|plan|definitions)", cmd)
 	}
-	topo, err := rmq.Load()
+}
+
+func ensureTopology(migrate bool) error {
+	topo, conn, err := connect()
 	if err != nil {
-		return fmt.Errorf("config: %w", err)
+		return err
 	}
+	defer conn.Close()
+	decls := topo.Declarations()
 
-	conn, err := amqp.Dial(amqpURL)
+	// mismatched queues make QueueDeclare fail with PRECONDITION_FAILED, so
+	// find them first and either migrate them or explain what to do
+	changes, err := decls.Plan(context.Background(), conn, rmq.MgmtFromEnv())
 	if err != nil {
-		return fmt.Errorf("amqp dial: %w", err)
+		return fmt.Errorf("plan: %w", err)
+	}
+	var recreate []rmq.Change
+	for _, c := range changes {
+		if c.Action == rmq.ActionRecreate {
+			recreate = append(recreate, c)
+		}
+	}
+	for _, c := range recreate {
+		if c.Kind != "queue" || !migrate {
+			return fmt.Errorf("%s (run `rmq-init plan`; queues can be fixed with `rmq-init apply -migrate`)", c)
+		}
+	}
+	for _, c := range recreate {
+		log.Printf("migrating %s", c)
+		if err := decls.MigrateQueue(context.Background(), conn, c.Name); err != nil {
+			return fmt.Errorf("migrate %s: %w", c.Name, err)
+		}
 	}
-	defer conn.Close()
 
 	ch, err := conn.Channel()
 	if err != nil {
@@ -40,47 +96,70 @@ func ensureTopology() error {
 	}
 	defer ch.Close()
 
-	// exchanges
-	if err := ch.ExchangeDeclare(topo.MainExchange, topo.MainKind, true, false, false, false, nil); err != nil {
-		return fmt.Errorf("declare %s: %w", topo.MainExchange, err)
-	}
-	if err := ch.ExchangeDeclare(topo.DLXExchange, topo.DLXKind, true, false, false, false, nil); err != nil {
-		return fmt.Errorf("declare %s: %w", topo.DLXExchange, err)
-	}
+	return decls.Apply(ch)
+}
 
-	// queues + bindings
-	for _, rk := range topo.RoutingKeys {
-		q := topo.FullQueueName(rk) // e.g. tasks.default
-		if _, err := ch.QueueDeclare(q, true, false, false, false, nil); err != nil {
-			return fmt.Errorf("declare queue %s: %w", q, err)
-		}
-		if err := ch.QueueBind(q, rk, topo.MainExchange, false, nil); err != nil {
-			return fmt.Errorf("bind %s <- %s[%s]: %w", q, topo.MainExchange, rk, err)
-		}
+// plan prints the differences and returns how many changes apply would make.
+func plan() (int, error) {
+	topo, conn, err := connect()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	// single DLQ for all priorities + bindings from DLX
-	if _, err := ch.QueueDeclare(topo.DLQName, true, false, false, false, nil); err != nil {
-		return fmt.Errorf("declare dlq %s: %w", topo.DLQName, err)
+	mgmt := rmq.MgmtFromEnv()
+	if mgmt == nil {
+		log.Println("RMQ_MGMT_URL not set: argument diffs and bindings are not inspected")
 	}
-	for _, rk := range topo.RoutingKeys {
-		if err := ch.QueueBind(topo.DLQName, rk, topo.DLXExchange, false, nil); err != nil {
-			return fmt.Errorf("bind dlq <- %s[%s]: %w", topo.DLXExchange, rk, err)
+	changes, err := topo.Declarations().Plan(context.Background(), conn, mgmt)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, c := range changes {
+		fmt.Println(c)
+		if c.Action != rmq.ActionOK {
+			n++
 		}
 	}
+	fmt.Printf("%d change(s)\n", n)
+	return n, nil
+}
 
-	// retry queues (one per priority)... per-message TTL is set at publish time
-	// these queues dead-letter back to the main exchange with the same routing key
-	for _, rk := range topo.RoutingKeys {
-		qRetry := topo.RetryQueueName(rk) // e.g. tasks.retry.default
-		args := amqp.Table{
-			"x-dead-letter-exchange":    topo.MainExchange,
-			"x-dead-letter-routing-key": rk,
-		}
-		if _, err := ch.QueueDeclare(qRetry, true, false, false, false, args); err != nil {
-			return fmt.Errorf("declare retry queue %s: %w", qRetry, err)
-		}
+func connect() (rmq.Topology, *amqp.Connection, error) {
+	amqpURL, err := rmq.URLFromEnv()
+	if err != nil {
+		return rmq.Topology{}, nil, fmt.Errorf("config: %w", err)
+	}
+	topo, err := rmq.Load()
+	if err != nil {
+		return rmq.Topology{}, nil, fmt.Errorf("config: %w", err)
 	}
+	conn, err := amqp.Dial(amqpURL)
+	if err != nil {
+		return rmq.Topology{}, nil, fmt.Errorf("amqp dial: %w", err)
+	}
+	return topo, conn, nil
+}
 
-	return nil
+// writeDefinitions rewrites exchanges/queues/bindings of the definitions file
+// from the topology, keeping users, permissions and vhosts as they are.
+func writeDefinitions(path string) error {
+	topo, err := rmq.Load()
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	vhost := strings.TrimSpace(os.Getenv("RMQ_VHOST"))
+	if vhost == "" {
+		vhost = "/"
+	}
+	out, err := topo.Declarations().MergeDefinitions(existing, vhost)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return os.WriteFile(path, out, 0o644)
 }
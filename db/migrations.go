@@ -0,0 +1,8 @@
+// Package db holds the schema as numbered migrations (NNNN_name.up.sql /
+// NNNN_name.down.sql), embedded for cmd/migrate and the startup check.
+package db
+
+import "embed"
+
+//go:embed migrations/*.sql
+var Migrations embed.FS
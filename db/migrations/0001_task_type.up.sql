@@ -4,4 +4,4 @@ CREATE TABLE IF NOT EXISTS task_type (
     default_queue TEXT NOT NULL, 
     default_max_attempts INT NOT NULL DEFAULT 5, 
     payload_schema JSONB
-);
\ No newline at end of file
+);
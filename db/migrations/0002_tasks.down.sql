@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS tasks;
+DROP FUNCTION IF EXISTS set_updated_at();
@@ -28,4 +28,4 @@ $$;
 DROP TRIGGER IF EXISTS trg_set_updated_at ON tasks;
 CREATE TRIGGER trg_set_updated_at
     BEFORE UPDATE ON tasks
-    FOR EACH ROW EXECUTE FUNCTION set_updated_at();
\ No newline at end of file
+    FOR EACH ROW EXECUTE FUNCTION set_updated_at();
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS trg_task_events_after_update ON tasks;
+DROP TRIGGER IF EXISTS trg_task_events_after_insert ON tasks;
+DROP FUNCTION IF EXISTS trg_task_events_update();
+DROP FUNCTION IF EXISTS trg_task_events_insert();
+DROP TABLE IF EXISTS task_events;
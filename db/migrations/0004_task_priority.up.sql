@@ -0,0 +1,2 @@
+-- AMQP message priority, kept on the row so retries republish with it
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS priority SMALLINT NOT NULL DEFAULT 0 CHECK (priority BETWEEN 0 AND 255);
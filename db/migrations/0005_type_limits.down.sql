@@ -0,0 +1,5 @@
+DROP FUNCTION IF EXISTS dq_rate_take(TEXT, DOUBLE PRECISION, INT);
+DROP TABLE IF EXISTS task_type_rate_state;
+ALTER TABLE task_type DROP COLUMN IF EXISTS rate_limit_burst;
+ALTER TABLE task_type DROP COLUMN IF EXISTS rate_limit_per_sec;
+ALTER TABLE task_type DROP COLUMN IF EXISTS max_concurrency;
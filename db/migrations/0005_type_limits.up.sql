@@ -0,0 +1,39 @@
+-- global cap on concurrently running tasks of this type across all workers (NULL = unlimited)
+ALTER TABLE task_type ADD COLUMN IF NOT EXISTS max_concurrency INT CHECK (max_concurrency >= 1);
+
+-- throughput cap for this type across all workers (NULL = unlimited); burst defaults to 1
+ALTER TABLE task_type ADD COLUMN IF NOT EXISTS rate_limit_per_sec DOUBLE PRECISION CHECK (rate_limit_per_sec > 0);
+ALTER TABLE task_type ADD COLUMN IF NOT EXISTS rate_limit_burst INT CHECK (rate_limit_burst >= 1);
+
+-- GCRA state per rate-limited type: tat is the theoretical arrival time of the next task
+CREATE TABLE IF NOT EXISTS task_type_rate_state (
+    type TEXT PRIMARY KEY REFERENCES task_type(type) ON DELETE CASCADE,
+    tat  TIMESTAMPTZ NOT NULL
+);
+
+-- take one token for p_type. returns 0 when allowed, otherwise the seconds to wait.
+-- throttled calls leave the state untouched so they don't reserve capacity.
+CREATE OR REPLACE FUNCTION dq_rate_take(p_type TEXT, p_rate DOUBLE PRECISION, p_burst INT)
+RETURNS DOUBLE PRECISION LANGUAGE plpgsql AS $$
+DECLARE
+    emission  INTERVAL := make_interval(secs => 1.0 / p_rate);
+    tolerance INTERVAL := make_interval(secs => (greatest(p_burst, 1) - 1) / p_rate);
+    now_ts    TIMESTAMPTZ := clock_timestamp();
+    cur       TIMESTAMPTZ;
+BEGIN
+    INSERT INTO task_type_rate_state (type, tat) VALUES (p_type, now_ts)
+    ON CONFLICT (type) DO NOTHING;
+
+    SELECT greatest(tat, now_ts) INTO cur
+      FROM task_type_rate_state
+     WHERE type = p_type
+       FOR UPDATE;
+
+    IF cur - now_ts > tolerance THEN
+        RETURN extract(epoch FROM cur - now_ts - tolerance);
+    END IF;
+
+    UPDATE task_type_rate_state SET tat = cur + emission WHERE type = p_type;
+    RETURN 0;
+END;
+$$;
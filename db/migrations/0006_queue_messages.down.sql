@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS queue_messages;
+DROP FUNCTION IF EXISTS trg_queue_messages_notify();
@@ -0,0 +1,35 @@
+-- message queue for BROKER=postgres (replaces RabbitMQ queues, retries and DLQs)
+CREATE TABLE IF NOT EXISTS queue_messages (
+    id            BIGSERIAL PRIMARY KEY,
+    queue         TEXT NOT NULL,               -- routing key, or DLQ name when dead
+    task_id       TEXT NOT NULL,
+    type          TEXT NOT NULL,
+    priority      SMALLINT NOT NULL DEFAULT 0,
+    headers       JSONB,
+    run_after     TIMESTAMPTZ NOT NULL DEFAULT now(), -- retries become visible here
+    locked_until  TIMESTAMPTZ,                 -- claimed by a worker until then
+    deliveries    INTEGER NOT NULL DEFAULT 0,
+    dead          BOOLEAN NOT NULL DEFAULT false,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- claim order within a queue: priority first, then due time
+CREATE INDEX IF NOT EXISTS queue_messages_claim_idx
+    ON queue_messages (queue, priority DESC, run_after, id)
+    WHERE NOT dead;
+
+-- wake sleeping consumers when a message is ready now
+CREATE OR REPLACE FUNCTION trg_queue_messages_notify()
+RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    IF NOT NEW.dead AND NEW.run_after <= now() THEN
+        PERFORM pg_notify('dq_queue_messages', NEW.queue);
+    END IF;
+    RETURN NEW;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS trg_queue_messages_after_insert ON queue_messages;
+CREATE TRIGGER trg_queue_messages_after_insert
+AFTER INSERT ON queue_messages
+FOR EACH ROW EXECUTE FUNCTION trg_queue_messages_notify();
@@ -0,0 +1,13 @@
+-- change log of task_type, written by the /types API
+CREATE TABLE IF NOT EXISTS task_type_audit (
+    id      BIGSERIAL PRIMARY KEY,
+    type    TEXT NOT NULL,
+    action  TEXT NOT NULL CHECK (action IN ('CREATE', 'UPDATE', 'DEACTIVATE')),
+    actor   TEXT,
+    before  JSONB,
+    after   JSONB NOT NULL,
+    at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS task_type_audit_type_at_idx
+    ON task_type_audit (type, at);
@@ -0,0 +1,12 @@
+DELETE FROM task_type_audit WHERE action = 'DEPRECATE';
+ALTER TABLE task_type_audit DROP CONSTRAINT IF EXISTS task_type_audit_action_check;
+ALTER TABLE task_type_audit ADD CONSTRAINT task_type_audit_action_check
+    CHECK (action IN ('CREATE', 'UPDATE', 'DEACTIVATE'));
+
+DROP INDEX IF EXISTS task_type_family_version_idx;
+DROP TRIGGER IF EXISTS trg_task_type_family ON task_type;
+DROP FUNCTION IF EXISTS trg_task_type_family();
+ALTER TABLE task_type DROP COLUMN IF EXISTS replaced_by;
+ALTER TABLE task_type DROP COLUMN IF EXISTS deprecated_at;
+ALTER TABLE task_type DROP COLUMN IF EXISTS version;
+ALTER TABLE task_type DROP COLUMN IF EXISTS family;
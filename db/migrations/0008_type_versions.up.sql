@@ -0,0 +1,37 @@
+-- type families and versions: email.send.v2 is version 2 of family email.send
+ALTER TABLE task_type ADD COLUMN IF NOT EXISTS family TEXT;
+ALTER TABLE task_type ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1 CHECK (version >= 1);
+ALTER TABLE task_type ADD COLUMN IF NOT EXISTS deprecated_at TIMESTAMPTZ;
+ALTER TABLE task_type ADD COLUMN IF NOT EXISTS replaced_by TEXT REFERENCES task_type(type);
+
+-- derive family/version from the name when not given (raw SQL inserts, backfill)
+CREATE OR REPLACE FUNCTION trg_task_type_family()
+RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    IF NEW.family IS NULL THEN
+        IF NEW.type ~ '\.v[1-9][0-9]{0,5}$' THEN
+            NEW.family  := substring(NEW.type FROM '^(.*)\.v[1-9][0-9]{0,5}$');
+            NEW.version := substring(NEW.type FROM '\.v([1-9][0-9]{0,5})$')::int;
+        ELSE
+            NEW.family := NEW.type;
+        END IF;
+    END IF;
+    RETURN NEW;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS trg_task_type_family ON task_type;
+CREATE TRIGGER trg_task_type_family
+BEFORE INSERT OR UPDATE ON task_type
+FOR EACH ROW EXECUTE FUNCTION trg_task_type_family();
+
+UPDATE task_type SET family = NULL WHERE family IS NULL; -- fires the trigger
+ALTER TABLE task_type ALTER COLUMN family SET NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS task_type_family_version_idx
+    ON task_type (family, version);
+
+-- deprecations are audited too
+ALTER TABLE task_type_audit DROP CONSTRAINT IF EXISTS task_type_audit_action_check;
+ALTER TABLE task_type_audit ADD CONSTRAINT task_type_audit_action_check
+    CHECK (action IN ('CREATE', 'UPDATE', 'DEACTIVATE', 'DEPRECATE'));
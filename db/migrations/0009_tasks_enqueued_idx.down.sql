@@ -0,0 +1 @@
+DROP INDEX IF EXISTS tasks_enqueued_idx;
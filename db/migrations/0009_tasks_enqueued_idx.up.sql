@@ -0,0 +1,4 @@
+-- oldest ENQUEUED task per queue, polled by the backlog collector
+CREATE INDEX IF NOT EXISTS tasks_enqueued_idx
+    ON tasks (queue, created_at)
+    WHERE status = 'ENQUEUED';
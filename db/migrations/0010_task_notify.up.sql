@@ -0,0 +1,14 @@
+-- wake API long-polls and streams: notify the task id of every task_events row.
+-- delivered on commit; listeners re-read the task, so the payload stays small.
+CREATE OR REPLACE FUNCTION trg_task_events_notify()
+RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    PERFORM pg_notify('task_events', NEW.task_id);
+    RETURN NEW;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS trg_task_events_notify ON task_events;
+CREATE TRIGGER trg_task_events_notify
+AFTER INSERT ON task_events
+FOR EACH ROW EXECUTE FUNCTION trg_task_events_notify();
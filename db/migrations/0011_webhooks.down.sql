@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS trg_task_webhook ON tasks;
+DROP FUNCTION IF EXISTS trg_task_webhook();
+DROP TABLE IF EXISTS webhook_deliveries;
+ALTER TABLE tasks DROP COLUMN IF EXISTS callback_url;
+ALTER TABLE task_type DROP COLUMN IF EXISTS callback_url;
@@ -0,0 +1,46 @@
+-- completion webhooks: tasks.callback_url (or the type's default) is POSTed
+-- the final task once it reaches SUCCEEDED, FAILED or DLQ
+ALTER TABLE task_type ADD COLUMN IF NOT EXISTS callback_url TEXT;
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS callback_url TEXT;
+
+-- one row per delivery attempt. the dispatcher claims due PENDING rows,
+-- marks them DELIVERED, RETRY (and inserts the next attempt) or FAILED
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id           BIGSERIAL PRIMARY KEY,
+    task_id      TEXT NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+    url          TEXT NOT NULL,
+    event        TEXT NOT NULL CHECK (event IN ('SUCCEEDED','FAILED','DLQ')),
+    attempt      INTEGER NOT NULL DEFAULT 1 CHECK (attempt >= 1),
+    state        TEXT NOT NULL DEFAULT 'PENDING' CHECK (state IN ('PENDING','DELIVERED','RETRY','FAILED')),
+    run_after    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    status_code  INTEGER,
+    error        TEXT,
+    duration_ms  INTEGER,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    done_at      TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_task_idx
+    ON webhook_deliveries (task_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx
+    ON webhook_deliveries (run_after)
+    WHERE state = 'PENDING';
+
+-- queue the first attempt in the transaction that finishes the task
+CREATE OR REPLACE FUNCTION trg_task_webhook()
+RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    IF NEW.callback_url IS NOT NULL
+       AND NEW.status IS DISTINCT FROM OLD.status
+       AND NEW.status IN ('SUCCEEDED','FAILED','DLQ') THEN
+        INSERT INTO webhook_deliveries(task_id, url, event)
+        VALUES (NEW.id, NEW.callback_url, NEW.status);
+    END IF;
+    RETURN NEW;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS trg_task_webhook ON tasks;
+CREATE TRIGGER trg_task_webhook
+AFTER UPDATE OF status ON tasks
+FOR EACH ROW EXECUTE FUNCTION trg_task_webhook();
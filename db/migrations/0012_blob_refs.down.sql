@@ -0,0 +1,2 @@
+ALTER TABLE tasks DROP COLUMN IF EXISTS result_ref;
+ALTER TABLE tasks DROP COLUMN IF EXISTS payload_ref;
@@ -0,0 +1,3 @@
+-- offloaded payloads/results: the blob key, with payload 'null' / result NULL
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS payload_ref TEXT;
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS result_ref TEXT;
@@ -0,0 +1,2 @@
+ALTER TABLE tasks DROP COLUMN IF EXISTS encrypted;
+ALTER TABLE task_type DROP COLUMN IF EXISTS encrypt;
@@ -0,0 +1,5 @@
+-- opt-in encryption at rest: tasks of an encrypt type store payload and
+-- result as envelopes (internal/envelope). tasks.encrypted is fixed at
+-- enqueue, so toggling the type only affects new tasks
+ALTER TABLE task_type ADD COLUMN IF NOT EXISTS encrypt BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS encrypted BOOLEAN NOT NULL DEFAULT false;
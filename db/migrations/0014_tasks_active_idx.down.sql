@@ -0,0 +1 @@
+DROP INDEX IF EXISTS tasks_active_idx;
@@ -0,0 +1,5 @@
+-- exact counts of live (ENQUEUED/RUNNING) tasks for the backlog collector;
+-- terminal statuses are estimated from planner statistics instead
+CREATE INDEX IF NOT EXISTS tasks_active_idx
+    ON tasks (status)
+    WHERE status IN ('ENQUEUED', 'RUNNING');
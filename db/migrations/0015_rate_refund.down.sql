@@ -0,0 +1 @@
+DROP FUNCTION IF EXISTS dq_rate_refund(TEXT, DOUBLE PRECISION);
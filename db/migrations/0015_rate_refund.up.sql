@@ -0,0 +1,9 @@
+-- hands back a token taken by dq_rate_take for a task that didn't run
+-- (already done, not served, at its concurrency cap). never moves tat
+-- behind now, which already means an idle limiter
+CREATE OR REPLACE FUNCTION dq_rate_refund(p_type TEXT, p_rate DOUBLE PRECISION)
+RETURNS void LANGUAGE sql AS $$
+    UPDATE task_type_rate_state
+       SET tat = greatest(tat - make_interval(secs => 1.0 / p_rate), clock_timestamp())
+     WHERE type = p_type;
+$$;
@@ -2,42 +2,40 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
-	amqp "github.com/rabbitmq/amqp091-go"
 
 	"github.com/henok3878/distributed-task-queue/internal/backoff"
+	"github.com/henok3878/distributed-task-queue/internal/blob"
+	"github.com/henok3878/distributed-task-queue/internal/broker"
 	"github.com/henok3878/distributed-task-queue/internal/config"
+	"github.com/henok3878/distributed-task-queue/internal/envelope"
+	"github.com/henok3878/distributed-task-queue/internal/logging"
+	"github.com/henok3878/distributed-task-queue/internal/migrate"
 	"github.com/henok3878/distributed-task-queue/internal/rmq"
 	"github.com/henok3878/distributed-task-queue/internal/store"
+	"github.com/henok3878/distributed-task-queue/internal/tracing"
+	"github.com/henok3878/distributed-task-queue/pkg/worker"
 )
 
-type msgEnvelope struct {
-	ID   string `json:"id"`
-	Type string `json:"type"`
-}
-
 func main() {
 	_ = godotenv.Load()
 
-	// config
-	dbDSN, err := config.GetFromEnv("DB_DSN")
-	if err != nil {
+	// structured logs: LOG_FORMAT=text|json, LOG_LEVEL
+	if _, err := logging.FromEnv("dq-worker"); err != nil {
 		log.Fatal("config:", err)
 	}
-	amqpURL, err := rmq.URLFromEnv()
+
+	// config
+	dbDSN, err := config.GetFromEnv("DB_DSN")
 	if err != nil {
 		log.Fatal("config:", err)
 	}
@@ -46,9 +44,6 @@ func main() {
 		log.Fatal("config:", err)
 	}
 
-	// backoff strategy (env-driven)
-	bo := backoff.FromEnv()
-
 	// prefetch (max unacked per consumer)
 	prefetch := 32
 	if v := os.Getenv("WORKER_PREFETCH"); v != "" {
@@ -58,220 +53,146 @@ func main() {
 		}
 	}
 
-	// connections
-	ctx := context.Background()
-	db, err := pgxpool.New(ctx, dbDSN)
-	if err != nil {
-		log.Fatal("pg connect:", err)
-	}
-	defer db.Close()
+	// which queues/types this worker serves (default: all queues, every registered handler)
+	queues := splitCSV(os.Getenv("WORKER_QUEUES")) // ex: "high"
+	types := splitCSV(os.Getenv("WORKER_TYPES"))   // ex: "email.send.v1"
 
-	conn, err := amqp.Dial(amqpURL)
+	// how queues share capacity: equal (default) | weighted | strict
+	policy, err := broker.ParsePolicy(os.Getenv("WORKER_CONSUME_POLICY"))
 	if err != nil {
-		log.Fatal("amqp dial:", err)
+		log.Fatal("config:", err)
 	}
-	defer conn.Close()
-
-	ch, err := conn.Channel()
+	weights, err := broker.ParseWeights(os.Getenv("WORKER_QUEUE_WEIGHTS")) // ex: "high:6,default:1"
 	if err != nil {
-		log.Fatal("amqp channel:", err)
+		log.Fatal("config:", err)
 	}
-	defer ch.Close()
 
-	if err := ch.Qos(prefetch, 0, false); err != nil {
-		log.Fatal("amqp qos:", err)
+	// how long to park a task whose type is at its concurrency cap
+	var limitDelay time.Duration
+	if v := os.Getenv("WORKER_LIMIT_DELAY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			limitDelay = d
+		}
 	}
-	log.Printf("worker: prefetch=%d queues=%v", prefetch, topology.RoutingKeys)
-
-	// graceful shutdown
-	ctxRun, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer cancel()
-
-	var wg sync.WaitGroup
-	var tags []string
 
-	// one consumer per priority queue
-	for _, rk := range topology.RoutingKeys {
-		queue := topology.FullQueueName(rk)
-		tag := fmt.Sprintf("worker-%s-%d", rk, time.Now().UnixNano())
-		tags = append(tags, tag)
-
-		deliveries, err := ch.Consume(queue, tag, false, false, false, false, nil)
-		if err != nil {
-			log.Fatalf("consume %s: %v", queue, err)
+	// how long one task may run; Postgres claims stay hidden a bit longer
+	handlerTimeout := 10 * time.Second
+	if v := os.Getenv("WORKER_HANDLER_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			handlerTimeout = d
 		}
+	}
 
-		wg.Add(1)
-		go func(q, ctag string, ds <-chan amqp.Delivery) {
-			defer wg.Done()
-			for {
-				select {
-				case <-ctxRun.Done():
-					return
-				case d, ok := <-ds:
-					if !ok {
-						return
-					}
-
-					var env msgEnvelope
-					if err := json.Unmarshal(d.Body, &env); err != nil {
-						log.Printf("queue=%s parse error: %v body=%q", q, err, string(d.Body))
-						_ = d.Ack(false) // drop poison for now
-						continue
-					}
-
-					start := time.Now()
-
-					// per-message transactional scope
-					ctxMsg, cancelMsg := context.WithTimeout(ctxRun, 10*time.Second)
-					tx, err := db.Begin(ctxMsg)
-					if err != nil {
-						cancelMsg()
-						log.Printf("begin tx error: %v", err)
-						_ = d.Nack(false, true)
-						continue
-					}
-
-					t, err := store.LockTaskForWork(ctxMsg, tx, env.ID)
-					if err != nil {
-						_ = tx.Rollback(ctxMsg)
-						cancelMsg()
-						if err == pgx.ErrNoRows {
-							log.Printf("missing task id=%s; ack", env.ID)
-							_ = d.Ack(false)
-							continue
-						}
-						log.Printf("lock error id=%s: %v", env.ID, err)
-						_ = d.Nack(false, true)
-						continue
-					}
-
-					// already completed? (idempotent)
-					if t.Status == "SUCCEEDED" {
-						_ = tx.Commit(ctxMsg)
-						cancelMsg()
-						_ = d.Ack(false)
-						continue
-					}
-
-					// attempts guard
-					if t.Attempts >= t.MaxAttempts {
-						_ = store.MarkFailed(ctxMsg, tx, t.ID, "max attempts exceeded")
-						_ = tx.Commit(ctxMsg)
-						cancelMsg()
-						_ = d.Ack(false)
-						continue
-					}
-
-					// RUNNING (+attempts)
-					if err := store.MarkRunning(ctxMsg, tx, t.ID); err != nil {
-						_ = tx.Rollback(ctxMsg)
-						cancelMsg()
-						_ = d.Nack(false, true)
-						continue
-					}
+	// how often a task of a type no worker serves is handed back before it fails
+	var maxUnhandled int
+	if v := os.Getenv("WORKER_UNHANDLED_MAX"); v != "" {
+		var n int
+		if _, err := fmt.Sscanf(v, "%d", &n); err == nil && n > 0 {
+			maxUnhandled = n
+		}
+	}
 
-					// do work
-					resultJSON, handlerErr := handle(ctxMsg, t.Type, t.Payload)
+	// BROKER=postgres: claims without an outcome before a task is failed
+	var deliveryLimit int
+	if v := os.Getenv("WORKER_DELIVERY_LIMIT"); v != "" {
+		var n int
+		if _, err := fmt.Sscanf(v, "%d", &n); err == nil && n > 0 {
+			deliveryLimit = n
+		}
+	}
 
-					if handlerErr == nil {
-						// write-before-ACK
-						if err := store.MarkSucceeded(ctxMsg, tx, t.ID, resultJSON); err != nil {
-							_ = tx.Rollback(ctxMsg)
-							cancelMsg()
-							_ = d.Nack(false, true)
-							continue
-						}
-						if err := tx.Commit(ctxMsg); err != nil {
-							cancelMsg()
-							_ = d.Nack(false, true)
-							continue
-						}
-						cancelMsg()
-						_ = d.Ack(false)
-						log.Printf("id=%s ok in %s", env.ID, time.Since(start))
-						continue
-					}
+	// tracing: OTEL_TRACES_EXPORTER=otlp|stdout (default none)
+	ctx := context.Background()
+	shutdown, err := tracing.FromEnv(ctx, "dq-worker")
+	if err != nil {
+		log.Fatal("config:", err)
+	}
+	defer shutdown(context.Background())
 
-					// error: retry or final DLQ
-					// compute delay using the post increment attempt number
-					attemptAfter := t.Attempts + 1
-					if attemptAfter < t.MaxAttempts {
-						// persist retry state (status back to ENQUEUED, record last_error)
-						if err := store.MarkRetry(ctxMsg, tx, t.ID, handlerErr.Error()); err != nil {
-							_ = tx.Rollback(ctxMsg)
-							cancelMsg()
-							_ = d.Nack(false, true)
-							continue
-						}
-						if err := tx.Commit(ctxMsg); err != nil {
-							cancelMsg()
-							_ = d.Nack(false, true)
-							continue
-						}
-						cancelMsg()
+	// connections; queries are traced under the task's span
+	pgCfg, err := pgxpool.ParseConfig(dbDSN)
+	if err != nil {
+		log.Fatal("config:", err)
+	}
+	pgCfg.ConnConfig.Tracer = tracing.PgxTracer{}
+	db, err := pgxpool.NewWithConfig(ctx, pgCfg)
+	if err != nil {
+		log.Fatal("pg connect:", err)
+	}
+	defer db.Close()
 
-						// compute delay and publish to retry queue with per-message TTL
-						delay := bo.NextDelay(attemptAfter)
+	// refuse to run against an older schema
+	if err := migrate.Check(context.Background(), db); err != nil {
+		log.Fatal("schema:", err)
+	}
 
-						rk := strings.TrimPrefix(t.Queue, topology.QueuePrefix+".") // "default" | "high"
-						retryQueue := topology.RetryQueueName(rk)
+	// BROKER=rabbitmq (default) | postgres
+	b, err := broker.FromEnv(db, topology, broker.ConsumeConfig{
+		Prefetch:      prefetch,
+		Policy:        policy,
+		Weights:       weights,
+		Visibility:    handlerTimeout + 30*time.Second,
+		DeliveryLimit: deliveryLimit,
+	})
+	if err != nil {
+		log.Fatal("broker:", err)
+	}
+	defer b.Close()
 
-						body, _ := json.Marshal(msgEnvelope{ID: t.ID, Type: t.Type})
-						pub := amqp.Publishing{
-							ContentType: "application/json",
-							Body:        body,
-							Expiration:  strconv.FormatInt(delay.Milliseconds(), 10), // TTL in ms
-						}
-						if err := ch.PublishWithContext(ctxRun, "", retryQueue, false, false, pub); err != nil {
-							log.Printf("retry publish %s: %v", retryQueue, err)
-							_ = d.Nack(false, true)
-							continue
-						}
+	// large payloads/results, when BLOB_STORE is set; must match the API's
+	blobs, err := blob.FromEnv()
+	if err != nil {
+		log.Fatal("config:", err)
+	}
 
-						_ = d.Ack(false)
-						log.Printf("id=%s retry in %s -> %s", t.ID, delay, retryQueue)
-						continue
-					}
+	// keys for encrypt types, when ENCRYPTION_KEYS is set; must match the API's
+	keys, err := envelope.FromEnv()
+	if err != nil {
+		log.Fatal("config:", err)
+	}
 
-					// final failure -> mark FAILED and route to DLQ for inspection
-					_ = store.MarkFailed(ctxMsg, tx, t.ID, handlerErr.Error())
-					_ = tx.Commit(ctxMsg)
-					cancelMsg()
+	w := worker.New(worker.Config{
+		Store:          store.NewPostgres(db),
+		Broker:         b,
+		Topology:       topology,
+		Backoff:        backoff.FromEnv(), // env-driven
+		Queues:         queues,
+		Types:          types,
+		HandlerTimeout: handlerTimeout,
+		LimitDelay:     limitDelay,
+		MaxUnhandled:   maxUnhandled,
+		Blobs:          blobs,
+		Keys:           keys,
+
+		// /metrics (Prometheus), optional
+		MetricsAddr: os.Getenv("WORKER_METRICS_PORT"),
+	})
+	w.Handle("email.send.v1", sendEmail)
 
-					rk := strings.TrimPrefix(t.Queue, topology.QueuePrefix+".")
-					body, _ := json.Marshal(msgEnvelope{ID: t.ID, Type: t.Type})
-					_ = ch.PublishWithContext(ctxRun, topology.DLXExchange, rk, false, false, amqp.Publishing{
-						ContentType: "application/json",
-						Body:        body,
-					})
+	// graceful shutdown
+	ctxRun, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
-					_ = d.Ack(false)
-					log.Printf("id=%s FINAL FAILED: %v", env.ID, handlerErr)
-				}
-			}
-		}(queue, tag, deliveries)
+	if err := w.Run(ctxRun); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	// wait for shutdown
-	<-ctxRun.Done()
-	log.Println("worker: shutting down...")
-	for _, tag := range tags {
-		_ = ch.Cancel(tag, false)
+func splitCSV(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if v := strings.TrimSpace(p); v != "" {
+			out = append(out, v)
+		}
 	}
-	wg.Wait()
-	log.Println("worker: stopped")
+	return out
 }
 
 // example handler
-func handle(ctx context.Context, typ string, payload []byte) ([]byte, error) {
-	switch typ {
-	case "email.send.v1":
-		// TODO: actual work goes here
-		// simulate the work with some delay
-		time.Sleep(100 * time.Millisecond)
-		return []byte(`{"ok":true,"provider":"stub"}`), nil
-	default:
-		return nil, fmt.Errorf("no handler for type %q", typ)
-	}
+func sendEmail(ctx context.Context, payload []byte) ([]byte, error) {
+	// TODO: actual work goes here
+	worker.Logger(ctx).Debug("sending email (stub)")
+	// simulate the work with some delay
+	time.Sleep(100 * time.Millisecond)
+	return []byte(`{"ok":true,"provider":"stub"}`), nil
 }
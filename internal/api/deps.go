@@ -1,13 +1,23 @@
 package api
 
 import (
-	"github.com/jackc/pgx/v5/pgxpool"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/henok3878/distributed-task-queue/internal/blob"
+	"github.com/henok3878/distributed-task-queue/internal/broker"
+	"github.com/henok3878/distributed-task-queue/internal/envelope"
 	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/internal/store"
 )
 
 type Deps struct {
-	DB       *pgxpool.Pool
-	RMQ      *amqp.Channel
+	Store    store.Store
+	Broker   broker.Broker
 	Topology rmq.Topology
-}
\ No newline at end of file
+	Watcher  store.Watcher     // wakes /tasks/{id}/wait and /stream; nil leaves them unregistered
+	Blobs    *blob.Offloader   // large payloads/results; nil keeps them inline
+	Keys     *envelope.Keyring // seals payloads of encrypt types; nil rejects them
+	Webhooks bool              // a webhook.Dispatcher runs; callback_url is rejected without one
+
+	// ReadToken is the bearer token that lets task reads see decrypted
+	// results; "" means encrypted results are always redacted.
+	ReadToken string
+}
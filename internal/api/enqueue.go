@@ -6,15 +6,26 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/henok3878/distributed-task-queue/internal/blob"
+	"github.com/henok3878/distributed-task-queue/internal/broker"
+	"github.com/henok3878/distributed-task-queue/internal/logging"
 	"github.com/henok3878/distributed-task-queue/internal/metrics"
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
 	"github.com/henok3878/distributed-task-queue/internal/store"
+	"github.com/henok3878/distributed-task-queue/internal/tracing"
 )
 
 type EnqueueRequest struct {
@@ -22,17 +33,24 @@ type EnqueueRequest struct {
 	Queue          string          `json:"queue,omitempty"`           // optional override: "default"/"high"
 	MaxAttempts    int             `json:"max_attempts,omitempty"`    // optional override
 	IdempotencyKey string          `json:"idempotency_key,omitempty"` // optional dedupe
+	Priority       *int            `json:"priority,omitempty"`        // optional: 0..RMQ_MAX_PRIORITY
+	CallbackURL    string          `json:"callback_url,omitempty"`    // optional: POSTed the task when it finishes
 	Payload        json.RawMessage `json:"payload"`                   // required
 }
 type EnqueueResponse struct {
 	ID     string `json:"id"`
 	Status string `json:"status"`
 	Queue  string `json:"queue"`
+
+	// with ?wait=, once the task finished in time
+	Result    json.RawMessage `json:"result,omitempty"`
+	LastError *string         `json:"last_error,omitempty"`
+	Encrypted bool            `json:"encrypted,omitempty"` // result left out unless revealed
 }
 
 func RegisterEnqueue(mux *http.ServeMux, d Deps) {
 	mux.HandleFunc("POST /enqueue", func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, 1<<20) // 1MiB cap
+		r.Body = http.MaxBytesReader(w, r.Body, d.maxBody())
 		defer r.Body.Close()
 
 		var req EnqueueRequest
@@ -48,23 +66,56 @@ func RegisterEnqueue(mux *http.ServeMux, d Deps) {
 			ErrorJSON(w, http.StatusBadRequest, "payload is required")
 			return
 		}
+		// ?wait=5s: answer with the result if the task finishes by then
+		var wait time.Duration
+		if v := r.URL.Query().Get("wait"); v != "" {
+			dur, err := time.ParseDuration(v)
+			if err != nil || dur <= 0 || dur > maxWait {
+				ErrorJSON(w, http.StatusBadRequest, "wait must be a duration in (0, %s]", maxWait)
+				return
+			}
+			if d.Watcher == nil {
+				ErrorJSON(w, http.StatusBadRequest, "wait is not supported by this server")
+				return
+			}
+			wait = dur
+		}
 
 		// start timing & ensure metric emission (ok|error) - capture all requests including validation errors
 		start := time.Now()
 		status := "ok"
 		var finalQueue string
+		var latency float64 // set before a ?wait=, which isn't enqueue latency
 		defer func() {
 			t := metrics.LabelOrUnknown(req.Type)
 			q := metrics.LabelOrUnknown(finalQueue)
-			metrics.EnqueueLatency.WithLabelValues(t, q).Observe(metrics.ObserveDuration(start))
+			if latency == 0 {
+				latency = metrics.ObserveDuration(start)
+			}
+			metrics.EnqueueLatency.WithLabelValues(t, q).Observe(latency)
 			metrics.EnqueueTotal.WithLabelValues(t, q, status).Inc()
 		}()
 
-		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		// the trace follows the task: store calls, publish, and (via message
+		// headers) the worker; a caller's traceparent is continued
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, "POST /enqueue", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("task.type", req.Type)))
+		defer func() {
+			span.SetAttributes(attribute.String("task.queue", finalQueue))
+			if status == "error" {
+				span.SetStatus(codes.Error, "enqueue failed")
+			}
+			span.End()
+		}()
+
+		reqCtx := ctx
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 		defer cancel()
+		log := logging.FromContext(ctx).With("type", req.Type)
 
 		// registry defaults
-		active, defQ, defMax, err := store.GetTypeDefaults(ctx, d.DB, req.Type)
+		tt, err := d.Store.GetType(ctx, req.Type)
 		if errors.Is(err, pgx.ErrNoRows) {
 			status = "error"
 			ErrorJSON(w, http.StatusBadRequest, "unknown type %q", req.Type)
@@ -72,10 +123,11 @@ func RegisterEnqueue(mux *http.ServeMux, d Deps) {
 		}
 		if err != nil {
 			status = "error"
+			log.Error("get type", "err", err)
 			ErrorJSON(w, http.StatusInternalServerError, "db error: %v", err)
 			return
 		}
-		if !active {
+		if !tt.Active {
 			status = "error"
 			ErrorJSON(w, http.StatusBadRequest, "type %q is not active", req.Type)
 			return
@@ -84,7 +136,7 @@ func RegisterEnqueue(mux *http.ServeMux, d Deps) {
 		// resolve queue/attempts with guardrails
 		queue := strings.TrimSpace(req.Queue)
 		if queue == "" {
-			queue = defQ
+			queue = tt.DefaultQueue
 		}
 		if !contains(d.Topology.RoutingKeys, queue) {
 			status = "error"
@@ -93,7 +145,7 @@ func RegisterEnqueue(mux *http.ServeMux, d Deps) {
 		}
 		maxAttempts := req.MaxAttempts
 		if maxAttempts == 0 {
-			maxAttempts = defMax
+			maxAttempts = tt.DefaultMaxAttempts
 		}
 		if maxAttempts < 1 || maxAttempts > 20 {
 			status = "error"
@@ -101,31 +153,169 @@ func RegisterEnqueue(mux *http.ServeMux, d Deps) {
 			return
 		}
 
-		// insert (idempotent on idempotency_key)
+		priority := 0
+		if req.Priority != nil {
+			priority = *req.Priority
+		}
+		if priority < 0 || priority > int(d.Topology.MaxPriority) {
+			status = "error"
+			ErrorJSON(w, http.StatusBadRequest, "priority out of range (0..%d)", d.Topology.MaxPriority)
+			return
+		}
+
+		// a type's default set while webhooks were on is dropped when they
+		// are off, so its producers keep working; an explicit one is a 400
+		callback := strings.TrimSpace(req.CallbackURL)
+		if callback == "" && tt.CallbackURL != nil && d.Webhooks {
+			callback = *tt.CallbackURL
+		}
+		if err := d.checkCallback(callback); err != nil {
+			status = "error"
+			ErrorJSON(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+
+		// encrypt types store an envelope; sealed before offloading, so
+		// blobs are encrypted too
 		taskID := newID()
-		outID, outStatus, outQueue, err := store.UpsertEnqueue(ctx, d.DB, taskID, req.Type, queue, req.Payload, req.IdempotencyKey, maxAttempts)
+		payload := []byte(req.Payload)
+		if tt.Encrypt {
+			if payload, err = d.Keys.Seal(payload, blob.PayloadKey(taskID)); err != nil {
+				status = "error"
+				log.Error("seal payload", "err", err)
+				ErrorJSON(w, http.StatusServiceUnavailable, "encryption: %v", err)
+				return
+			}
+		}
+
+		// large payloads go to the blob store, the row keeps the key. not
+		// under the 2s db timeout: uploads take what they take
+		payload, payloadRef, err := d.Blobs.Offload(reqCtx, blob.PayloadKey(taskID), payload)
 		if err != nil {
 			status = "error"
+			log.Error("offload payload", "err", err)
+			ErrorJSON(w, http.StatusServiceUnavailable, "blob store: %v", err)
+			return
+		}
+
+		// insert (idempotent on idempotency_key)
+		nt := store.NewTask{
+			ID: taskID, Type: req.Type, Queue: queue, Payload: payload, PayloadRef: payloadRef,
+			IdempotencyKey: req.IdempotencyKey, MaxAttempts: maxAttempts, Priority: priority, CallbackURL: callback,
+			Encrypted: tt.Encrypt,
+		}
+		// the Postgres broker publishes in the insert's transaction
+		txPub, inTx := d.Broker.(broker.TxPublisher)
+		if inTx {
+			nt.Publish = func(ctx context.Context, tx pgx.Tx, id, queue string, priority int) error {
+				return txPub.PublishTx(ctx, tx, broker.Message{ID: id, Type: req.Type, Queue: queue, Priority: uint8(priority)})
+			}
+		}
+		outID, outStatus, outQueue, outPriority, err := d.Store.UpsertEnqueue(ctx, nt)
+		if payloadRef != "" && (err != nil || outID != taskID) {
+			// not stored, or coalesced onto an earlier task: the blob is ours alone
+			_ = d.Blobs.Store.Delete(reqCtx, payloadRef)
+		}
+		if err != nil {
+			status = "error"
+			log.Error("insert task", "err", err)
 			ErrorJSON(w, http.StatusInternalServerError, "insert error: %v", err)
 			return
 		}
+		log = log.With("task_id", outID, "queue", outQueue)
 
 		// use the canonical queue from DB for metrics
 		finalQueue = outQueue
+		span.SetAttributes(attribute.String("task.id", outID))
 
 		// publish minimal persistent message (workers fetch payload by id)
-		body, _ := json.Marshal(map[string]string{"id": outID, "type": req.Type})
-		pub := amqp.Publishing{ContentType: "application/json", DeliveryMode: amqp.Persistent, Body: body}
-		if err := d.RMQ.PublishWithContext(ctx, d.Topology.Namespace+".direct", outQueue, false, false, pub); err != nil {
-			status = "error"
-			ErrorJSON(w, http.StatusServiceUnavailable, "publish failed: %v", err)
+		if !inTx {
+			msg := broker.Message{ID: outID, Type: req.Type, Queue: outQueue, Priority: uint8(outPriority)}
+			if err := d.Broker.Publish(ctx, msg); err != nil {
+				status = "error"
+				log.Error("publish", "err", err)
+				ErrorJSON(w, http.StatusServiceUnavailable, "publish failed: %v", err)
+				return
+			}
+		}
+
+		// best-effort mirror onto the event stream (no-op unless enabled)
+		_ = d.Broker.Event(ctx, rmq.Event{TaskID: outID, Type: req.Type, Queue: outQueue, Event: "ENQUEUED"})
+
+		if tt.DeprecatedAt != nil {
+			deprecation(w, tt)
+			log.Warn("deprecated type enqueued")
+		}
+		log.Info("task enqueued", "status", outStatus, "priority", outPriority)
+		res := EnqueueResponse{ID: outID, Status: outStatus, Queue: outQueue}
+		if wait == 0 {
+			WriteJSON(w, http.StatusCreated, res)
 			return
 		}
 
-		WriteJSON(w, http.StatusCreated, EnqueueResponse{ID: outID, Status: outStatus, Queue: outQueue})
+		latency = metrics.ObserveDuration(start)
+		span.SetAttributes(attribute.String("enqueue.wait", wait.String()))
+		t, err := d.waitTask(reqCtx, outID, wait, d.reveal(r))
+		if reqCtx.Err() != nil {
+			return // client went away; the task runs regardless
+		}
+		if err != nil {
+			log.Warn("wait for task", "err", err)
+		}
+		if err != nil || !store.Terminal(t.Status) {
+			// still running: poll /tasks/{id} or /tasks/{id}/wait
+			w.Header().Set("Location", "/tasks/"+outID)
+			if err == nil {
+				res.Status = t.Status
+			}
+			WriteJSON(w, http.StatusAccepted, res)
+			return
+		}
+		res.Status, res.LastError, res.Encrypted = t.Status, t.LastError, t.Encrypted
+		if t.Status == "SUCCEEDED" {
+			res.Result = t.ResultJSON
+		}
+		WriteJSON(w, http.StatusOK, res)
 	})
 }
 
+// deprecation tells the producer it enqueued a deprecated type version
+// (RFC 9745 Deprecation, plus a Warning readable by humans and old clients).
+func deprecation(w http.ResponseWriter, t store.TaskType) {
+	msg := fmt.Sprintf("task type %s is deprecated", t.Type)
+	if t.ReplacedBy != nil {
+		msg += ", use " + *t.ReplacedBy
+		w.Header().Set("Link", fmt.Sprintf(`</types/%s>; rel="successor-version"`, *t.ReplacedBy))
+	}
+	w.Header().Set("Deprecation", fmt.Sprintf("@%d", t.DeprecatedAt.Unix()))
+	w.Header().Set("Warning", fmt.Sprintf("299 - %q", msg))
+}
+
+// maxBody caps enqueue bodies: 1 MiB inline, more with a blob store.
+func (d Deps) maxBody() int64 {
+	if d.Blobs != nil && d.Blobs.MaxSize > 1<<20 {
+		return int64(d.Blobs.MaxSize)
+	}
+	return 1 << 20
+}
+
+// checkCallback accepts "" (no webhook) or an absolute http(s) URL, the
+// latter only when the dispatcher runs. addresses the URL resolves to are
+// checked when it is called (webhook.Dispatcher.Allow).
+func (d Deps) checkCallback(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	if !d.Webhooks {
+		return invalid("callback_url needs webhooks enabled (WEBHOOK_SECRET)")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(raw) > 2048 {
+		return invalid(fmt.Sprintf("callback_url must be an absolute http(s) URL (got %q)", raw))
+	}
+	return nil
+}
+
 func newID() string {
 	var b [16]byte
 	_, _ = rand.Read(b[:])
@@ -0,0 +1,134 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/henok3878/distributed-task-queue/internal/api"
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/internal/testkit"
+	"github.com/henok3878/distributed-task-queue/pkg/worker"
+)
+
+func newKit() *testkit.Kit {
+	k := testkit.New(rmq.New("tasks", "default", "high"), worker.Config{})
+	k.Store.AddType("email.send.v1", testkit.Type{Active: true, Queue: "high", MaxAttempts: 5})
+	k.Store.AddType("old.v1", testkit.Type{Active: false, Queue: "default", MaxAttempts: 5})
+	return k
+}
+
+func TestEnqueueValidation(t *testing.T) {
+	k := newKit()
+	payload := json.RawMessage(`{}`)
+	cases := []struct {
+		name string
+		req  api.EnqueueRequest
+	}{
+		{"missing type", api.EnqueueRequest{Payload: payload}},
+		{"missing payload", api.EnqueueRequest{Type: "email.send.v1"}},
+		{"unknown type", api.EnqueueRequest{Type: "nope.v1", Payload: payload}},
+		{"inactive type", api.EnqueueRequest{Type: "old.v1", Payload: payload}},
+		{"queue not in topology", api.EnqueueRequest{Type: "email.send.v1", Queue: "low", Payload: payload}},
+		{"max attempts", api.EnqueueRequest{Type: "email.send.v1", MaxAttempts: 21, Payload: payload}},
+		{"callback url", api.EnqueueRequest{Type: "email.send.v1", CallbackURL: "ftp://example.com/x", Payload: payload}},
+	}
+	for _, c := range cases {
+		if rec := k.Do(http.MethodPost, "/enqueue", c.req); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400 (%s)", c.name, rec.Code, rec.Body)
+		}
+	}
+	if n := len(k.Broker.Published()); n != 0 {
+		t.Fatalf("published %d messages for rejected requests", n)
+	}
+}
+
+func TestCallbackNeedsWebhooks(t *testing.T) {
+	k := newKit()
+	mux := http.NewServeMux()
+	deps := api.Deps{Store: k.Store, Broker: k.Broker, Topology: k.Topology} // no dispatcher
+	api.RegisterEnqueue(mux, deps)
+	api.RegisterTypes(mux, deps)
+	do := func(method, path, body string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec.Code
+	}
+
+	if code := do(http.MethodPost, "/enqueue", `{"type":"email.send.v1","payload":{},"callback_url":"https://example.com/hook"}`); code != http.StatusBadRequest {
+		t.Fatalf("enqueue with callback: %d", code)
+	}
+	if code := do(http.MethodPatch, "/types/email.send.v1", `{"callback_url":"https://example.com/hook"}`); code != http.StatusBadRequest {
+		t.Fatalf("type callback: %d", code)
+	}
+	if code := do(http.MethodPatch, "/types/email.send.v1", `{"callback_url":""}`); code != http.StatusOK {
+		t.Fatalf("clearing a type callback: %d", code)
+	}
+}
+
+func TestEnqueueUsesTypeDefaults(t *testing.T) {
+	k := newKit()
+	res, err := k.Enqueue(api.EnqueueRequest{Type: "email.send.v1", Payload: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Queue != "high" || res.Status != "ENQUEUED" {
+		t.Fatalf("got %+v", res)
+	}
+	pub := k.Broker.Published()
+	if len(pub) != 1 || pub[0].ID != res.ID || pub[0].Queue != "high" {
+		t.Fatalf("published %+v", pub)
+	}
+}
+
+func TestEnqueueIdempotent(t *testing.T) {
+	k := newKit()
+	req := api.EnqueueRequest{Type: "email.send.v1", IdempotencyKey: "k1", Payload: json.RawMessage(`{}`)}
+	a, err := k.Enqueue(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := k.Enqueue(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID != b.ID {
+		t.Fatalf("ids differ: %s vs %s", a.ID, b.ID)
+	}
+}
+
+func TestGetTask(t *testing.T) {
+	k := newKit()
+	if rec := k.Do(http.MethodGet, "/tasks/missing", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("missing task: status %d", rec.Code)
+	}
+
+	res, err := k.Enqueue(api.EnqueueRequest{Type: "email.send.v1", Payload: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := k.Do(http.MethodGet, "/tasks/"+res.ID, nil)
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d body %s", rec.Code, rec.Body)
+	}
+	if got["status"] != "ENQUEUED" || got["queue"] != "high" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	k := newKit()
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	rec := httptest.NewRecorder()
+	k.API.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-ID"); got != "req-1" {
+		t.Fatalf("echoed id = %q", got)
+	}
+	if rec := k.Do(http.MethodGet, "/healthz", nil); len(rec.Header().Get("X-Request-ID")) != 32 {
+		t.Fatalf("generated id = %q", rec.Header().Get("X-Request-ID"))
+	}
+}
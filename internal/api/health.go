@@ -4,6 +4,8 @@ import (
 	"context"
 	"net/http"
 	"time"
+
+	"github.com/henok3878/distributed-task-queue/internal/broker"
 )
 
 func RegisterHealth(mux *http.ServeMux, d Deps) {
@@ -12,40 +14,24 @@ func RegisterHealth(mux *http.ServeMux, d Deps) {
 		defer cancel()
 
 		// dp ping
-		if err := d.DB.Ping(ctx); err != nil {
+		if err := d.Store.Ping(ctx); err != nil {
 			WriteJSON(w, http.StatusServiceUnavailable, map[string]string{
 				"status": "degraded", "db": "down: " + err.Error(),
 			})
 			return
 		}
 
-		// exchanges
-		if err := d.RMQ.ExchangeDeclarePassive(
-			d.Topology.MainExchange, "direct", true, false, false, false, nil,
-		); err != nil {
-			ErrorJSON(w, http.StatusServiceUnavailable, "main exchange missing (%s): %v", d.Topology.MainExchange, err)
-			return
-		}
-		if err := d.RMQ.ExchangeDeclarePassive(
-			d.Topology.DLXExchange, "direct", true, false, false, false, nil,
-		); err != nil {
-			ErrorJSON(w, http.StatusServiceUnavailable, "dlx exchange missing (%s): %v", d.Topology.DLXExchange, err)
+		// exchanges/queues (and their declared types) or the queue table
+		if err := d.Broker.Check(ctx); err != nil {
+			ErrorJSON(w, http.StatusServiceUnavailable, "broker: %v", err)
 			return
 		}
 
-		// queues
-		for _, rk := range d.Topology.RoutingKeys {
-			name := d.Topology.FullQueueName(rk)
-			if _, err := d.RMQ.QueueDeclarePassive(name, true, false, false, false, nil); err != nil {
-				ErrorJSON(w, http.StatusServiceUnavailable, "queue missing: %s", name)
-				return
-			}
+		res := map[string]string{"status": "ok"}
+		// whether queue arguments were compared too, or only existence
+		if r, ok := d.Broker.(broker.ArgsReporter); ok {
+			res["queue_args"] = r.ArgsStatus()
 		}
-		if _, err := d.RMQ.QueueDeclarePassive(d.Topology.DLQName, true, false, false, false, nil); err != nil {
-			ErrorJSON(w, http.StatusServiceUnavailable, "dlq missing: %v", err)
-			return
-		}
-
-		WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		WriteJSON(w, http.StatusOK, res)
 	})
 }
@@ -1,16 +1,30 @@
 package api
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 
+	"github.com/henok3878/distributed-task-queue/internal/blob"
+	"github.com/henok3878/distributed-task-queue/internal/logging"
 	"github.com/henok3878/distributed-task-queue/internal/store"
 )
 
+const (
+	defaultWait = 30 * time.Second
+	maxWait     = time.Minute
+	keepalive   = 15 * time.Second
+)
+
 func RegisterTasks(mux *http.ServeMux, d Deps) {
 	mux.HandleFunc("GET /tasks/{id}", func(w http.ResponseWriter, r *http.Request) {
 		id := strings.TrimSpace(r.PathValue("id"))
@@ -19,7 +33,7 @@ func RegisterTasks(mux *http.ServeMux, d Deps) {
 			return
 		}
 
-		t, err := store.GetTask(r.Context(), d.DB, id)
+		t, err := d.task(r.Context(), id, d.reveal(r))
 		if errors.Is(err, pgx.ErrNoRows) {
 			WriteJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
 			return
@@ -28,24 +42,205 @@ func RegisterTasks(mux *http.ServeMux, d Deps) {
 			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 			return
 		}
+		WriteJSON(w, http.StatusOK, taskJSON(t))
+	})
+
+	// completion webhook attempts, oldest first
+	mux.HandleFunc("GET /tasks/{id}/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if _, err := d.Store.GetTask(r.Context(), id); errors.Is(err, pgx.ErrNoRows) {
+			ErrorJSON(w, http.StatusNotFound, "not found")
+			return
+		} else if err != nil {
+			ErrorJSON(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		ds, err := d.Store.ListWebhooks(r.Context(), id)
+		if err != nil {
+			ErrorJSON(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]any{"deliveries": ds})
+	})
+
+	if d.Watcher == nil {
+		return
+	}
+
+	// long-poll: 200 once the task is terminal, 202 with its current state
+	// when timeout passes first
+	mux.HandleFunc("GET /tasks/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		timeout := defaultWait
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			dur, err := time.ParseDuration(v)
+			if err != nil || dur <= 0 || dur > maxWait {
+				ErrorJSON(w, http.StatusBadRequest, "timeout must be a duration in (0, %s]", maxWait)
+				return
+			}
+			timeout = dur
+		}
+
+		t, err := d.waitTask(r.Context(), r.PathValue("id"), timeout, d.reveal(r))
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			ErrorJSON(w, http.StatusNotFound, "not found")
+		case r.Context().Err() != nil:
+			// client went away
+		case err != nil:
+			ErrorJSON(w, http.StatusInternalServerError, "%v", err)
+		case !store.Terminal(t.Status):
+			WriteJSON(w, http.StatusAccepted, taskJSON(t))
+		default:
+			WriteJSON(w, http.StatusOK, taskJSON(t))
+		}
+	})
+
+	// server-sent events: one "message" per task_events row (id = event id,
+	// so Last-Event-ID resumes), then "done" with the final task
+	mux.HandleFunc("GET /tasks/{id}/stream", func(w http.ResponseWriter, r *http.Request) {
+		ctx, id, reveal := r.Context(), r.PathValue("id"), d.reveal(r)
+		wake, stop := d.Watcher.Watch(id)
+		defer stop()
 
-		// stream result as raw JSON
-		var result any
-		if len(t.ResultJSON) > 0 {
-			_ = json.Unmarshal(t.ResultJSON, &result)
+		if _, err := d.Store.GetTask(ctx, id); errors.Is(err, pgx.ErrNoRows) {
+			ErrorJSON(w, http.StatusNotFound, "not found")
+			return
+		} else if err != nil {
+			ErrorJSON(w, http.StatusInternalServerError, "%v", err)
+			return
 		}
+		last, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
 
-		WriteJSON(w, http.StatusOK, map[string]any{
-			"id":           t.ID,
-			"type":         t.Type,
-			"queue":        t.Queue,
-			"status":       t.Status,
-			"attempts":     t.Attempts,
-			"max_attempts": t.MaxAttempts,
-			"last_error":   t.LastError,
-			"result":       result,
-			"created_at":   t.CreatedAt,
-			"updated_at":   t.UpdatedAt,
-		})
+		tick := time.NewTicker(keepalive)
+		defer tick.Stop()
+		for {
+			// read the task before its events: the terminal event is
+			// committed with the status, so it is in the list that follows
+			t, err := d.task(ctx, id, reveal)
+			if err != nil {
+				logging.FromContext(ctx).Error("stream task", "task_id", id, "err", err)
+				return
+			}
+			evs, err := d.Store.ListTaskEvents(ctx, id, last)
+			if err != nil {
+				logging.FromContext(ctx).Error("stream task events", "task_id", id, "err", err)
+				return
+			}
+			for _, e := range evs {
+				writeEvent(w, strconv.FormatInt(e.ID, 10), "", e)
+				last = e.ID
+			}
+			if store.Terminal(t.Status) {
+				writeEvent(w, "", "done", taskJSON(t))
+				_ = rc.Flush()
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case <-wake:
+			case <-tick.C:
+				_, _ = io.WriteString(w, ": keepalive\n\n")
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
 	})
 }
+
+// waitTask returns id's row once it is terminal, or as it is when timeout
+// passes. it watches before reading, so a change committed in between still
+// wakes it.
+func (d Deps) waitTask(ctx context.Context, id string, timeout time.Duration, reveal bool) (store.TaskRow, error) {
+	wake, stop := d.Watcher.Watch(id)
+	defer stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		t, err := d.task(ctx, id, reveal)
+		if err != nil || store.Terminal(t.Status) {
+			return t, err
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+			return t, nil
+		case <-ctx.Done():
+			return t, ctx.Err()
+		}
+	}
+}
+
+// task reads id, with an offloaded result loaded back in. an encrypted
+// result is decrypted when reveal is set and left out otherwise.
+func (d Deps) task(ctx context.Context, id string, reveal bool) (store.TaskRow, error) {
+	t, err := d.Store.GetTask(ctx, id)
+	if err != nil {
+		return t, err
+	}
+	if t.Encrypted && !reveal {
+		t.ResultJSON = nil
+		return t, nil
+	}
+	if t.ResultRef != nil {
+		if t.ResultJSON, err = d.Blobs.Load(ctx, nil, *t.ResultRef); err != nil {
+			return t, err
+		}
+	}
+	if t.Encrypted && t.Status == "SUCCEEDED" {
+		t.ResultJSON, err = d.Keys.Open(t.ResultJSON, blob.ResultKey(t.ID))
+	}
+	return t, err
+}
+
+// reveal reports whether r may see decrypted results: it carries
+// Authorization: Bearer <ReadToken>.
+func (d Deps) reveal(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && d.ReadToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(d.ReadToken)) == 1
+}
+
+func taskJSON(t store.TaskRow) map[string]any {
+	// stream result as raw JSON
+	var result any
+	if len(t.ResultJSON) > 0 {
+		_ = json.Unmarshal(t.ResultJSON, &result)
+	}
+	return map[string]any{
+		"id":           t.ID,
+		"type":         t.Type,
+		"queue":        t.Queue,
+		"status":       t.Status,
+		"attempts":     t.Attempts,
+		"max_attempts": t.MaxAttempts,
+		"priority":     t.Priority,
+		"last_error":   t.LastError,
+		"result":       result,
+		"callback_url": t.CallbackURL,
+		"encrypted":    t.Encrypted, // result is null unless revealed
+		"created_at":   t.CreatedAt,
+		"updated_at":   t.UpdatedAt,
+	}
+}
+
+// writeEvent writes one SSE event; empty id and event are left out.
+func writeEvent(w io.Writer, id, event string, v any) {
+	data, _ := json.Marshal(v)
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	if event != "" {
+		fmt.Fprintf(w, "event: %s\n", event)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
@@ -0,0 +1,199 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/henok3878/distributed-task-queue/internal/api"
+	"github.com/henok3878/distributed-task-queue/internal/envelope"
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/internal/store"
+	"github.com/henok3878/distributed-task-queue/internal/testkit"
+	"github.com/henok3878/distributed-task-queue/pkg/worker"
+)
+
+func startTask(t *testing.T, k *testkit.Kit) string {
+	t.Helper()
+	k.Worker.Handle("email.send.v1", func(context.Context, []byte) ([]byte, error) {
+		return []byte(`{"sent":true}`), nil
+	})
+	k.Start(t)
+	res, err := k.Enqueue(api.EnqueueRequest{Type: "email.send.v1", Payload: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.ID
+}
+
+func TestWaitForTask(t *testing.T) {
+	k := newKit()
+	id := startTask(t, k)
+
+	if rec := k.Do(http.MethodGet, "/tasks/"+id+"/wait?timeout=10ms", nil); rec.Code != http.StatusAccepted ||
+		decode[map[string]any](t, rec.Body.Bytes())["status"] != "ENQUEUED" {
+		t.Fatalf("timed out wait: %d %s", rec.Code, rec.Body)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- k.Do(http.MethodGet, "/tasks/"+id+"/wait?timeout=5s", nil) }()
+	k.Deliver()
+	rec := <-done
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wait: %d %s", rec.Code, rec.Body)
+	}
+	if got := decode[map[string]any](t, rec.Body.Bytes()); got["status"] != "SUCCEEDED" || got["result"].(map[string]any)["sent"] != true {
+		t.Fatalf("wait = %v", got)
+	}
+
+	for path, code := range map[string]int{
+		"/tasks/nope/wait":                      http.StatusNotFound,
+		"/tasks/" + id + "/wait?timeout=2m":     http.StatusBadRequest,
+		"/tasks/" + id + "/wait?timeout=banana": http.StatusBadRequest,
+	} {
+		if rec := k.Do(http.MethodGet, path, nil); rec.Code != code {
+			t.Errorf("%s: %d, want %d", path, rec.Code, code)
+		}
+	}
+}
+
+func TestStreamTask(t *testing.T) {
+	k := newKit()
+	id := startTask(t, k)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- k.Do(http.MethodGet, "/tasks/"+id+"/stream", nil) }()
+	k.Deliver()
+	rec := <-done
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	evs := sse(t, rec.Body.String())
+	var got []string
+	for _, e := range evs[:len(evs)-1] {
+		got = append(got, decode[store.TaskEvent](t, []byte(e.data)).Event)
+	}
+	if strings.Join(got, ",") != "ENQUEUED,RUNNING,SUCCEEDED" || evs[len(evs)-1].event != "done" {
+		t.Fatalf("stream = %+v", evs)
+	}
+
+	// resuming after the last event only gets the final task
+	req := httptest.NewRequest(http.MethodGet, "/tasks/"+id+"/stream", nil)
+	req.Header.Set("Last-Event-ID", evs[len(evs)-2].id)
+	rec = httptest.NewRecorder()
+	k.API.ServeHTTP(rec, req)
+	if evs := sse(t, rec.Body.String()); len(evs) != 1 || evs[0].event != "done" {
+		t.Fatalf("resumed stream = %+v", evs)
+	}
+}
+
+type sseEvent struct{ id, event, data string }
+
+func sse(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var out []sseEvent
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var e sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			k, v, _ := strings.Cut(line, ": ")
+			switch k {
+			case "id":
+				e.id = v
+			case "event":
+				e.event = v
+			case "data":
+				e.data = v
+			}
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func TestEnqueueAndWait(t *testing.T) {
+	k := newKit()
+	startTask(t, k)
+	body := map[string]any{"type": "email.send.v1", "payload": map[string]any{}}
+
+	rec := k.Do(http.MethodPost, "/enqueue?wait=10ms", body)
+	if rec.Code != http.StatusAccepted || !strings.HasPrefix(rec.Header().Get("Location"), "/tasks/") {
+		t.Fatalf("undelivered: %d %v %s", rec.Code, rec.Header(), rec.Body)
+	}
+	if rec := k.Do(http.MethodPost, "/enqueue?wait=1h", body); rec.Code != http.StatusBadRequest {
+		t.Fatalf("wait=1h: %d", rec.Code)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- k.Do(http.MethodPost, "/enqueue?wait=5s", body) }()
+	for rec = nil; rec == nil; {
+		select {
+		case rec = <-done:
+		default:
+			k.Deliver() // runs the task once it's published
+		}
+	}
+	res := decode[api.EnqueueResponse](t, rec.Body.Bytes())
+	if rec.Code != http.StatusOK || res.Status != "SUCCEEDED" || string(res.Result) != `{"sent":true}` {
+		t.Fatalf("wait: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestEncryptedTask(t *testing.T) {
+	// without keys the type can't opt in
+	if rec := newKit().Do(http.MethodPatch, "/types/email.send.v1", map[string]any{"encrypt": true}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("encrypt without keys: %d %s", rec.Code, rec.Body)
+	}
+
+	keys, err := envelope.NewKeyring("k1", map[string][]byte{"k1": make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := testkit.New(rmq.New("tasks", "default"), worker.Config{Keys: keys})
+	k.Store.AddType("pii.v1", testkit.Type{Active: true, Queue: "default", MaxAttempts: 1, Encrypt: true})
+	var got string
+	k.Worker.Handle("pii.v1", func(_ context.Context, payload []byte) ([]byte, error) {
+		got = string(payload)
+		return []byte(`{"dob":"1970-01-01"}`), nil
+	})
+	k.Start(t)
+
+	res, err := k.Enqueue(api.EnqueueRequest{Type: "pii.v1", Payload: json.RawMessage(`{"ssn":"123-45-6789"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := k.Store.Payload(res.ID); strings.Contains(string(stored), "123-45") {
+		t.Fatalf("stored payload in the clear: %s", stored)
+	}
+	k.Deliver()
+	if got != `{"ssn":"123-45-6789"}` {
+		t.Fatalf("handler payload = %s", got)
+	}
+	if row, _ := k.Store.Task(res.ID); row.Status != "SUCCEEDED" || strings.Contains(string(row.ResultJSON), "1970") {
+		t.Fatalf("stored result: %s %s", row.Status, row.ResultJSON)
+	}
+
+	read := func(auth string) map[string]any {
+		req := httptest.NewRequest(http.MethodGet, "/tasks/"+res.ID, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		k.API.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", auth, rec.Code, rec.Body)
+		}
+		return decode[map[string]any](t, rec.Body.Bytes())
+	}
+	if got := read(""); got["encrypted"] != true || got["result"] != nil {
+		t.Fatalf("default read: %v", got)
+	}
+	if got := read("Bearer wrong"); got["result"] != nil {
+		t.Fatalf("wrong token: %v", got)
+	}
+	if got := read("Bearer " + testkit.ReadToken); got["result"].(map[string]any)["dob"] != "1970-01-01" {
+		t.Fatalf("token read: %v", got)
+	}
+}
@@ -0,0 +1,306 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/henok3878/distributed-task-queue/internal/store"
+)
+
+// TypeRequest registers (POST) or changes (PATCH) a task type. omitted fields
+// keep their value; on PATCH a 0 limit clears it (unlimited).
+type TypeRequest struct {
+	Type               string          `json:"type,omitempty"` // POST only
+	Active             *bool           `json:"active,omitempty"`
+	DefaultQueue       *string         `json:"default_queue,omitempty"`
+	DefaultMaxAttempts *int            `json:"default_max_attempts,omitempty"`
+	PayloadSchema      json.RawMessage `json:"payload_schema,omitempty"` // JSON object, null clears
+	MaxConcurrency     *int            `json:"max_concurrency,omitempty"`
+	RateLimitPerSec    *float64        `json:"rate_limit_per_sec,omitempty"`
+	RateLimitBurst     *int            `json:"rate_limit_burst,omitempty"`
+	CallbackURL        *string         `json:"callback_url,omitempty"` // "" clears
+	Encrypt            *bool           `json:"encrypt,omitempty"`      // seal payloads/results of new tasks
+	Deprecated         *bool           `json:"deprecated,omitempty"`
+	ReplacedBy         *string         `json:"replaced_by,omitempty"` // newer version of the family, "" clears
+}
+
+// ex: email.send.v1 (family email.send, version 1)
+var typeName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,127}$`)
+
+// invalid is a validation failure, answered with 400.
+type invalid string
+
+func (e invalid) Error() string { return string(e) }
+
+func RegisterTypes(mux *http.ServeMux, d Deps) {
+	// ?family=email.send lists the versions of one family
+	mux.HandleFunc("GET /types", func(w http.ResponseWriter, r *http.Request) {
+		ts, err := d.Store.ListTypes(r.Context())
+		if err != nil {
+			ErrorJSON(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if family := r.URL.Query().Get("family"); family != "" {
+			out := []store.TaskType{}
+			for _, t := range ts {
+				if t.Family == family {
+					out = append(out, t)
+				}
+			}
+			ts = out
+		}
+		WriteJSON(w, http.StatusOK, map[string]any{"types": ts})
+	})
+
+	mux.HandleFunc("POST /types", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeType(w, r)
+		if !ok {
+			return
+		}
+		if !typeName.MatchString(req.Type) {
+			ErrorJSON(w, http.StatusBadRequest, "type must match %s", typeName)
+			return
+		}
+		if req.DefaultQueue == nil {
+			ErrorJSON(w, http.StatusBadRequest, "default_queue is required")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		next, ok := d.successor(ctx, w, req)
+		if !ok {
+			return
+		}
+
+		t := store.TaskType{Type: req.Type, Active: true, DefaultMaxAttempts: 5}
+		t.Family, t.Version = store.ParseTypeName(req.Type)
+		if err := d.applyType(&t, req, next); err != nil {
+			ErrorJSON(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+
+		err := d.Store.CreateType(ctx, t, actor(r))
+		if errors.Is(err, store.ErrTypeExists) {
+			ErrorJSON(w, http.StatusConflict, "type %q (%s version %d) already exists", t.Type, t.Family, t.Version)
+			return
+		}
+		if err != nil {
+			ErrorJSON(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusCreated, t)
+	})
+
+	mux.HandleFunc("GET /types/{type}", func(w http.ResponseWriter, r *http.Request) {
+		t, err := d.Store.GetType(r.Context(), r.PathValue("type"))
+		if errors.Is(err, pgx.ErrNoRows) {
+			ErrorJSON(w, http.StatusNotFound, "not found")
+			return
+		}
+		if err != nil {
+			ErrorJSON(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, t)
+	})
+
+	mux.HandleFunc("PATCH /types/{type}", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeType(w, r)
+		if !ok {
+			return
+		}
+		if req.Type != "" && req.Type != r.PathValue("type") {
+			ErrorJSON(w, http.StatusBadRequest, "type can't be renamed")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		next, ok := d.successor(ctx, w, req)
+		if !ok {
+			return
+		}
+		d.updateType(ctx, w, r, func(t *store.TaskType) error { return d.applyType(t, req, next) })
+	})
+
+	// soft delete: tasks keep referencing the row, enqueue rejects the type
+	mux.HandleFunc("DELETE /types/{type}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		d.updateType(ctx, w, r, func(t *store.TaskType) error {
+			t.Active = false
+			return nil
+		})
+	})
+
+	mux.HandleFunc("GET /types/{type}/audit", func(w http.ResponseWriter, r *http.Request) {
+		typ := r.PathValue("type")
+		if _, err := d.Store.GetType(r.Context(), typ); errors.Is(err, pgx.ErrNoRows) {
+			ErrorJSON(w, http.StatusNotFound, "not found")
+			return
+		}
+		entries, err := d.Store.ListTypeAudit(r.Context(), typ)
+		if err != nil {
+			ErrorJSON(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]any{"audit": entries})
+	})
+}
+
+func (d Deps) updateType(ctx context.Context, w http.ResponseWriter, r *http.Request, fn func(*store.TaskType) error) {
+	t, err := d.Store.UpdateType(ctx, r.PathValue("type"), actor(r), fn)
+	var bad invalid
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		ErrorJSON(w, http.StatusNotFound, "not found")
+	case errors.As(err, &bad):
+		ErrorJSON(w, http.StatusBadRequest, "%v", bad)
+	case err != nil:
+		ErrorJSON(w, http.StatusInternalServerError, "db error: %v", err)
+	default:
+		WriteJSON(w, http.StatusOK, t)
+	}
+}
+
+func decodeType(w http.ResponseWriter, r *http.Request) (TypeRequest, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	defer r.Body.Close()
+	var req TypeRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields() // catch typos in policy names
+	if err := dec.Decode(&req); err != nil {
+		ErrorJSON(w, http.StatusBadRequest, "invalid json: %v", err)
+		return req, false
+	}
+	req.Type = strings.TrimSpace(req.Type)
+	return req, true
+}
+
+// successor looks up req.ReplacedBy, if any. on failure the response is
+// written and ok is false.
+func (d Deps) successor(ctx context.Context, w http.ResponseWriter, req TypeRequest) (next *store.TaskType, ok bool) {
+	if req.ReplacedBy == nil || *req.ReplacedBy == "" {
+		return nil, true
+	}
+	t, err := d.Store.GetType(ctx, *req.ReplacedBy)
+	if errors.Is(err, pgx.ErrNoRows) {
+		ErrorJSON(w, http.StatusBadRequest, "replaced_by: unknown type %q", *req.ReplacedBy)
+		return nil, false
+	}
+	if err != nil {
+		ErrorJSON(w, http.StatusInternalServerError, "db error: %v", err)
+		return nil, false
+	}
+	return &t, true
+}
+
+// applyType merges req into t and validates the result against the topology.
+// next is the type named by req.ReplacedBy.
+func (d Deps) applyType(t *store.TaskType, req TypeRequest, next *store.TaskType) error {
+	if req.Active != nil {
+		t.Active = *req.Active
+	}
+	if req.DefaultQueue != nil {
+		t.DefaultQueue = strings.TrimSpace(*req.DefaultQueue)
+	}
+	if req.DefaultMaxAttempts != nil {
+		t.DefaultMaxAttempts = *req.DefaultMaxAttempts
+	}
+	if req.PayloadSchema != nil {
+		t.PayloadSchema = req.PayloadSchema
+		if string(req.PayloadSchema) == "null" {
+			t.PayloadSchema = nil
+		}
+	}
+	if req.MaxConcurrency != nil {
+		t.MaxConcurrency = positive(*req.MaxConcurrency)
+	}
+	if req.RateLimitPerSec != nil {
+		t.RateLimitPerSec = nil
+		if *req.RateLimitPerSec != 0 {
+			t.RateLimitPerSec = req.RateLimitPerSec
+		}
+	}
+	if req.RateLimitBurst != nil {
+		t.RateLimitBurst = positive(*req.RateLimitBurst)
+	}
+	if req.CallbackURL != nil {
+		t.CallbackURL = nil
+		if u := strings.TrimSpace(*req.CallbackURL); u != "" {
+			t.CallbackURL = &u
+		}
+	}
+	if req.Encrypt != nil {
+		t.Encrypt = *req.Encrypt
+	}
+	if req.Deprecated != nil {
+		switch {
+		case !*req.Deprecated:
+			t.DeprecatedAt = nil
+		case t.DeprecatedAt == nil: // keep the original date on repeats
+			now := time.Now().UTC()
+			t.DeprecatedAt = &now
+		}
+	}
+	if req.ReplacedBy != nil {
+		t.ReplacedBy = nil
+		if next != nil {
+			if next.Family != t.Family || next.Version <= t.Version {
+				return invalid(fmt.Sprintf("replaced_by must be a newer version of %s (got %s)", t.Family, next.Type))
+			}
+			t.ReplacedBy = &next.Type
+		}
+	}
+
+	if !contains(d.Topology.RoutingKeys, t.DefaultQueue) {
+		return invalid(fmt.Sprintf("default_queue %q not in topology (one of %v)", t.DefaultQueue, d.Topology.RoutingKeys))
+	}
+	if t.DefaultMaxAttempts < 1 || t.DefaultMaxAttempts > 20 {
+		return invalid("default_max_attempts out of range (1..20)")
+	}
+	if t.PayloadSchema != nil {
+		var obj map[string]any
+		if err := json.Unmarshal(t.PayloadSchema, &obj); err != nil {
+			return invalid("payload_schema must be a JSON object")
+		}
+	}
+	if t.CallbackURL != nil {
+		if err := d.checkCallback(*t.CallbackURL); err != nil {
+			return err
+		}
+	}
+	if req.Encrypt != nil && *req.Encrypt && d.Keys == nil {
+		return invalid("encrypt needs ENCRYPTION_KEYS on the API and workers")
+	}
+	if (req.MaxConcurrency != nil && *req.MaxConcurrency < 0) ||
+		(req.RateLimitBurst != nil && *req.RateLimitBurst < 0) ||
+		(t.RateLimitPerSec != nil && *t.RateLimitPerSec < 0) {
+		return invalid("limits must be positive (0 clears)")
+	}
+	return nil
+}
+
+// positive maps 0 (clear) to nil.
+func positive(n int) *int {
+	if n == 0 {
+		return nil
+	}
+	return &n
+}
+
+// actor names who made a registry change, for the audit log. it is what
+// the caller sent in X-Actor, unverified: the API has no authentication, so
+// put it behind a proxy that sets (and strips client-sent) X-Actor when the
+// audit log must be trustworthy.
+func actor(r *http.Request) string {
+	return strings.TrimSpace(r.Header.Get("X-Actor"))
+}
@@ -0,0 +1,136 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/henok3878/distributed-task-queue/internal/store"
+)
+
+func decode[T any](t *testing.T, body []byte) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("decode %s: %v", body, err)
+	}
+	return v
+}
+
+func TestTypeLifecycle(t *testing.T) {
+	k := newKit()
+
+	rec := k.Do(http.MethodPost, "/types", map[string]any{
+		"type": "sms.send.v1", "default_queue": "high", "rate_limit_per_sec": 100,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	created := decode[store.TaskType](t, rec.Body.Bytes())
+	if !created.Active || created.DefaultMaxAttempts != 5 || *created.RateLimitPerSec != 100 {
+		t.Fatalf("created %+v", created)
+	}
+	if rec := k.Do(http.MethodPost, "/types", map[string]any{"type": "sms.send.v1", "default_queue": "high"}); rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate: %d", rec.Code)
+	}
+
+	// update: move queue, clear the rate limit
+	rec = k.Do(http.MethodPatch, "/types/sms.send.v1", map[string]any{"default_queue": "default", "rate_limit_per_sec": 0})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", rec.Code, rec.Body)
+	}
+	if u := decode[store.TaskType](t, rec.Body.Bytes()); u.DefaultQueue != "default" || u.RateLimitPerSec != nil {
+		t.Fatalf("updated %+v", u)
+	}
+
+	// deactivate: enqueue now refuses the type
+	if rec := k.Do(http.MethodDelete, "/types/sms.send.v1", nil); rec.Code != http.StatusOK {
+		t.Fatalf("deactivate: %d", rec.Code)
+	}
+	if rec := k.Do(http.MethodPost, "/enqueue", map[string]any{"type": "sms.send.v1", "payload": map[string]any{}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("enqueue of inactive type: %d", rec.Code)
+	}
+
+	rec = k.Do(http.MethodGet, "/types/sms.send.v1/audit", nil)
+	audit := decode[struct{ Audit []store.TypeAudit }](t, rec.Body.Bytes()).Audit
+	var actions []string
+	for _, a := range audit {
+		actions = append(actions, a.Action)
+	}
+	if len(actions) != 3 || actions[0] != "CREATE" || actions[1] != "UPDATE" || actions[2] != "DEACTIVATE" {
+		t.Fatalf("audit actions = %v", actions)
+	}
+}
+
+func TestTypeValidation(t *testing.T) {
+	k := newKit()
+	cases := map[string]map[string]any{
+		"bad name":          {"type": "Email Send", "default_queue": "high"},
+		"missing queue":     {"type": "a.v1"},
+		"queue not in topo": {"type": "a.v1", "default_queue": "low"},
+		"max attempts":      {"type": "a.v1", "default_queue": "high", "default_max_attempts": 0},
+		"schema not object": {"type": "a.v1", "default_queue": "high", "payload_schema": []int{1}},
+		"negative limit":    {"type": "a.v1", "default_queue": "high", "max_concurrency": -1},
+		"unknown field":     {"type": "a.v1", "default_queue": "high", "max_concurency": 1},
+		"callback url":      {"type": "a.v1", "default_queue": "high", "callback_url": "/relative"},
+	}
+	for name, body := range cases {
+		if rec := k.Do(http.MethodPost, "/types", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s", name, rec.Code, rec.Body)
+		}
+	}
+	if rec := k.Do(http.MethodPatch, "/types/email.send.v1", map[string]any{"default_queue": "low"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("patch to unknown queue: %d", rec.Code)
+	}
+	if rec := k.Do(http.MethodPatch, "/types/nope.v1", map[string]any{"active": true}); rec.Code != http.StatusNotFound {
+		t.Errorf("patch missing type: %d", rec.Code)
+	}
+}
+
+func TestTypeVersionsAndDeprecation(t *testing.T) {
+	k := newKit()
+	rec := k.Do(http.MethodPost, "/types", map[string]any{"type": "email.send.v2", "default_queue": "high"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create v2: %d %s", rec.Code, rec.Body)
+	}
+	if v2 := decode[store.TaskType](t, rec.Body.Bytes()); v2.Family != "email.send" || v2.Version != 2 {
+		t.Fatalf("v2 = %+v", v2)
+	}
+	rec = k.Do(http.MethodGet, "/types?family=email.send", nil)
+	if ts := decode[struct{ Types []store.TaskType }](t, rec.Body.Bytes()).Types; len(ts) != 2 || ts[0].Version != 1 || ts[1].Version != 2 {
+		t.Fatalf("family listing = %+v", ts)
+	}
+
+	// the successor must be a newer version of the same family
+	for _, next := range []string{"old.v1", "email.send.v1", "nope.v9"} {
+		if rec := k.Do(http.MethodPatch, "/types/email.send.v1", map[string]any{"replaced_by": next}); rec.Code != http.StatusBadRequest {
+			t.Errorf("replaced_by %s: %d", next, rec.Code)
+		}
+	}
+
+	rec = k.Do(http.MethodPatch, "/types/email.send.v1", map[string]any{"deprecated": true, "replaced_by": "email.send.v2"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("deprecate: %d %s", rec.Code, rec.Body)
+	}
+	if v1 := decode[store.TaskType](t, rec.Body.Bytes()); v1.DeprecatedAt == nil || *v1.ReplacedBy != "email.send.v2" {
+		t.Fatalf("v1 = %+v", v1)
+	}
+	rec = k.Do(http.MethodGet, "/types/email.send.v1/audit", nil)
+	if audit := decode[struct{ Audit []store.TypeAudit }](t, rec.Body.Bytes()).Audit; len(audit) != 1 || audit[0].Action != store.AuditDeprecate {
+		t.Fatalf("audit = %+v", audit)
+	}
+
+	// deprecated versions are still accepted, with a warning
+	rec = k.Do(http.MethodPost, "/enqueue", map[string]any{"type": "email.send.v1", "payload": map[string]any{}})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("enqueue v1: %d %s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Deprecation") == "" || !strings.Contains(rec.Header().Get("Warning"), "use email.send.v2") {
+		t.Fatalf("headers = %v", rec.Header())
+	}
+	rec = k.Do(http.MethodPost, "/enqueue", map[string]any{"type": "email.send.v2", "payload": map[string]any{}})
+	if rec.Header().Get("Deprecation") != "" || rec.Header().Get("Warning") != "" {
+		t.Fatalf("v2 warned: %v", rec.Header())
+	}
+}
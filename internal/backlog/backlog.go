@@ -0,0 +1,124 @@
+package backlog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/henok3878/distributed-task-queue/internal/broker"
+	"github.com/henok3878/distributed-task-queue/internal/metrics"
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/internal/store"
+)
+
+// statuses are reported even at 0 so alerts don't see gaps.
+var statuses = []string{"ENQUEUED", "RUNNING", "SUCCEEDED", "FAILED", "DLQ"}
+
+// Collector polls queue depths from the broker and task counts from the
+// store into the backlog gauges of internal/metrics.
+type Collector struct {
+	Store    store.Store
+	Broker   broker.Broker
+	Topology rmq.Topology
+	Interval time.Duration    // default 15s
+	Now      func() time.Time // default time.Now
+}
+
+// IntervalFromEnv reads BACKLOG_INTERVAL (default 15s; 0 or "off" disables).
+func IntervalFromEnv() (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv("BACKLOG_INTERVAL"))
+	switch v {
+	case "":
+		return 15 * time.Second, nil
+	case "0", "off":
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad BACKLOG_INTERVAL %q", v)
+	}
+	return d, nil
+}
+
+// Run collects right away and then every Interval until ctx is done.
+// failures are logged and counted; the gauges keep their last values.
+func (c *Collector) Run(ctx context.Context) {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		if err := c.Collect(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("backlog sample failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Collect takes one sample. the broker and the store are sampled
+// independently, so one being down doesn't blank the other's gauges.
+func (c *Collector) Collect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	berr := c.queues(ctx)
+	if berr != nil {
+		metrics.BacklogErrors.WithLabelValues("broker").Inc()
+		berr = fmt.Errorf("broker: %w", berr)
+	}
+	serr := c.tasks(ctx)
+	if serr != nil {
+		metrics.BacklogErrors.WithLabelValues("db").Inc()
+		serr = fmt.Errorf("db: %w", serr)
+	}
+	if berr != nil {
+		return berr
+	}
+	return serr
+}
+
+func (c *Collector) queues(ctx context.Context) error {
+	depths, err := c.Broker.Depths(ctx)
+	if err != nil {
+		return err
+	}
+	for _, d := range depths {
+		metrics.QueueMessages.WithLabelValues(d.Queue, d.Kind).Set(float64(d.Messages))
+		if d.Consumers >= 0 {
+			metrics.QueueConsumers.WithLabelValues(d.Queue, d.Kind).Set(float64(d.Consumers))
+		}
+	}
+	return nil
+}
+
+func (c *Collector) tasks(ctx context.Context) error {
+	st, err := c.Store.TaskStats(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		metrics.Tasks.WithLabelValues(s).Set(float64(st.ByStatus[s]))
+	}
+
+	now := time.Now
+	if c.Now != nil {
+		now = c.Now
+	}
+	for _, rk := range c.Topology.RoutingKeys {
+		age := 0.0
+		if oldest, ok := st.OldestEnqueued[rk]; ok {
+			age = max(now().Sub(oldest).Seconds(), 0)
+		}
+		metrics.OldestEnqueuedAge.WithLabelValues(rk).Set(age)
+	}
+	return nil
+}
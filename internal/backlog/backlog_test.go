@@ -0,0 +1,51 @@
+package backlog_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/henok3878/distributed-task-queue/internal/api"
+	"github.com/henok3878/distributed-task-queue/internal/backlog"
+	"github.com/henok3878/distributed-task-queue/internal/metrics"
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/internal/testkit"
+	"github.com/henok3878/distributed-task-queue/pkg/worker"
+)
+
+func TestCollect(t *testing.T) {
+	k := testkit.New(rmq.New("tasks", "default", "high"), worker.Config{})
+	k.Store.AddType("email.send.v1", testkit.Type{Active: true, Queue: "high", MaxAttempts: 5})
+	for range 2 {
+		if _, err := k.Enqueue(api.EnqueueRequest{Type: "email.send.v1", Payload: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k.Clock.Advance(30 * time.Second)
+
+	c := &backlog.Collector{Store: k.Store, Broker: k.Broker, Topology: k.Topology, Now: k.Clock.Now}
+	if err := c.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		name      string
+		got, want float64
+	}{
+		{"main messages", testutil.ToFloat64(metrics.QueueMessages.WithLabelValues("tasks.high", "main")), 2},
+		{"retry messages", testutil.ToFloat64(metrics.QueueMessages.WithLabelValues("tasks.retry.high", "retry")), 0},
+		{"dlq messages", testutil.ToFloat64(metrics.QueueMessages.WithLabelValues("tasks.dlq", "dead")), 0},
+		{"enqueued tasks", testutil.ToFloat64(metrics.Tasks.WithLabelValues("ENQUEUED")), 2},
+		{"failed tasks", testutil.ToFloat64(metrics.Tasks.WithLabelValues("FAILED")), 0},
+		{"oldest high", testutil.ToFloat64(metrics.OldestEnqueuedAge.WithLabelValues("high")), 30},
+		{"oldest default", testutil.ToFloat64(metrics.OldestEnqueuedAge.WithLabelValues("default")), 0},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
@@ -33,6 +33,12 @@ func (l list) NextDelay(attempt int) time.Duration {
 	return l.ds[i]
 }
 
+// Fixed always waits d.
+func Fixed(d time.Duration) Strategy { return fixed{d: d} }
+
+// List waits ds[attempt-1], repeating the last delay once attempts run past it.
+func List(ds ...time.Duration) Strategy { return list{ds: ds} }
+
 // Exponential (+ optional jitter)
 
 type exp struct {
@@ -68,34 +74,38 @@ func (e exp) NextDelay(attempt int) time.Duration {
 // list:        BACKOFFS="5s,30s,2m,10m,1h"
 // fixed:       BACKOFF_FIXED="30s"
 // exponential: BACKOFF_BASE="5s", BACKOFF_FACTOR="6", BACKOFF_MAX="1h", BACKOFF_JITTER="0.2"
-func FromEnv() Strategy {
-	mode := strings.ToLower(strings.TrimSpace(os.Getenv("BACKOFF_STRATEGY")))
+func FromEnv() Strategy { return FromEnvPrefix("BACKOFF") }
+
+// FromEnvPrefix is FromEnv with another prefix: WEBHOOK_BACKOFF reads
+// WEBHOOK_BACKOFF_STRATEGY, WEBHOOK_BACKOFFS, WEBHOOK_BACKOFF_FIXED, ...
+func FromEnvPrefix(prefix string) Strategy {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv(prefix + "_STRATEGY")))
 	switch mode {
 	case "fixed":
-		if d := parseDur(os.Getenv("BACKOFF_FIXED")); d > 0 {
+		if d := parseDur(os.Getenv(prefix + "_FIXED")); d > 0 {
 			return fixed{d: d}
 		}
 		return fixed{d: 30 * time.Second}
 	case "exponential":
-		base := parseDur(os.Getenv("BACKOFF_BASE"))
+		base := parseDur(os.Getenv(prefix + "_BASE"))
 		if base <= 0 {
 			base = 5 * time.Second
 		}
-		factor := parseFloat(os.Getenv("BACKOFF_FACTOR"))
+		factor := parseFloat(os.Getenv(prefix + "_FACTOR"))
 		if factor <= 1 {
 			factor = 6
 		}
-		max := parseDur(os.Getenv("BACKOFF_MAX"))
+		max := parseDur(os.Getenv(prefix + "_MAX"))
 		if max <= 0 {
 			max = time.Hour
 		}
-		j := parseFloat(os.Getenv("BACKOFF_JITTER"))
+		j := parseFloat(os.Getenv(prefix + "_JITTER"))
 		if j < 0 || j > 1 {
 			j = 0
 		}
 		return exp{base: base, factor: factor, max: max, jitter: j}
 	default: // list
-		if raw := strings.TrimSpace(os.Getenv("BACKOFFS")); raw != "" {
+		if raw := strings.TrimSpace(os.Getenv(prefix + "S")); raw != "" {
 			parts := strings.Split(raw, ",")
 			var ds []time.Duration
 			for _, p := range parts {
@@ -0,0 +1,103 @@
+// Package blob keeps large task payloads and results out of Postgres. above
+// Offloader.Threshold bytes the data goes to a Store (a directory or an
+// S3-compatible bucket) and the task row keeps only the key.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned by Get for a missing key.
+var ErrNotFound = errors.New("blob not found")
+
+// Store is a flat key/value store of immutable blobs. keys use '/'
+// separators, ex: tasks/<id>/payload.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// PayloadKey and ResultKey name a task's blobs. they are fixed per task, so
+// a retried upload overwrites instead of leaking.
+func PayloadKey(taskID string) string { return "tasks/" + taskID + "/payload" }
+func ResultKey(taskID string) string  { return "tasks/" + taskID + "/result" }
+
+// Offloader decides what goes to Store. a nil *Offloader keeps everything
+// inline.
+type Offloader struct {
+	Store     Store
+	Threshold int // bytes; larger data is offloaded
+	MaxSize   int // largest enqueue body accepted
+}
+
+// Offload returns data itself when it fits Threshold, else stores it under
+// key and returns key as ref (and no inline data).
+func (o *Offloader) Offload(ctx context.Context, key string, data []byte) (inline []byte, ref string, err error) {
+	if o == nil || len(data) <= o.Threshold {
+		return data, "", nil
+	}
+	if err := o.Store.Put(ctx, key, data); err != nil {
+		return nil, "", fmt.Errorf("blob put %s: %w", key, err)
+	}
+	return nil, key, nil
+}
+
+// Load returns inline, or the blob ref names when ref isn't "".
+func (o *Offloader) Load(ctx context.Context, inline []byte, ref string) ([]byte, error) {
+	if ref == "" {
+		return inline, nil
+	}
+	if o == nil {
+		return nil, fmt.Errorf("blob %s: no blob store configured (BLOB_STORE)", ref)
+	}
+	data, err := o.Store.Get(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("blob get %s: %w", ref, err)
+	}
+	return data, nil
+}
+
+// FromEnv configures an Offloader; nil when BLOB_STORE is unset.
+//
+//	BLOB_STORE       dir | s3
+//	BLOB_THRESHOLD   bytes kept inline, default 262144 (256 KiB)
+//	BLOB_MAX_SIZE    largest enqueue body, default 16777216 (16 MiB)
+//	BLOB_DIR         dir: root directory
+//	BLOB_S3_*        s3: see S3FromEnv
+func FromEnv() (*Offloader, error) {
+	o := &Offloader{Threshold: 256 << 10, MaxSize: 16 << 20}
+	switch kind := strings.ToLower(strings.TrimSpace(os.Getenv("BLOB_STORE"))); kind {
+	case "":
+		return nil, nil
+	case "dir":
+		root := os.Getenv("BLOB_DIR")
+		if root == "" {
+			return nil, errors.New("BLOB_STORE=dir needs BLOB_DIR")
+		}
+		o.Store = NewDir(root)
+	case "s3":
+		s, err := S3FromEnv()
+		if err != nil {
+			return nil, err
+		}
+		o.Store = s
+	default:
+		return nil, fmt.Errorf("bad BLOB_STORE %q (dir|s3)", kind)
+	}
+	for name, dst := range map[string]*int{"BLOB_THRESHOLD": &o.Threshold, "BLOB_MAX_SIZE": &o.MaxSize} {
+		if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad %s %q (bytes)", name, v)
+			}
+			*dst = n
+		}
+	}
+	return o, nil
+}
@@ -0,0 +1,36 @@
+package blob_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/henok3878/distributed-task-queue/internal/blob"
+)
+
+func TestOffloadToDir(t *testing.T) {
+	ctx := context.Background()
+	o := &blob.Offloader{Store: blob.NewDir(t.TempDir()), Threshold: 4}
+
+	if inline, ref, err := o.Offload(ctx, blob.PayloadKey("t1"), []byte(`{}`)); err != nil || ref != "" || string(inline) != `{}` {
+		t.Fatalf("small: %s %q %v", inline, ref, err)
+	}
+	inline, ref, err := o.Offload(ctx, blob.PayloadKey("t1"), []byte(`{"a":1}`))
+	if err != nil || inline != nil || ref != "tasks/t1/payload" {
+		t.Fatalf("large: %s %q %v", inline, ref, err)
+	}
+	if got, err := o.Load(ctx, nil, ref); err != nil || string(got) != `{"a":1}` {
+		t.Fatalf("load = %s, %v", got, err)
+	}
+
+	if _, err := o.Store.Get(ctx, "tasks/nope"); !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("missing: %v", err)
+	}
+	if err := o.Store.Put(ctx, "../escape", nil); err == nil {
+		t.Fatal("key escaped the root")
+	}
+	var none *blob.Offloader
+	if _, err := none.Load(ctx, nil, ref); err == nil {
+		t.Fatal("nil offloader loaded a ref")
+	}
+}
@@ -0,0 +1,181 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 stores blobs in a bucket of S3 or any S3-compatible server (MinIO,
+// Ceph, R2, ...), over plain HTTP with SigV4 signing.
+type S3 struct {
+	Endpoint  string // ex: https://s3.eu-west-1.amazonaws.com, http://localhost:9000
+	Bucket    string
+	Region    string // default us-east-1
+	AccessKey string
+	SecretKey string
+	PathStyle bool // endpoint/bucket/key instead of bucket.endpoint/key; most stand-ins need it
+
+	Client *http.Client     // default http.DefaultClient
+	Now    func() time.Time // default time.Now
+}
+
+var _ Store = (*S3)(nil)
+
+// S3FromEnv reads BLOB_S3_ENDPOINT, BLOB_S3_BUCKET, BLOB_S3_REGION,
+// BLOB_S3_ACCESS_KEY, BLOB_S3_SECRET_KEY and BLOB_S3_PATH_STYLE (true|false).
+func S3FromEnv() (*S3, error) {
+	s := &S3{
+		Endpoint:  strings.TrimRight(os.Getenv("BLOB_S3_ENDPOINT"), "/"),
+		Bucket:    os.Getenv("BLOB_S3_BUCKET"),
+		Region:    os.Getenv("BLOB_S3_REGION"),
+		AccessKey: os.Getenv("BLOB_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("BLOB_S3_SECRET_KEY"),
+		PathStyle: os.Getenv("BLOB_S3_PATH_STYLE") == "true",
+	}
+	if s.Endpoint == "" || s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+		return nil, errors.New("BLOB_STORE=s3 needs BLOB_S3_ENDPOINT, BLOB_S3_BUCKET, BLOB_S3_ACCESS_KEY and BLOB_S3_SECRET_KEY")
+	}
+	if _, err := url.Parse(s.Endpoint); err != nil {
+		return nil, fmt.Errorf("bad BLOB_S3_ENDPOINT: %w", err)
+	}
+	return s, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.do(ctx, http.MethodPut, key, data)
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, key, nil)
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, http.MethodDelete, key, nil)
+	return err
+}
+
+func (s *S3) do(ctx context.Context, method, key string, body []byte) ([]byte, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	path := "/" + escapePath(key)
+	if s.PathStyle {
+		path = "/" + escapePath(s.Bucket) + path
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path, u.RawPath = "", ""
+	req, err := http.NewRequestWithContext(ctx, method, u.String()+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	s.sign(req, path, sha256Hex(body), now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodGet:
+		return nil, ErrNotFound
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("s3 %s %s: status %d: %s", method, key, resp.StatusCode, bytes.TrimSpace(out[:min(len(out), 512)]))
+	}
+	return out, nil
+}
+
+// sign adds SigV4 headers to req, signing the host and every header it
+// already carries. path is the canonical (escaped) URI.
+func (s *S3) sign(req *http.Request, path, payloadHash string, now time.Time) {
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	vals := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		vals[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(vals))
+	for k := range vals {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canon strings.Builder
+	for _, k := range names {
+		canon.WriteString(k + ":" + vals[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	creq := strings.Join([]string{req.Method, path, req.URL.RawQuery, canon.String(), signed, payloadHash}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	sts := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(creq))
+
+	k := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, sts))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.AccessKey, scope, signed, sig))
+}
+
+// escapePath percent-encodes everything but unreserved characters and '/',
+// as SigV4 canonical URIs for S3 expect.
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
@@ -0,0 +1,454 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+)
+
+// AMQP is the RabbitMQ broker: main direct exchange, retry queues / tiers /
+// delayed exchange per topology, and a DLX.
+type AMQP struct {
+	conn *amqp.Connection
+	ch   *amqp.Channel // publishes
+	topo rmq.Topology
+	cfg  ConsumeConfig
+	own  bool // Close also closes conn (dialled by FromEnv)
+
+	mgmt       *rmq.Mgmt // optional: Check compares queue arguments through it
+	argsMu     sync.Mutex
+	argsAt     time.Time // when the last comparison started
+	argsErr    error     // drift it found
+	argsStatus string    // see ArgsStatus
+}
+
+// envelope is the AMQP message body
+type envelope struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// NewAMQP opens a publishing channel on conn. the caller keeps owning conn.
+func NewAMQP(conn *amqp.Connection, topo rmq.Topology, cfg ConsumeConfig) (*AMQP, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("amqp channel: %w", err)
+	}
+	return &AMQP{conn: conn, ch: ch, topo: topo, cfg: cfg.withDefaults(200 * time.Millisecond)}, nil
+}
+
+func (a *AMQP) Publish(ctx context.Context, m Message) error {
+	return traced(ctx, "rabbitmq", "publish", m, a.publish)
+}
+
+func (a *AMQP) publish(ctx context.Context, m Message) error {
+	// minimal persistent message (workers fetch payload by id)
+	body, _ := json.Marshal(envelope{ID: m.ID, Type: m.Type})
+	headers := amqp.Table{headerReady: time.Now().UnixMilli()}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	pub := amqp.Publishing{ContentType: "application/json", DeliveryMode: amqp.Persistent, Priority: m.Priority, Headers: headers, Body: body}
+	return a.ch.PublishWithContext(ctx, a.topo.MainExchange, m.Queue, false, false, pub)
+}
+
+func (a *AMQP) Retry(ctx context.Context, m Message, delay time.Duration) (actual time.Duration, err error) {
+	err = traced(ctx, "rabbitmq", "retry", m, func(ctx context.Context, m Message) error {
+		actual, err = a.retry(ctx, m, delay)
+		return err
+	})
+	return actual, err
+}
+
+func (a *AMQP) retry(ctx context.Context, m Message, delay time.Duration) (time.Duration, error) {
+	// ttl queue, tier queue or delayed exchange, per topology
+	target := a.topo.RetryTarget(m.Queue, delay)
+	headers := amqp.Table{}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	for k, v := range target.Headers {
+		headers[k] = v
+	}
+	headers[headerReady] = time.Now().Add(target.Delay).UnixMilli()
+
+	body, _ := json.Marshal(envelope{ID: m.ID, Type: m.Type})
+	// priority survives the dead-letter hop back to the main queue
+	pub := amqp.Publishing{
+		ContentType: "application/json",
+		Priority:    m.Priority,
+		Headers:     headers,
+		Body:        body,
+		Expiration:  target.Expiry,
+	}
+	if err := a.ch.PublishWithContext(ctx, target.Exchange, target.Key, false, false, pub); err != nil {
+		return 0, fmt.Errorf("retry publish %s: %w", target.Key, err)
+	}
+	return target.Delay, nil
+}
+
+func (a *AMQP) DeadLetter(ctx context.Context, m Message) error {
+	return traced(ctx, "rabbitmq", "dead-letter", m, func(ctx context.Context, m Message) error {
+		body, _ := json.Marshal(envelope{ID: m.ID, Type: m.Type})
+		dlKey := a.topo.DeadLetterKey(m.Queue, m.Type) // selects shared, per-queue or per-type DLQ
+		return a.ch.PublishWithContext(ctx, a.topo.DLXExchange, dlKey, false, false, amqp.Publishing{
+			ContentType: "application/json",
+			Priority:    m.Priority,
+			Headers:     amqp.Table(m.Headers), // trace context, for whoever replays it
+			Body:        body,
+		})
+	})
+}
+
+func (a *AMQP) Event(ctx context.Context, ev rmq.Event) error {
+	return rmq.PublishEvent(ctx, a.ch, a.topo, ev)
+}
+
+// Check verifies every exchange and queue of the topology exists. it only
+// uses passive declares, on one channel, so a health check never creates
+// anything. with RMQ_MGMT_URL set it also compares each queue's
+// type/arguments, at most once per argsCheckEvery.
+func (a *AMQP) Check(ctx context.Context) error {
+	decls := a.topo.Declarations()
+	ch, err := a.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("amqp channel: %w", err)
+	}
+	// a failed passive declare closes ch, so stop at the first one
+	defer ch.Close()
+
+	for _, e := range decls.Exchanges {
+		if err := ch.ExchangeDeclarePassive(e.Name, e.Kind, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("exchange missing (%s): %w", e.Name, err)
+		}
+	}
+	for _, q := range decls.Queues {
+		if _, err := ch.QueueDeclarePassive(q.Name, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("queue missing (%s): %w", q.Name, err)
+		}
+	}
+	return a.checkArgs(ctx, decls.Queues)
+}
+
+// argsCheckEvery bounds how often Check asks the management API for queue
+// arguments; they only change when rmq-init runs.
+const argsCheckEvery = time.Minute
+
+// checkArgs compares the queues' type/arguments via the management API.
+// the outcome, drift or an unreachable management API alike, is cached for
+// argsCheckEvery. the HTTP calls run outside argsMu: checks that arrive
+// meanwhile get the previous outcome instead of queueing behind them. an
+// unreachable management API is logged and not held against the broker.
+func (a *AMQP) checkArgs(ctx context.Context, queues []rmq.QueueDecl) error {
+	if a.mgmt == nil {
+		return nil
+	}
+	a.argsMu.Lock()
+	if time.Since(a.argsAt) < argsCheckEvery {
+		defer a.argsMu.Unlock()
+		return a.argsErr
+	}
+	a.argsAt = time.Now()
+	a.argsMu.Unlock()
+
+	status, drift := a.compareArgs(ctx, queues)
+	a.argsMu.Lock()
+	a.argsErr, a.argsStatus = drift, status
+	a.argsMu.Unlock()
+	return drift
+}
+
+func (a *AMQP) compareArgs(ctx context.Context, queues []rmq.QueueDecl) (string, error) {
+	for _, q := range queues {
+		info, err := a.mgmt.Queue(ctx, q.Name)
+		if err != nil {
+			slog.Warn("healthz: queue arguments not verified", "queue", q.Name, "err", err)
+			return fmt.Sprintf("not verified: queue %s: %v", q.Name, err), nil
+		}
+		if diff := rmq.DiffArgs(q.Args, info); diff != "" {
+			return ArgsVerified, fmt.Errorf("queue %s: declared differently than topology: %s", q.Name, diff)
+		}
+	}
+	return ArgsVerified, nil
+}
+
+// ArgsStatus says whether Check compares queue arguments: ArgsVerified, or
+// why not (no RMQ_MGMT_URL, management API unreachable).
+func (a *AMQP) ArgsStatus() string {
+	if a.mgmt == nil {
+		return "not verified: RMQ_MGMT_URL not set"
+	}
+	a.argsMu.Lock()
+	defer a.argsMu.Unlock()
+	if a.argsStatus == "" {
+		return "not verified yet"
+	}
+	return a.argsStatus
+}
+
+// Depths reads message/consumer counts with a passive declare per queue.
+func (a *AMQP) Depths(ctx context.Context) ([]QueueDepth, error) {
+	ch, err := a.conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("amqp channel: %w", err)
+	}
+	defer ch.Close()
+
+	main, retry, dead := a.topo.QueuesByKind()
+	var out []QueueDepth
+	for _, g := range []struct {
+		kind   string
+		queues []string
+	}{{KindMain, main}, {KindRetry, retry}, {KindDead, dead}} {
+		for _, name := range g.queues {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			q, err := ch.QueueDeclarePassive(name, true, false, false, false, nil)
+			if err != nil {
+				return nil, fmt.Errorf("queue %s: %w", name, err)
+			}
+			out = append(out, QueueDepth{Queue: name, Kind: g.kind, Messages: q.Messages, Consumers: q.Consumers})
+		}
+	}
+	return out, nil
+}
+
+func (a *AMQP) Close() error {
+	err := a.ch.Close()
+	if a.own {
+		_ = a.conn.Close()
+	}
+	return err
+}
+
+// Consume runs one of the consumption policies over queues.
+func (a *AMQP) Consume(ctx context.Context, queues []string, handle HandleFunc) error {
+	var chans []*amqp.Channel
+	open := func() (*amqp.Channel, error) {
+		ch, err := a.conn.Channel()
+		if err != nil {
+			return nil, fmt.Errorf("amqp channel: %w", err)
+		}
+		chans = append(chans, ch)
+		return ch, nil
+	}
+	defer func() {
+		for _, c := range chans {
+			_ = c.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var err error
+	switch a.cfg.Policy {
+	case PolicyStrict:
+		err = a.runStrict(ctx, &wg, open, queues, handle)
+	case PolicyWeighted:
+		err = a.runWeighted(ctx, &wg, open, queues, handle)
+	default:
+		err = a.runEqual(ctx, &wg, open, queues, handle)
+	}
+	if err == nil {
+		<-ctx.Done()
+	}
+	// cancelling consumers is implied by closing their channels; unacked
+	// deliveries go back to the queue
+	wg.Wait()
+	return err
+}
+
+// equal: one consumer per queue on a shared channel; queues compete for the
+// same prefetch window, so a busy default queue can starve high.
+func (a *AMQP) runEqual(ctx context.Context, wg *sync.WaitGroup, open func() (*amqp.Channel, error), queues []string, handle HandleFunc) error {
+	ch, err := open()
+	if err != nil {
+		return err
+	}
+	if err := ch.Qos(a.cfg.Prefetch, 0, false); err != nil {
+		return fmt.Errorf("amqp qos: %w", err)
+	}
+
+	// one consumer per priority queue, each with enough handlers to fill the
+	// shared window on its own
+	for _, rk := range queues {
+		if err := a.consume(ctx, wg, ch, rk, a.cfg.Prefetch, handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// weighted: one channel per queue with prefetch split by weight, and as many
+// handlers as its prefetch. with every queue backlogged each runs that many
+// tasks at a time, so they are served roughly in weight ratio.
+func (a *AMQP) runWeighted(ctx context.Context, wg *sync.WaitGroup, open func() (*amqp.Channel, error), queues []string, handle HandleFunc) error {
+	for _, rk := range queues {
+		weight := a.cfg.weight(rk, 1)
+		prefetch := weightedPrefetch(a.cfg, queues, rk)
+		if prefetch == 0 {
+			continue // explicitly disabled
+		}
+
+		ch, err := open()
+		if err != nil {
+			return err
+		}
+		if err := ch.Qos(prefetch, 0, false); err != nil {
+			return fmt.Errorf("amqp qos: %w", err)
+		}
+		if err := a.consume(ctx, wg, ch, rk, prefetch, handle); err != nil {
+			return err
+		}
+		slog.Info("broker: weighted consumer", "queue", rk, "weight", weight, "prefetch", prefetch)
+	}
+	return nil
+}
+
+// weightedPrefetch is rk's share of Prefetch by weight, at least 1 unless
+// its weight is 0.
+func weightedPrefetch(cfg ConsumeConfig, queues []string, rk string) int {
+	weight := cfg.weight(rk, 1)
+	if weight == 0 {
+		return 0
+	}
+	total := 0
+	for _, q := range queues {
+		total += cfg.weight(q, 1)
+	}
+	return max(cfg.Prefetch*weight/total, 1)
+}
+
+// strict: pull-based (basic.get); Prefetch goroutines each read a lower queue
+// only when every higher one is empty. each puller has its own channel:
+// amqp091 doesn't pair concurrent Gets on one channel with their replies.
+func (a *AMQP) runStrict(ctx context.Context, wg *sync.WaitGroup, open func() (*amqp.Channel, error), queues []string, handle HandleFunc) error {
+	order := strictOrder(a.cfg, queues)
+	slog.Info("broker: strict order", "order", order)
+
+	for i := 0; i < a.cfg.Prefetch; i++ {
+		ch, err := open()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if !a.pullOne(ctx, ch, order, handle) {
+					select {
+					case <-ctx.Done():
+					case <-time.After(a.cfg.PollInterval):
+					}
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// pullOne handles the first message found walking order; false if all empty.
+func (a *AMQP) pullOne(ctx context.Context, ch *amqp.Channel, order []string, handle HandleFunc) bool {
+	for _, rk := range order {
+		queue := a.topo.FullQueueName(rk)
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			slog.Error("broker: get", "queue", queue, "err", err)
+			return false
+		}
+		if ok {
+			a.dispatch(ctx, rk, d, handle)
+			return true
+		}
+	}
+	return false
+}
+
+// consume starts a consumer for rk on ch, handled by workers goroutines.
+func (a *AMQP) consume(ctx context.Context, wg *sync.WaitGroup, ch *amqp.Channel, rk string, workers int, handle HandleFunc) error {
+	queue := a.topo.FullQueueName(rk)
+	tag := fmt.Sprintf("worker-%s-%d", rk, time.Now().UnixNano())
+
+	deliveries, err := ch.Consume(queue, tag, false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("consume %s: %w", queue, err)
+	}
+	a.serve(ctx, wg, deliveries, rk, workers, handle)
+	return nil
+}
+
+// serve drains deliveries with workers goroutines, so up to workers tasks of
+// rk run at once (the channel's prefetch bounds how many arrive).
+func (a *AMQP) serve(ctx context.Context, wg *sync.WaitGroup, deliveries <-chan amqp.Delivery, rk string, workers int, handle HandleFunc) {
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d, ok := <-deliveries:
+					if !ok {
+						return
+					}
+					a.dispatch(ctx, rk, d, handle)
+				}
+			}
+		}()
+	}
+}
+
+func (a *AMQP) dispatch(ctx context.Context, rk string, d amqp.Delivery, handle HandleFunc) {
+	var env envelope
+	if err := json.Unmarshal(d.Body, &env); err != nil {
+		slog.Error("broker: unparsable message dropped", "queue", rk, "err", err, "body", string(d.Body))
+		_ = d.Ack(false) // drop poison for now
+		return
+	}
+	handle(ctx, amqpDelivery{d: d, m: Message{
+		ID:       env.ID,
+		Type:     env.Type,
+		Queue:    rk,
+		Priority: d.Priority,
+		Headers:  d.Headers,
+		Ready:    readyAt(d.Headers),
+	}})
+}
+
+// headerReady carries Message.Ready (unix ms) through RabbitMQ; the AMQP
+// timestamp property only has second resolution.
+const headerReady = "x-dq-ready"
+
+func readyAt(h amqp.Table) time.Time {
+	if ms, ok := h[headerReady].(int64); ok {
+		return time.UnixMilli(ms)
+	}
+	return time.Time{}
+}
+
+type amqpDelivery struct {
+	d amqp.Delivery
+	m Message
+}
+
+func (x amqpDelivery) Message() Message { return x.m }
+func (x amqpDelivery) Ack() error       { return x.d.Ack(false) }
+func (x amqpDelivery) Requeue() error   { return x.d.Nack(false, true) }
+
+// strictOrder: highest weight first; ties keep queues order.
+func strictOrder(cfg ConsumeConfig, queues []string) []string {
+	order := append([]string(nil), queues...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return cfg.weight(order[i], 0) > cfg.weight(order[j], 0)
+	})
+	return order
+}
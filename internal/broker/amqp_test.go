@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+)
+
+func TestWeightedPrefetch(t *testing.T) {
+	cfg := ConsumeConfig{Prefetch: 14, Weights: map[string]int{"high": 6, "default": 1, "bulk": 0}}
+	queues := []string{"high", "default", "bulk"}
+	for rk, want := range map[string]int{"high": 12, "default": 2, "bulk": 0} {
+		if got := weightedPrefetch(cfg, queues, rk); got != want {
+			t.Errorf("%s: prefetch %d, want %d", rk, got, want)
+		}
+	}
+	// never starved below one
+	cfg = ConsumeConfig{Prefetch: 2, Weights: map[string]int{"high": 10, "default": 1}}
+	if got := weightedPrefetch(cfg, []string{"high", "default"}, "default"); got != 1 {
+		t.Errorf("small share: prefetch %d, want 1", got)
+	}
+}
+
+// with both queues backlogged, tasks complete in weight ratio because each
+// queue runs as many handlers as its prefetch.
+func TestWeightedServesInRatio(t *testing.T) {
+	a := &AMQP{topo: rmq.New("tasks", "default", "high")}
+	cfg := ConsumeConfig{Prefetch: 14, Weights: map[string]int{"high": 6, "default": 1}}
+	queues := []string{"high", "default"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	var done sync.Map // rk -> *atomic.Int64
+	handle := func(ctx context.Context, d Delivery) {
+		time.Sleep(2 * time.Millisecond)
+		n, _ := done.LoadOrStore(d.Message().Queue, new(atomic.Int64))
+		n.(*atomic.Int64).Add(1)
+	}
+	for _, rk := range queues {
+		deliveries := make(chan amqp.Delivery)
+		go func() { // always backlogged
+			for ctx.Err() == nil {
+				select {
+				case deliveries <- amqp.Delivery{Body: []byte(`{"id":"t","type":"x"}`)}:
+				case <-ctx.Done():
+				}
+			}
+		}()
+		a.serve(ctx, &wg, deliveries, rk, weightedPrefetch(cfg, queues, rk), handle)
+	}
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	count := func(rk string) int64 {
+		n, ok := done.Load(rk)
+		if !ok {
+			return 0
+		}
+		return n.(*atomic.Int64).Load()
+	}
+	high, def := count("high"), count("default")
+	if def == 0 || high < 4*def || high > 8*def {
+		t.Fatalf("high %d, default %d: want about 6:1", high, def)
+	}
+}
+
+// mgmtServer answers queue lookups with handle and counts them.
+func mgmtServer(t *testing.T, handle http.HandlerFunc) (*rmq.Mgmt, *atomic.Int64) {
+	t.Helper()
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		handle(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return &rmq.Mgmt{BaseURL: srv.URL, VHost: "/", Client: srv.Client()}, &calls
+}
+
+func TestCheckArgsCachesOutcome(t *testing.T) {
+	queues := []rmq.QueueDecl{{Name: "tasks.default", Args: amqp.Table{"x-max-priority": int32(10)}}}
+
+	if got := (&AMQP{}).ArgsStatus(); !strings.Contains(got, "RMQ_MGMT_URL not set") {
+		t.Fatalf("no mgmt: %q", got)
+	}
+
+	// an unreachable management API isn't held against the broker, but it
+	// isn't asked again on every check either
+	mgmt, calls := mgmtServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	a := &AMQP{mgmt: mgmt}
+	for range 3 {
+		if err := a.checkArgs(context.Background(), queues); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("mgmt asked %d times", n)
+	}
+	if got := a.ArgsStatus(); !strings.HasPrefix(got, "not verified: queue tasks.default") {
+		t.Fatalf("status %q", got)
+	}
+
+	// drift is cached the same way
+	mgmt, calls = mgmtServer(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"name": "tasks.default", "type": "classic", "arguments": {}}`))
+	})
+	a = &AMQP{mgmt: mgmt}
+	for range 3 {
+		if err := a.checkArgs(context.Background(), queues); err == nil || !strings.Contains(err.Error(), "x-max-priority") {
+			t.Fatalf("err %v, want drift", err)
+		}
+	}
+	if n := calls.Load(); n != 1 || a.ArgsStatus() != ArgsVerified {
+		t.Fatalf("mgmt asked %d times, status %q", n, a.ArgsStatus())
+	}
+}
+
+func TestCheckArgsDoesNotWaitForSlowMgmt(t *testing.T) {
+	queues := []rmq.QueueDecl{{Name: "tasks.default"}}
+	asked, release := make(chan struct{}), make(chan struct{})
+	mgmt, _ := mgmtServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(asked)
+		<-release
+		_, _ = w.Write([]byte(`{"name": "tasks.default", "type": "classic"}`))
+	})
+	a := &AMQP{mgmt: mgmt}
+
+	done := make(chan error, 1)
+	go func() { done <- a.checkArgs(context.Background(), queues) }()
+	<-asked
+
+	// a second check meanwhile gets the last outcome instead of blocking
+	second := make(chan error, 1)
+	go func() { second <- a.checkArgs(context.Background(), queues) }()
+	select {
+	case err := <-second:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("check blocked behind the management API call")
+	}
+	close(release)
+	if err := <-done; err != nil || a.ArgsStatus() != ArgsVerified {
+		t.Fatalf("err %v, status %q", err, a.ArgsStatus())
+	}
+}
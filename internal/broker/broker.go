@@ -0,0 +1,239 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+)
+
+// Message is the envelope moved between the API and workers. workers fetch
+// the payload by ID, so it stays small.
+type Message struct {
+	ID       string
+	Type     string
+	Queue    string // routing key, ex: "default"
+	Priority uint8
+	Headers  map[string]any
+
+	// Ready is when the message became deliverable: its publish time, or the
+	// end of its retry delay. set on delivery; zero when the broker can't tell.
+	Ready time.Time
+}
+
+// Delivery is a message handed to a worker. settle it exactly once.
+type Delivery interface {
+	Message() Message
+	Ack() error
+	// Requeue puts the message straight back (transient failure, no delay).
+	Requeue() error
+}
+
+// Retrier is a Delivery that hands itself back after a delay in one step,
+// settling it (Postgres: one UPDATE of its row). callers use it instead of
+// Broker.Retry followed by Ack, so a crash between the two can't leave both
+// the retry and the original.
+type Retrier interface {
+	RetryAfter(ctx context.Context, m Message, delay time.Duration) (time.Duration, error)
+}
+
+// TxPublisher is a Broker that can publish inside the caller's Postgres
+// transaction (the Postgres broker), so the message commits or rolls back
+// with the task row it points at.
+type TxPublisher interface {
+	PublishTx(ctx context.Context, tx pgx.Tx, m Message) error
+}
+
+// ArgsReporter is a Broker whose Check can compare queue arguments with the
+// topology (AMQP, through the management API).
+type ArgsReporter interface {
+	ArgsStatus() string
+}
+
+// ArgsVerified is the ArgsStatus of a broker whose last Check compared the
+// queue arguments.
+const ArgsVerified = "verified"
+
+// HandleFunc processes one delivery and settles it.
+type HandleFunc func(ctx context.Context, d Delivery)
+
+// Broker moves task messages. RabbitMQ (AMQP) is the default implementation;
+// Postgres (SKIP LOCKED + LISTEN/NOTIFY) serves deployments without RabbitMQ.
+type Broker interface {
+	// Publish sends m to its main queue.
+	Publish(ctx context.Context, m Message) error
+	// Retry sends m back to its queue after delay and returns the delay that
+	// will actually elapse (retry tiers round up).
+	Retry(ctx context.Context, m Message, delay time.Duration) (time.Duration, error)
+	// DeadLetter parks m in the DLQ selected by its queue and type.
+	DeadLetter(ctx context.Context, m Message) error
+	// Event mirrors a task transition (no-op unless the broker has an event log).
+	Event(ctx context.Context, ev rmq.Event) error
+	// Consume calls handle for messages of the given queues until ctx is
+	// done, then waits for in-flight handlers.
+	Consume(ctx context.Context, queues []string, handle HandleFunc) error
+	// Check verifies the broker is reachable and its topology in place.
+	Check(ctx context.Context) error
+	// Depths reports how many messages wait in each task queue.
+	Depths(ctx context.Context) ([]QueueDepth, error)
+	Close() error
+}
+
+// QueueDepth is the backlog of one queue. Messages counts ready messages
+// (not in flight); Consumers is -1 when the broker can't tell.
+type QueueDepth struct {
+	Queue     string // full name, ex: "tasks.default", "tasks.retry.default", "tasks.dlq"
+	Kind      string // main | retry | dead
+	Messages  int
+	Consumers int
+}
+
+// queue kinds of QueueDepth
+const (
+	KindMain  = "main"
+	KindRetry = "retry"
+	KindDead  = "dead"
+)
+
+// Kind reads BROKER: rabbitmq (default) | postgres.
+func Kind() (string, error) {
+	switch k := strings.ToLower(strings.TrimSpace(os.Getenv("BROKER"))); k {
+	case "", "rabbitmq", "amqp":
+		return "rabbitmq", nil
+	case "postgres":
+		return k, nil
+	default:
+		return "", fmt.Errorf("unknown BROKER %q (rabbitmq|postgres)", k)
+	}
+}
+
+// FromEnv builds the broker selected by BROKER. for rabbitmq it dials
+// RMQ_URL (or RMQ_USER/PASS/HOST/PORT); Close hangs up again. RMQ_MGMT_URL
+// lets Check compare queue arguments.
+func FromEnv(db *pgxpool.Pool, topo rmq.Topology, cfg ConsumeConfig) (Broker, error) {
+	kind, err := Kind()
+	if err != nil {
+		return nil, err
+	}
+	if kind == "postgres" {
+		return NewPostgres(db, topo, cfg), nil
+	}
+
+	url, err := rmq.URLFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, fmt.Errorf("amqp dial: %w", err)
+	}
+	a, err := NewAMQP(conn, topo, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	a.own = true
+	a.mgmt = rmq.MgmtFromEnv()
+	return a, nil
+}
+
+// Policy selects how a consumer divides its capacity between queues.
+type Policy string
+
+const (
+	// PolicyEqual: queues compete for the same capacity; no preference.
+	PolicyEqual Policy = "equal"
+	// PolicyWeighted: when every queue has a backlog they are served roughly
+	// in weight ratio.
+	PolicyWeighted Policy = "weighted"
+	// PolicyStrict: a lower queue is only read when every higher one is empty.
+	PolicyStrict Policy = "strict"
+)
+
+// ConsumeConfig is shared by both brokers.
+type ConsumeConfig struct {
+	// Prefetch is the in-flight budget: max unacked per consumer for
+	// PolicyEqual on AMQP, per worker otherwise.
+	Prefetch int
+	// Policy decides how the queues share the budget; Weights are per routing
+	// key (missing keys weigh 1 for weighted, 0 for strict).
+	Policy  Policy
+	Weights map[string]int
+	// PollInterval is how long pullers sleep when every queue is empty
+	// (AMQP strict, Postgres).
+	PollInterval time.Duration
+	// Visibility is how long a Postgres claim hides its message (default
+	// 1m). it must outlast the worker's HandlerTimeout, or a slow task is
+	// handed to a second worker while the first still runs it.
+	Visibility time.Duration
+	// DeliveryLimit is how often a Postgres message may be claimed without
+	// an outcome before the worker fails and dead-letters it (default 20,
+	// RabbitMQ's quorum queue default). AMQP takes it from the topology.
+	DeliveryLimit int
+}
+
+func (c ConsumeConfig) withDefaults(poll time.Duration) ConsumeConfig {
+	if c.Prefetch <= 0 {
+		c.Prefetch = 32
+	}
+	if c.Policy == "" {
+		c.Policy = PolicyEqual
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = poll
+	}
+	if c.Visibility <= 0 {
+		c.Visibility = time.Minute
+	}
+	if c.DeliveryLimit <= 0 {
+		c.DeliveryLimit = 20
+	}
+	return c
+}
+
+func (c ConsumeConfig) weight(rk string, def int) int {
+	if n, ok := c.Weights[rk]; ok {
+		return n
+	}
+	return def
+}
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return PolicyEqual, nil
+	case PolicyEqual, PolicyWeighted, PolicyStrict:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown consume policy %q (equal|weighted|strict)", s)
+	}
+}
+
+// ParseWeights parses "high:6,default:1".
+func ParseWeights(s string) (map[string]int, error) {
+	ws := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		rk, raw, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("weight %q: want <queue>:<n>", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("weight %q: want a non-negative integer", part)
+		}
+		ws[strings.TrimSpace(rk)] = n
+	}
+	return ws, nil
+}
@@ -0,0 +1,389 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+)
+
+// Postgres is the RabbitMQ-free broker over the queue_messages table
+// (migration 0006). consumers claim rows with FOR UPDATE SKIP LOCKED and a
+// visibility timeout; LISTEN/NOTIFY wakes them when something is published.
+type Postgres struct {
+	db   *pgxpool.Pool
+	topo rmq.Topology
+	cfg  ConsumeConfig
+}
+
+const notifyChannel = "dq_queue_messages"
+
+func NewPostgres(db *pgxpool.Pool, topo rmq.Topology, cfg ConsumeConfig) *Postgres {
+	return &Postgres{db: db, topo: topo, cfg: cfg.withDefaults(time.Second)}
+}
+
+// Visibility is how long a claimed message stays hidden. a worker that dies
+// mid-task has its message redelivered after it, like an AMQP connection
+// loss.
+func (p *Postgres) Visibility() time.Duration { return p.cfg.Visibility }
+
+// DeliveryLimit is how often a message may be claimed without an outcome.
+// claims carry the earlier ones in x-delivery-count, like a quorum queue.
+func (p *Postgres) DeliveryLimit() int { return p.cfg.DeliveryLimit }
+
+func (p *Postgres) Publish(ctx context.Context, m Message) error {
+	return traced(ctx, "postgresql", "publish", m, func(ctx context.Context, m Message) error {
+		return p.insert(ctx, p.db, m, m.Queue, 0, false)
+	})
+}
+
+// PublishTx inserts the message in tx; it becomes visible on commit.
+func (p *Postgres) PublishTx(ctx context.Context, tx pgx.Tx, m Message) error {
+	return traced(ctx, "postgresql", "publish", m, func(ctx context.Context, m Message) error {
+		return p.insert(ctx, tx, m, m.Queue, 0, false)
+	})
+}
+
+// Retry delays by run_after; there is no head-of-line blocking, so the
+// delay is exact.
+func (p *Postgres) Retry(ctx context.Context, m Message, delay time.Duration) (time.Duration, error) {
+	return delay, traced(ctx, "postgresql", "retry", m, func(ctx context.Context, m Message) error {
+		return p.insert(ctx, p.db, m, m.Queue, delay, false)
+	})
+}
+
+// DeadLetter keeps the row with dead=true under the DLQ name the AMQP
+// topology would use, so triage looks the same.
+func (p *Postgres) DeadLetter(ctx context.Context, m Message) error {
+	return traced(ctx, "postgresql", "dead-letter", m, func(ctx context.Context, m Message) error {
+		return p.insert(ctx, p.db, m, p.topo.DeadLetterQueueFor(m.Queue, m.Type), 0, true)
+	})
+}
+
+// Event is a no-op: task_events already is the event log.
+func (p *Postgres) Event(context.Context, rmq.Event) error { return nil }
+
+func (p *Postgres) Check(ctx context.Context) error {
+	var ok bool
+	err := p.db.QueryRow(ctx, `SELECT to_regclass('queue_messages') IS NOT NULL`).Scan(&ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("queue_messages table missing (run `make db-migrate`)")
+	}
+	return nil
+}
+
+// Depths counts queue_messages rows: due ones as main, delayed ones as
+// retry, dead ones under their DLQ. rows claimed by a worker are in flight
+// and not counted. queues of the topology without rows report 0.
+func (p *Postgres) Depths(ctx context.Context) ([]QueueDepth, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT queue,
+		       CASE WHEN dead THEN 'dead' WHEN run_after > now() THEN 'retry' ELSE 'main' END,
+		       count(*)
+		  FROM queue_messages
+		 WHERE dead OR locked_until IS NULL OR locked_until < now()
+		 GROUP BY 1, 2
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var (
+			queue, kind string
+			n           int
+		)
+		if err := rows.Scan(&queue, &kind, &n); err != nil {
+			return nil, err
+		}
+		// live rows are keyed by routing key; name them like the AMQP queues
+		switch kind {
+		case KindMain:
+			queue = p.topo.FullQueueName(queue)
+		case KindRetry:
+			queue = p.topo.RetryQueueName(queue)
+		}
+		counts[kind+"/"+queue] += n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var out []QueueDepth
+	add := func(kind, queue string) {
+		out = append(out, QueueDepth{Queue: queue, Kind: kind, Messages: counts[kind+"/"+queue], Consumers: -1})
+		delete(counts, kind+"/"+queue)
+	}
+	_, _, dead := p.topo.QueuesByKind()
+	for _, rk := range p.topo.RoutingKeys {
+		add(KindMain, p.topo.FullQueueName(rk))
+		add(KindRetry, p.topo.RetryQueueName(rk))
+	}
+	for _, q := range dead {
+		add(KindDead, q)
+	}
+	for k := range counts { // left over from an older topology
+		kind, queue, _ := strings.Cut(k, "/")
+		add(kind, queue)
+	}
+	return out, nil
+}
+
+func (p *Postgres) Close() error { return nil }
+
+// execer is a pool or a transaction.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func (p *Postgres) insert(ctx context.Context, db execer, m Message, queue string, delay time.Duration, dead bool) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO queue_messages (queue, task_id, type, priority, headers, run_after, dead)
+		VALUES ($1, $2, $3, $4, $5, now() + $6 * interval '1 millisecond', $7)
+	`, queue, m.ID, m.Type, int(m.Priority), jsonHeaders(m.Headers), delay.Milliseconds(), dead)
+	return err
+}
+
+func jsonHeaders(h map[string]any) []byte {
+	if len(h) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(h)
+	return b
+}
+
+// Consume runs Prefetch claimers. each claim walks the queues in an order
+// given by the policy: all at once (equal), by weight (strict), or a
+// weight-biased shuffle per claim (weighted).
+func (p *Postgres) Consume(ctx context.Context, queues []string, handle HandleFunc) error {
+	wake := newWaker()
+	go p.listen(ctx, wake)
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.cfg.Prefetch; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				// grab the wake channel before claiming so a notify that
+				// lands mid-claim isn't missed
+				woken := wake.wait()
+				d, err := p.claim(ctx, p.order(queues))
+				if err != nil && ctx.Err() == nil {
+					slog.Error("broker: claim", "err", err)
+				}
+				if d != nil {
+					handle(ctx, d)
+					continue
+				}
+				select {
+				case <-ctx.Done():
+				case <-woken:
+				case <-time.After(p.cfg.PollInterval): // delayed messages coming due
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// order returns groups of queues to try in turn.
+func (p *Postgres) order(queues []string) [][]string {
+	switch p.cfg.Policy {
+	case PolicyStrict:
+		var groups [][]string
+		for _, rk := range strictOrder(p.cfg, queues) {
+			groups = append(groups, []string{rk})
+		}
+		return groups
+	case PolicyWeighted:
+		// weighted random order without replacement
+		left := append([]string(nil), queues...)
+		var groups [][]string
+		for len(left) > 0 {
+			total := 0
+			for _, rk := range left {
+				total += p.cfg.weight(rk, 1)
+			}
+			if total == 0 {
+				break // the rest are disabled
+			}
+			n := rand.Intn(total)
+			for i, rk := range left {
+				if n -= p.cfg.weight(rk, 1); n < 0 {
+					groups = append(groups, []string{rk})
+					left = append(left[:i], left[i+1:]...)
+					break
+				}
+			}
+		}
+		return groups
+	default:
+		return [][]string{queues}
+	}
+}
+
+func (p *Postgres) claim(ctx context.Context, groups [][]string) (Delivery, error) {
+	for _, qs := range groups {
+		var (
+			id          int64
+			m           Message
+			prio        int
+			headers     []byte
+			deliveries  int
+			lockedUntil time.Time
+		)
+		err := p.db.QueryRow(ctx, `
+			UPDATE queue_messages
+			   SET locked_until = now() + $2 * interval '1 millisecond',
+			       deliveries   = deliveries + 1
+			 WHERE id = (
+				SELECT id FROM queue_messages
+				 WHERE queue = ANY($1)
+				   AND NOT dead
+				   AND run_after <= now()
+				   AND (locked_until IS NULL OR locked_until < now())
+				 ORDER BY priority DESC, run_after, id
+				 LIMIT 1
+				   FOR UPDATE SKIP LOCKED)
+			RETURNING id, queue, task_id, type, priority, headers, run_after, deliveries, locked_until
+		`, qs, p.cfg.Visibility.Milliseconds()).Scan(&id, &m.Queue, &m.ID, &m.Type, &prio, &headers, &m.Ready, &deliveries, &lockedUntil)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Priority = uint8(prio)
+		if len(headers) > 0 {
+			_ = json.Unmarshal(headers, &m.Headers)
+		}
+		if deliveries > 1 {
+			if m.Headers == nil {
+				m.Headers = map[string]any{}
+			}
+			m.Headers[headerDeliveryCount] = int32(deliveries - 1)
+		}
+		return &pgDelivery{db: p.db, id: id, lease: lockedUntil, m: m}, nil
+	}
+	return nil, nil
+}
+
+// listen holds one connection in LISTEN and wakes claimers on every notify.
+// it retries on connection loss; polling covers the gap.
+func (p *Postgres) listen(ctx context.Context, wake *waker) {
+	for ctx.Err() == nil {
+		err := func() error {
+			conn, err := p.db.Acquire(ctx)
+			if err != nil {
+				return err
+			}
+			defer conn.Release()
+			if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+				return err
+			}
+			for {
+				if _, err := conn.Conn().WaitForNotification(ctx); err != nil {
+					return err
+				}
+				wake.broadcast()
+			}
+		}()
+		if ctx.Err() == nil {
+			slog.Warn("broker: listen", "err", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.cfg.PollInterval):
+			}
+		}
+	}
+}
+
+var _ Retrier = (*pgDelivery)(nil)
+
+// headerDeliveryCount is how many earlier claims ended without an outcome,
+// the name quorum queues use.
+const headerDeliveryCount = "x-delivery-count"
+
+// pgDelivery settles its row only while its lease holds: lease is the
+// locked_until its claim set, so a worker whose claim expired and was taken
+// over can't ack or release the new holder's claim.
+type pgDelivery struct {
+	db    *pgxpool.Pool
+	id    int64
+	lease time.Time
+	m     Message
+}
+
+func (d *pgDelivery) Message() Message { return d.m }
+
+// Ack deletes the row. settling uses a fresh context so it still lands when
+// the consumer is shutting down.
+func (d *pgDelivery) Ack() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := d.db.Exec(ctx, `DELETE FROM queue_messages WHERE id = $1 AND locked_until = $2`, d.id, d.lease)
+	return err
+}
+
+// RetryAfter turns the claimed row itself into the retry: one UPDATE, so
+// there is never a new row next to an unacked original.
+func (d *pgDelivery) RetryAfter(ctx context.Context, m Message, delay time.Duration) (time.Duration, error) {
+	return delay, traced(ctx, "postgresql", "retry", m, func(ctx context.Context, m Message) error {
+		tag, err := d.db.Exec(ctx, `
+			UPDATE queue_messages
+			   SET queue = $2, type = $3, priority = $4, headers = $5,
+			       run_after = now() + $6 * interval '1 millisecond',
+			       locked_until = NULL, deliveries = 0
+			 WHERE id = $1 AND locked_until = $7 AND NOT dead
+		`, d.id, m.Queue, m.Type, int(m.Priority), jsonHeaders(m.Headers), delay.Milliseconds(), d.lease)
+		if err == nil && tag.RowsAffected() != 1 {
+			err = fmt.Errorf("message %d no longer claimed by this delivery", d.id)
+		}
+		return err
+	})
+}
+
+func (d *pgDelivery) Requeue() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := d.db.Exec(ctx, `UPDATE queue_messages SET locked_until = NULL WHERE id = $1 AND locked_until = $2`, d.id, d.lease)
+	return err
+}
+
+// waker is a broadcast: wait returns a channel closed by the next broadcast.
+type waker struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newWaker() *waker { return &waker{ch: make(chan struct{})} }
+
+func (w *waker) wait() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ch
+}
+
+func (w *waker) broadcast() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	close(w.ch)
+	w.ch = make(chan struct{})
+}
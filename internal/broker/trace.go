@@ -0,0 +1,32 @@
+package broker
+
+import (
+	"context"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/henok3878/distributed-task-queue/internal/tracing"
+)
+
+// traced runs send in a producer span named op ("publish", "retry",
+// "dead-letter") and hands it a copy of m whose headers carry the span's W3C
+// trace context, so the consumer continues the same trace.
+func traced(ctx context.Context, system, op string, m Message, send func(context.Context, Message) error) error {
+	ctx, span := tracing.Tracer().Start(ctx, op+" "+m.Queue, trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		semconv.MessagingSystemKey.String(system),
+		semconv.MessagingOperationTypeSend,
+		semconv.MessagingDestinationName(m.Queue),
+		semconv.MessagingMessageID(m.ID),
+	))
+	headers := make(map[string]any, len(m.Headers)+2)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	tracing.Inject(ctx, headers)
+	m.Headers = headers
+
+	err := send(ctx, m)
+	tracing.End(span, err)
+	return err
+}
@@ -0,0 +1,182 @@
+// Package envelope encrypts task payloads and results at rest. Each value
+// gets its own AES-256-GCM data key, stored next to it wrapped by a
+// key-encryption key (KEK) named by id. New values are wrapped with the
+// Keyring's active KEK; older ones open as long as their KEK is configured,
+// so KEKs rotate by adding a new active key and keeping the old ones.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// format is the envelope version, stored as dq_enc.
+const format = 1
+
+// Sealed is an encrypted value as stored in tasks.payload / tasks.result.
+type Sealed struct {
+	Format int    `json:"dq_enc"`
+	KeyID  string `json:"kid"`
+	DEK    []byte `json:"dek"` // nonce || AES-GCM(KEK, data key), aad: key id
+	Data   []byte `json:"ct"`  // nonce || AES-GCM(data key, value), aad: label
+}
+
+var (
+	// ErrNoKeys is returned by a nil Keyring.
+	ErrNoKeys = errors.New("encryption keys not configured (ENCRYPTION_KEYS)")
+	// ErrOpen covers a wrong key, a wrong label and tampering alike.
+	ErrOpen = errors.New("envelope: decrypt failed")
+)
+
+// Keyring holds the KEKs by id.
+type Keyring struct {
+	active string
+	keks   map[string]cipher.AEAD
+}
+
+// NewKeyring builds a Keyring from 32-byte KEKs; active names the one new
+// values are wrapped with.
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{active: active, keks: map[string]cipher.AEAD{}}
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, ":,") {
+			return nil, fmt.Errorf("bad key id %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s: want 32 bytes, got %d", id, len(key))
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		k.keks[id] = aead
+	}
+	if _, ok := k.keks[active]; !ok {
+		return nil, fmt.Errorf("active key %q not configured", active)
+	}
+	return k, nil
+}
+
+// Active is the id new values are wrapped with.
+func (k *Keyring) Active() string { return k.active }
+
+// Seal encrypts value under a fresh data key and returns the Sealed JSON.
+// label binds it to where it is stored (e.g. tasks/<id>/payload): Open with
+// another label fails, so sealed values can't be swapped between tasks.
+func (k *Keyring) Seal(value []byte, label string) ([]byte, error) {
+	if k == nil {
+		return nil, ErrNoKeys
+	}
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	data, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Sealed{
+		Format: format,
+		KeyID:  k.active,
+		DEK:    seal(k.keks[k.active], dek, []byte(k.active)),
+		Data:   seal(data, value, []byte(label)),
+	})
+}
+
+// Open decrypts a value sealed under label.
+func (k *Keyring) Open(sealed []byte, label string) ([]byte, error) {
+	if k == nil {
+		return nil, ErrNoKeys
+	}
+	var s Sealed
+	if err := json.Unmarshal(sealed, &s); err != nil || s.Format != format {
+		return nil, fmt.Errorf("%w: not an envelope", ErrOpen)
+	}
+	kek, ok := k.keks[s.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrOpen, s.KeyID)
+	}
+	dek, err := open(kek, s.DEK, []byte(s.KeyID))
+	if err != nil {
+		return nil, err
+	}
+	data, err := newGCM(dek)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOpen, err)
+	}
+	return open(data, s.Data, []byte(label))
+}
+
+// FromEnv builds a Keyring; nil when ENCRYPTION_KEYS is unset.
+//
+//	ENCRYPTION_KEYS    CSV of id:base64 32-byte keys, e.g. k2:...,k1:...
+//	ENCRYPTION_KEY_ID  id new values are wrapped with, default the first
+func FromEnv() (*Keyring, error) {
+	raw := strings.TrimSpace(os.Getenv("ENCRYPTION_KEYS"))
+	if raw == "" {
+		return nil, nil
+	}
+	keys := map[string][]byte{}
+	var first string
+	for _, part := range strings.Split(raw, ",") {
+		id, b64, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS: want id:base64, got %q", part)
+		}
+		key, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS: key %s: %w", id, err)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS: duplicate key id %q", id)
+		}
+		keys[id] = key
+		if first == "" {
+			first = id
+		}
+	}
+	active := strings.TrimSpace(os.Getenv("ENCRYPTION_KEY_ID"))
+	if active == "" {
+		active = first
+	}
+	k, err := NewKeyring(active, keys)
+	if err != nil {
+		return nil, fmt.Errorf("ENCRYPTION_KEYS: %w", err)
+	}
+	return k, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// seal returns nonce || ciphertext.
+func seal(aead cipher.AEAD, plaintext, aad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad)
+}
+
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrOpen
+	}
+	out, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, ErrOpen
+	}
+	return out, nil
+}
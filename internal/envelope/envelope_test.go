@@ -0,0 +1,89 @@
+package envelope_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/henok3878/distributed-task-queue/internal/envelope"
+)
+
+func key(b byte) []byte { return bytes.Repeat([]byte{b}, 32) }
+
+func TestSealOpen(t *testing.T) {
+	k, err := envelope.NewKeyring("k1", map[string][]byte{"k1": key(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte(`{"ssn":"123-45-6789"}`)
+	sealed, err := k.Seal(value, "tasks/a/payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("123-45")) {
+		t.Fatalf("plaintext in %s", sealed)
+	}
+	got, err := k.Open(sealed, "tasks/a/payload")
+	if err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("open = %s, %v", got, err)
+	}
+
+	// bound to its label
+	if _, err := k.Open(sealed, "tasks/b/payload"); !errors.Is(err, envelope.ErrOpen) {
+		t.Fatalf("other label: %v", err)
+	}
+	var nilKeys *envelope.Keyring
+	if _, err := nilKeys.Open(sealed, "tasks/a/payload"); !errors.Is(err, envelope.ErrNoKeys) {
+		t.Fatalf("nil keyring: %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, _ := envelope.NewKeyring("k1", map[string][]byte{"k1": key(1)})
+	sealed, _ := old.Seal([]byte(`1`), "l")
+
+	rotated, err := envelope.NewKeyring("k2", map[string][]byte{"k1": key(1), "k2": key(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rotated.Open(sealed, "l"); err != nil || string(got) != "1" {
+		t.Fatalf("old value after rotation: %s, %v", got, err)
+	}
+	fresh, _ := rotated.Seal([]byte(`2`), "l")
+	if _, err := old.Open(fresh, "l"); !errors.Is(err, envelope.ErrOpen) {
+		t.Fatalf("new value with the old keyring: %v", err)
+	}
+
+	retired, _ := envelope.NewKeyring("k2", map[string][]byte{"k2": key(2)})
+	if _, err := retired.Open(sealed, "l"); !errors.Is(err, envelope.ErrOpen) {
+		t.Fatalf("retired key: %v", err)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	b64 := func(b byte) string { return base64.StdEncoding.EncodeToString(key(b)) }
+
+	t.Setenv("ENCRYPTION_KEYS", "")
+	if k, err := envelope.FromEnv(); k != nil || err != nil {
+		t.Fatalf("unset: %v, %v", k, err)
+	}
+
+	t.Setenv("ENCRYPTION_KEYS", "k2:"+b64(2)+", k1:"+b64(1))
+	k, err := envelope.FromEnv()
+	if err != nil || k.Active() != "k2" {
+		t.Fatalf("got %v, %v", k, err)
+	}
+	t.Setenv("ENCRYPTION_KEY_ID", "k1")
+	if k, err := envelope.FromEnv(); err != nil || k.Active() != "k1" {
+		t.Fatalf("ENCRYPTION_KEY_ID: %v, %v", k, err)
+	}
+
+	for _, bad := range []string{"k1", "k1:" + b64(1) + ",k1:" + b64(2), "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		t.Setenv("ENCRYPTION_KEYS", bad)
+		t.Setenv("ENCRYPTION_KEY_ID", "")
+		if _, err := envelope.FromEnv(); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/henok3878/distributed-task-queue/internal/migrate"
+)
+
+// every down migration undoes its up: roll all the way back, then forward.
+func TestMigrationsRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logf := func(s string) { t.Log(s) }
+
+	if err := m.To(ctx, 0, logf); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate.Check(ctx, db); !errors.Is(err, migrate.ErrBehind) {
+		t.Fatalf("check on empty schema: %v", err)
+	}
+	var tasks bool
+	if err := db.QueryRow(ctx, `SELECT to_regclass('tasks') IS NOT NULL`).Scan(&tasks); err != nil || tasks {
+		t.Fatalf("tasks survived rollback (%v)", err)
+	}
+
+	if err := m.Up(ctx, logf); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate.Check(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,449 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/henok3878/distributed-task-queue/internal/api"
+	"github.com/henok3878/distributed-task-queue/internal/backoff"
+	"github.com/henok3878/distributed-task-queue/internal/broker"
+	"github.com/henok3878/distributed-task-queue/internal/store"
+	"github.com/henok3878/distributed-task-queue/pkg/worker"
+)
+
+// scenarios follow the README's Worker Behavior section.
+
+const typ = "email.send.v1"
+
+func ok(context.Context, []byte) ([]byte, error) { return []byte(`{"ok":true}`), nil }
+
+func TestSucceeds(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, nil)
+	h.handle(typ, ok)
+	h.start()
+
+	id := h.mustEnqueue(api.EnqueueRequest{Type: typ})
+	row := h.waitStatus(id, "SUCCEEDED")
+	if row.Attempts != 1 || string(row.ResultJSON) != `{"ok": true}` {
+		t.Fatalf("attempts=%d result=%s", row.Attempts, row.ResultJSON)
+	}
+	h.waitQueueEmpty()
+	if ev := h.events(id); !slices.Equal(ev, []string{"ENQUEUED", "RUNNING", "SUCCEEDED"}) {
+		t.Fatalf("events = %v", ev)
+	}
+}
+
+func TestRedeliveredSucceededTaskIsSkipped(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, nil)
+	var calls atomic.Int32
+	h.handle(typ, func(ctx context.Context, p []byte) ([]byte, error) {
+		calls.Add(1)
+		return ok(ctx, p)
+	})
+	h.start()
+
+	id := h.mustEnqueue(api.EnqueueRequest{Type: typ})
+	h.waitStatus(id, "SUCCEEDED")
+
+	// a duplicate delivery (e.g. redelivered after a lost ack)
+	if err := h.broker.Publish(context.Background(), broker.Message{ID: id, Type: typ, Queue: "default"}); err != nil {
+		t.Fatal(err)
+	}
+	h.waitQueueEmpty()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler ran %d times", n)
+	}
+	if row := h.task(id); row.Attempts != 1 {
+		t.Fatalf("attempts = %d", row.Attempts)
+	}
+}
+
+func TestMissingTaskIsAcked(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.start()
+
+	if err := h.broker.Publish(context.Background(), broker.Message{ID: "nope", Type: typ, Queue: "default"}); err != nil {
+		t.Fatal(err)
+	}
+	h.waitQueueEmpty()
+}
+
+func TestUnhandledTypeIsHandedBack(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, nil)
+	h.start() // no handler registered
+
+	id := h.mustEnqueue(api.EnqueueRequest{Type: typ})
+
+	// bounced at least twice, never run
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var bounces float64
+		err := db.QueryRow(context.Background(), `
+			SELECT coalesce((headers->>'x-dq-unhandled')::float8, 0) FROM queue_messages WHERE task_id = $1
+		`, id).Scan(&bounces)
+		if err == nil && bounces >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not handed back (bounces=%v, err=%v)", bounces, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	row := h.task(id)
+	if row.Status != "ENQUEUED" || row.Attempts != 0 {
+		t.Fatalf("status=%s attempts=%d", row.Status, row.Attempts)
+	}
+}
+
+func TestAttemptsExhaustedFailsWithoutRunning(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 2, nil)
+	var calls atomic.Int32
+	h.handle(typ, func(ctx context.Context, p []byte) ([]byte, error) {
+		calls.Add(1)
+		return ok(ctx, p)
+	})
+
+	id := h.mustEnqueue(api.EnqueueRequest{Type: typ})
+	if _, err := db.Exec(context.Background(), `UPDATE tasks SET attempts = max_attempts WHERE id = $1`, id); err != nil {
+		t.Fatal(err)
+	}
+	h.start()
+
+	row := h.waitStatus(id, "FAILED")
+	if row.LastError == nil || *row.LastError != "max attempts exceeded" || calls.Load() != 0 {
+		t.Fatalf("last_error=%v calls=%d", row.LastError, calls.Load())
+	}
+}
+
+func TestRetryThenSucceed(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, nil)
+	var calls atomic.Int32
+	h.handle(typ, func(ctx context.Context, p []byte) ([]byte, error) {
+		if calls.Add(1) == 1 {
+			return nil, errors.New("smtp down")
+		}
+		return ok(ctx, p)
+	})
+	h.start()
+
+	id := h.mustEnqueue(api.EnqueueRequest{Type: typ})
+	row := h.waitStatus(id, "SUCCEEDED")
+	if row.Attempts != 2 || row.LastError != nil {
+		t.Fatalf("attempts=%d last_error=%v", row.Attempts, row.LastError)
+	}
+	want := []string{"ENQUEUED", "RUNNING", "RETRY", "RUNNING", "SUCCEEDED"}
+	if ev := h.events(id); !slices.Equal(ev, want) {
+		t.Fatalf("events = %v, want %v", ev, want)
+	}
+}
+
+func TestRetryReusesMessageRow(t *testing.T) {
+	h := newHarness(t, worker.Config{Backoff: backoff.Fixed(time.Hour)})
+	h.addType(typ, "default", 3, nil)
+	h.handle(typ, func(context.Context, []byte) ([]byte, error) { return nil, errors.New("smtp down") })
+
+	id := h.mustEnqueue(api.EnqueueRequest{Type: typ})
+	var msgID int64
+	if err := db.QueryRow(context.Background(), `SELECT id FROM queue_messages WHERE task_id = $1`, id).Scan(&msgID); err != nil {
+		t.Fatalf("enqueue left no message: %v", err)
+	}
+	h.start()
+
+	// the retry is the same row pushed back, not a new one next to the original
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var ids []int64
+		rows, _ := db.Query(context.Background(), `SELECT id FROM queue_messages WHERE task_id = $1 AND run_after > now()`, id)
+		for rows.Next() {
+			var n int64
+			_ = rows.Scan(&n)
+			ids = append(ids, n)
+		}
+		rows.Close()
+		if len(ids) == 1 && ids[0] == msgID && h.live() == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delayed messages %v, live %d; want only %d", ids, h.live(), msgID)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestDeliveryLimitDeadLetters(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, nil)
+	var calls atomic.Int32
+	h.handle(typ, func(ctx context.Context, p []byte) ([]byte, error) {
+		calls.Add(1)
+		return ok(ctx, p)
+	})
+	h.consume.DeliveryLimit = 3
+
+	// three earlier claims ended without an outcome, e.g. workers crashing
+	id := h.mustEnqueue(api.EnqueueRequest{Type: typ})
+	if _, err := db.Exec(context.Background(), `UPDATE queue_messages SET deliveries = 3 WHERE task_id = $1`, id); err != nil {
+		t.Fatal(err)
+	}
+	h.start()
+
+	row := h.waitStatus(id, "FAILED")
+	if row.Attempts != 0 || calls.Load() != 0 {
+		t.Fatalf("attempts=%d calls=%d, want it failed without running", row.Attempts, calls.Load())
+	}
+	h.waitQueueEmpty()
+	var n int
+	if err := db.QueryRow(context.Background(), `SELECT count(*) FROM queue_messages WHERE task_id = $1 AND dead`, id).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("dead letters = %d (%v)", n, err)
+	}
+}
+
+func TestExpiredClaimCannotSettle(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	if err := h.broker.Publish(context.Background(), broker.Message{ID: "t1", Type: typ, Queue: "default"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// claim it, then let another worker take it over once the lease lapsed
+	ctx, cancel := context.WithCancel(context.Background())
+	claimed := make(chan broker.Delivery, 1)
+	b := broker.NewPostgres(db, h.topo, broker.ConsumeConfig{Prefetch: 1, PollInterval: 20 * time.Millisecond})
+	_ = b.Consume(ctx, []string{"default"}, func(_ context.Context, d broker.Delivery) {
+		claimed <- d
+		cancel()
+	})
+	d := <-claimed
+	if _, err := db.Exec(context.Background(), `UPDATE queue_messages SET locked_until = now() + interval '1 hour'`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Requeue(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.(broker.Retrier).RetryAfter(context.Background(), d.Message(), 0); err == nil {
+		t.Fatal("retry of an expired claim succeeded")
+	}
+	var held bool
+	if err := db.QueryRow(context.Background(), `SELECT locked_until > now() FROM queue_messages`).Scan(&held); err != nil || !held {
+		t.Fatalf("new claim lost: held=%v err=%v", held, err)
+	}
+}
+
+func TestFinalFailureDeadLetters(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "high", 2, nil)
+	h.handle(typ, func(context.Context, []byte) ([]byte, error) {
+		return nil, errors.New("bounced")
+	})
+	h.start()
+
+	id := h.mustEnqueue(api.EnqueueRequest{Type: typ})
+	row := h.waitStatus(id, "FAILED")
+	if row.Attempts != 2 || row.LastError == nil || *row.LastError != "bounced" {
+		t.Fatalf("attempts=%d last_error=%v", row.Attempts, row.LastError)
+	}
+	h.waitQueueEmpty()
+
+	var dlq string
+	if err := db.QueryRow(context.Background(), `
+		SELECT queue FROM queue_messages WHERE task_id = $1 AND dead
+	`, id).Scan(&dlq); err != nil {
+		t.Fatalf("no dead letter: %v", err)
+	}
+	if dlq != h.topo.DLQName {
+		t.Fatalf("dead letter in %s, want %s", dlq, h.topo.DLQName)
+	}
+	want := []string{"ENQUEUED", "RUNNING", "RETRY", "RUNNING", "FAILED"}
+	if ev := h.events(id); !slices.Equal(ev, want) {
+		t.Fatalf("events = %v, want %v", ev, want)
+	}
+}
+
+func TestConcurrencyCap(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, map[string]any{"max_concurrency": 1})
+	var running, peak atomic.Int32
+	h.handle(typ, func(ctx context.Context, p []byte) ([]byte, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		return ok(ctx, p)
+	})
+	h.start()
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		ids = append(ids, h.mustEnqueue(api.EnqueueRequest{Type: typ}))
+	}
+	for _, id := range ids {
+		// parked deliveries don't spend attempts
+		if row := h.waitStatus(id, "SUCCEEDED"); row.Attempts != 1 {
+			t.Fatalf("task %s attempts=%d", id, row.Attempts)
+		}
+	}
+	if p := peak.Load(); p != 1 {
+		t.Fatalf("peak concurrency %d, want 1", p)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, map[string]any{"rate_limit_per_sec": 5.0})
+	var (
+		mu    sync.Mutex
+		times []time.Time
+	)
+	h.handle(typ, func(ctx context.Context, p []byte) ([]byte, error) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		return ok(ctx, p)
+	})
+	h.start()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, h.mustEnqueue(api.EnqueueRequest{Type: typ}))
+	}
+	for _, id := range ids {
+		if row := h.waitStatus(id, "SUCCEEDED"); row.Attempts != 1 {
+			t.Fatalf("task %s attempts=%d", id, row.Attempts)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	slices.SortFunc(times, func(a, b time.Time) int { return a.Compare(b) })
+	// 3 tasks at 5/s with burst 1 span at least 2 emission intervals
+	if span := times[2].Sub(times[0]); span < 350*time.Millisecond {
+		t.Fatalf("3 tasks ran within %s", span)
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, nil)
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	h.handle(typ, func(ctx context.Context, p []byte) ([]byte, error) {
+		mu.Lock()
+		order = append(order, string(p))
+		mu.Unlock()
+		return ok(ctx, p)
+	})
+
+	low, high := 0, 9
+	a := h.mustEnqueue(api.EnqueueRequest{Type: typ, Priority: &low, Payload: []byte(`"low"`)})
+	b := h.mustEnqueue(api.EnqueueRequest{Type: typ, Priority: &high, Payload: []byte(`"high"`)})
+	h.consume.Prefetch = 1 // one claimer, so claim order is run order
+	h.start()
+	h.waitStatus(a, "SUCCEEDED")
+	h.waitStatus(b, "SUCCEEDED")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != `"high"` {
+		t.Fatalf("order = %v", order)
+	}
+}
+
+func TestEnqueueIdempotent(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, nil)
+
+	req := api.EnqueueRequest{Type: typ, IdempotencyKey: "order-42"}
+	a := h.mustEnqueue(req)
+	b := h.mustEnqueue(req)
+	if a != b {
+		t.Fatalf("ids differ: %s, %s", a, b)
+	}
+	var n int
+	if err := db.QueryRow(context.Background(), `SELECT count(*) FROM tasks WHERE idempotency_key = 'order-42'`).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("rows = %d (%v)", n, err)
+	}
+}
+
+func TestEnqueueRejectsUnknownType(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	if code, _ := h.enqueue(api.EnqueueRequest{Type: "nope.v1"}); code != http.StatusBadRequest {
+		t.Fatalf("status %d", code)
+	}
+	if h.live() != 0 {
+		t.Fatal("rejected enqueue was published")
+	}
+}
+
+func TestWaitIsWokenByNotify(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, nil)
+	release := make(chan struct{})
+	h.handle(typ, func(ctx context.Context, p []byte) ([]byte, error) {
+		<-release
+		return ok(ctx, p)
+	})
+	h.start()
+	id := h.mustEnqueue(api.EnqueueRequest{Type: typ})
+	h.waitStatus(id, "RUNNING")
+
+	// without a notification the wait runs out and answers 202
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	resp, err := http.Get(h.api.URL + "/tasks/" + id + "/wait?timeout=5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&got)
+	if resp.StatusCode != http.StatusOK || got["status"] != "SUCCEEDED" {
+		t.Fatalf("wait: %d %v", resp.StatusCode, got)
+	}
+}
+
+func TestTaskStats(t *testing.T) {
+	h := newHarness(t, worker.Config{})
+	h.addType(typ, "default", 3, nil)
+	h.handle(typ, ok)
+	h.addType("other.v1", "default", 1, nil)
+	h.start()
+	for i := 0; i < 3; i++ {
+		h.waitStatus(h.mustEnqueue(api.EnqueueRequest{Type: typ}), "SUCCEEDED")
+	}
+	h.mustEnqueue(api.EnqueueRequest{Type: "other.v1"}) // no handler: stays ENQUEUED
+
+	// live statuses are exact; terminal ones come from ANALYZE
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, `ANALYZE tasks`); err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.GetTaskStats(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ByStatus["SUCCEEDED"] != 3 || st.ByStatus["ENQUEUED"] != 1 {
+		t.Fatalf("by status = %v", st.ByStatus)
+	}
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// FromEnv builds the process logger and installs it as slog's default (which
+// the log package then writes through too):
+//
+//	LOG_FORMAT  text (default) | json
+//	LOG_LEVEL   debug | info (default) | warn | error
+//
+// every record carries service.
+func FromEnv(service string) (*slog.Logger, error) {
+	return New(os.Stderr, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"), service)
+}
+
+// New is FromEnv with explicit settings.
+func New(w io.Writer, format, level, service string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level = strings.TrimSpace(level); level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("bad LOG_LEVEL %q (debug|info|warn|error)", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch f := strings.ToLower(strings.TrimSpace(format)); f {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("bad LOG_FORMAT %q (text|json)", f)
+	}
+
+	l := slog.New(h).With("service", service)
+	slog.SetDefault(l)
+	return l, nil
+}
+
+type ctxKey struct{}
+
+// WithContext returns ctx carrying l.
+func WithContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext is the logger carried by ctx, or slog's default. when ctx is
+// inside a recording span the trace and span ids are attached, so log lines
+// can be joined with traces.
+func FromContext(ctx context.Context) *slog.Logger {
+	l, ok := ctx.Value(ctxKey{}).(*slog.Logger)
+	if !ok {
+		l = slog.Default()
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() && sc.IsSampled() {
+		l = l.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+	}
+	return l
+}
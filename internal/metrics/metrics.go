@@ -3,6 +3,7 @@ package metrics
 import (
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -27,13 +28,157 @@ var (
 		},
 		[]string{"type", "queue"},
 	)
+	ThrottledTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dq_throttled_total",
+			Help: "Deliveries pushed back by the worker before running, by type/reason (rate|concurrency).",
+		},
+		[]string{"type", "reason"},
+	)
+	UnhandledTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dq_unhandled_total",
+			Help: "Deliveries handed back by a worker that does not serve their type, by type/queue.",
+		},
+		[]string{"type", "queue"},
+	)
+	ThrottleDelay = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dq_throttle_delay_seconds",
+			Help:    "Delay applied to throttled deliveries, by type/reason (rate|concurrency).",
+			Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"type", "reason"},
+	)
+
+	// worker
+	TaskDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dq_task_duration_seconds",
+			Help:    "Handler run time by type/queue/outcome (succeeded|retry|failed).",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"type", "queue", "outcome"},
+	)
+	TaskAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dq_task_attempts_total",
+			Help: "Handler executions (attempts spent), by type/queue.",
+		},
+		[]string{"type", "queue"},
+	)
+	TaskRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dq_task_retries_total",
+			Help: "Failed attempts scheduled for another try, by type/queue.",
+		},
+		[]string{"type", "queue"},
+	)
+	TaskDLQ = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dq_task_dlq_total",
+			Help: "Tasks failed for good and sent to a dead-letter queue, by type/queue.",
+		},
+		[]string{"type", "queue"},
+	)
+	TasksInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dq_tasks_in_flight",
+			Help: "Handlers currently running, by type/queue.",
+		},
+		[]string{"type", "queue"},
+	)
+	QueueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dq_queue_wait_seconds",
+			Help:    "Time from a task becoming deliverable (publish, end of retry delay, or created_at) to its handler starting, by type/queue.",
+			Buckets: []float64{.005, .01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		},
+		[]string{"type", "queue"},
+	)
+
+	// backlog, polled by internal/backlog
+	QueueMessages = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dq_queue_messages",
+			Help: "Ready messages per broker queue, by queue/kind (main|retry|dead).",
+		},
+		[]string{"queue", "kind"},
+	)
+	QueueConsumers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dq_queue_consumers",
+			Help: "Consumers per broker queue, by queue/kind (RabbitMQ only).",
+		},
+		[]string{"queue", "kind"},
+	)
+	Tasks = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dq_tasks",
+			Help: "Tasks in the database by status.",
+		},
+		[]string{"status"},
+	)
+	OldestEnqueuedAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dq_oldest_enqueued_age_seconds",
+			Help: "Age (since created_at) of the oldest ENQUEUED task per queue; 0 when none.",
+		},
+		[]string{"queue"},
+	)
+	BacklogErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dq_backlog_errors_total",
+			Help: "Failed backlog samples by source (broker|db).",
+		},
+		[]string{"source"},
+	)
+
+	// completion webhooks, sent by internal/webhook
+	WebhookDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dq_webhook_deliveries_total",
+			Help: "Webhook delivery attempts by event (SUCCEEDED|FAILED|DLQ) and state (delivered|retry|failed).",
+		},
+		[]string{"event", "state"},
+	)
+	WebhookLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dq_webhook_duration_seconds",
+			Help:    "Webhook request duration, by state.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"state"},
+	)
 )
 
+var registerOnce sync.Once
+
+// MustRegisterAll registers every collector on Registry. safe to call more
+// than once (api and worker in one process).
 func MustRegisterAll() {
-	Registry.MustRegister(
-		EnqueueTotal,
-		EnqueueLatency,
-	)
+	registerOnce.Do(func() {
+		Registry.MustRegister(
+			EnqueueTotal,
+			EnqueueLatency,
+			ThrottledTotal,
+			ThrottleDelay,
+			UnhandledTotal,
+			TaskDuration,
+			TaskAttempts,
+			TaskRetries,
+			TaskDLQ,
+			TasksInFlight,
+			QueueWait,
+			QueueMessages,
+			QueueConsumers,
+			Tasks,
+			OldestEnqueuedAge,
+			BacklogErrors,
+			WebhookDeliveries,
+			WebhookLatency,
+		)
+	})
 }
 
 // register /metrics for specific methods to avoid conflicts with "GET /" subtree.
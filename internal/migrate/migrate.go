@@ -0,0 +1,296 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/henok3878/distributed-task-queue/db"
+)
+
+// Migration is one numbered schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string // empty = irreversible
+}
+
+// State is a migration and when it was applied (nil = pending).
+type State struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type Migrator struct {
+	db         *pgxpool.Pool
+	migrations []Migration // ascending
+}
+
+// New loads the migrations embedded in package db.
+func New(pool *pgxpool.Pool) (*Migrator, error) {
+	ms, err := Load(db.Migrations)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: pool, migrations: ms}, nil
+}
+
+// Load reads NNNN_name.up.sql / NNNN_name.down.sql pairs from fsys (any
+// directory), sorted by version.
+func Load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, f := range files {
+		base := path.Base(f)
+		stem, dir, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		if !ok || (dir != "up" && dir != "down") {
+			return nil, fmt.Errorf("migration %s: want NNNN_name.up.sql or NNNN_name.down.sql", base)
+		}
+		num, name, _ := strings.Cut(stem, "_")
+		v, err := strconv.Atoi(num)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("migration %s: bad version %q", base, num)
+		}
+		body, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[v]
+		if m == nil {
+			m = &Migration{Version: v, Name: name}
+			byVersion[v] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d: names differ (%q, %q)", v, m.Name, name)
+		}
+		if dir == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	var out []Migration
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s: missing up", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Latest is the newest known version.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Status lists every known migration with its applied time.
+func (m *Migrator) Status(ctx context.Context) ([]State, error) {
+	applied, err := m.applied(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]State, 0, len(m.migrations))
+	for _, mg := range m.migrations {
+		s := State{Migration: mg}
+		if at, ok := applied[mg.Version]; ok {
+			s.AppliedAt = &at
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// Pending lists known migrations not applied yet.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	states, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []Migration
+	for _, s := range states {
+		if s.AppliedAt == nil {
+			out = append(out, s.Migration)
+		}
+	}
+	return out, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context, log func(string)) error {
+	return m.To(ctx, m.Latest(), log)
+}
+
+// Down rolls back the n most recently applied migrations.
+func (m *Migrator) Down(ctx context.Context, n int, log func(string)) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && n > 0; i-- {
+			mg := m.migrations[i]
+			if _, ok := applied[mg.Version]; !ok {
+				continue
+			}
+			if err := m.down(ctx, conn, mg, log); err != nil {
+				return err
+			}
+			n--
+		}
+		return nil
+	})
+}
+
+// To applies pending migrations up to version and rolls back applied ones
+// above it.
+func (m *Migrator) To(ctx context.Context, version int, log func(string)) error {
+	if version < 0 || version > m.Latest() {
+		return fmt.Errorf("version %d out of range (0..%d)", version, m.Latest())
+	}
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mg := m.migrations[i]
+			if _, ok := applied[mg.Version]; ok && mg.Version > version {
+				if err := m.down(ctx, conn, mg, log); err != nil {
+					return err
+				}
+			}
+		}
+		for _, mg := range m.migrations {
+			if _, ok := applied[mg.Version]; !ok && mg.Version <= version {
+				if err := m.up(ctx, conn, mg, log); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) up(ctx context.Context, conn *pgxpool.Conn, mg Migration, log func(string)) error {
+	log(fmt.Sprintf("up   %04d_%s", mg.Version, mg.Name))
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, mg.Up); err != nil {
+			return fmt.Errorf("%04d_%s up: %w", mg.Version, mg.Name, err)
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, mg.Version, mg.Name)
+		return err
+	})
+}
+
+func (m *Migrator) down(ctx context.Context, conn *pgxpool.Conn, mg Migration, log func(string)) error {
+	if mg.Down == "" {
+		return fmt.Errorf("%04d_%s has no down migration", mg.Version, mg.Name)
+	}
+	log(fmt.Sprintf("down %04d_%s", mg.Version, mg.Name))
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, mg.Down); err != nil {
+			return fmt.Errorf("%04d_%s down: %w", mg.Version, mg.Name, err)
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, mg.Version)
+		return err
+	})
+}
+
+// withLock runs fn on one connection holding the migration advisory lock, so
+// concurrent migrators (e.g. two deploys) apply each migration once.
+func (m *Migrator) withLock(ctx context.Context, fn func(*pgxpool.Conn) error) error {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock(hashtext('dq.migrate'))`); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock(hashtext('dq.migrate'))`)
+
+	if _, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+		    version    INT PRIMARY KEY,
+		    name       TEXT NOT NULL,
+		    applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// applied maps version -> applied_at. a missing table means nothing applied.
+func (m *Migrator) applied(ctx context.Context, q querier) (map[int]time.Time, error) {
+	var exists bool
+	if err := q.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, err
+	}
+	out := map[int]time.Time{}
+	if !exists {
+		return out, nil
+	}
+	rows, err := q.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			v  int
+			at time.Time
+		)
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		out[v] = at
+	}
+	return out, rows.Err()
+}
+
+// ErrBehind means the database is missing migrations this binary needs.
+var ErrBehind = errors.New("database schema is behind")
+
+// Check returns ErrBehind (wrapped with what is missing) unless every
+// embedded migration is applied. binaries call it at startup.
+func Check(ctx context.Context, pool *pgxpool.Pool) error {
+	m, err := New(pool)
+	if err != nil {
+		return err
+	}
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		first := pending[0]
+		return fmt.Errorf("%w: %d pending, first %04d_%s (run `make db-migrate`)", ErrBehind, len(pending), first.Version, first.Name)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/henok3878/distributed-task-queue/db"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	ms, err := Load(db.Migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range ms {
+		if m.Version != i+1 {
+			t.Fatalf("version %d at position %d: versions must be contiguous from 1", m.Version, i)
+		}
+		if m.Down == "" {
+			t.Errorf("%04d_%s has no down migration", m.Version, m.Name)
+		}
+	}
+}
+
+func TestLoadRejectsBadNames(t *testing.T) {
+	for _, name := range []string{"m/0001_x.sql", "m/x_init.up.sql", "m/0001_a.sideways.sql"} {
+		fsys := fstest.MapFS{name: {Data: []byte("select 1")}}
+		if _, err := Load(fsys); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	fsys := fstest.MapFS{"m/0001_a.down.sql": {Data: []byte("select 1")}}
+	if _, err := Load(fsys); err == nil {
+		t.Error("down without up accepted")
+	}
+}
@@ -0,0 +1,122 @@
+package rmq
+
+import (
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type ExchangeDecl struct {
+	Name string
+	Kind string
+	Args amqp.Table
+}
+
+type QueueDecl struct {
+	Name string
+	Args amqp.Table
+}
+
+type BindingDecl struct {
+	Queue    string
+	Exchange string
+	Key      string
+}
+
+// Declarations is everything the broker must have for this topology, in
+// declare order. rmq-init applies it, /healthz checks it and the broker
+// definitions file is generated from it, so the three can't drift.
+type Declarations struct {
+	Exchanges []ExchangeDecl
+	Queues    []QueueDecl
+	Bindings  []BindingDecl
+}
+
+func (t Topology) Declarations() Declarations {
+	var d Declarations
+
+	// exchanges
+	d.Exchanges = append(d.Exchanges,
+		ExchangeDecl{Name: t.MainExchange, Kind: t.MainKind},
+		ExchangeDecl{Name: t.DLXExchange, Kind: t.DLXKind},
+	)
+
+	// queues + bindings
+	for _, rk := range t.RoutingKeys {
+		q := t.FullQueueName(rk) // e.g. tasks.default
+		d.Queues = append(d.Queues, QueueDecl{Name: q, Args: t.QueueArgs(rk)})
+		d.Bindings = append(d.Bindings, BindingDecl{Queue: q, Exchange: t.MainExchange, Key: rk})
+	}
+
+	// shared DLQ (always present) plus any dedicated per-queue/per-type DLQs, bound from DLX
+	d.Queues = append(d.Queues, QueueDecl{Name: t.DLQName})
+	for _, rk := range t.RoutingKeys {
+		dlq := t.DeadLetterQueue(rk)
+		if dlq != t.DLQName {
+			d.Queues = append(d.Queues, QueueDecl{Name: dlq})
+		}
+		d.Bindings = append(d.Bindings, BindingDecl{Queue: dlq, Exchange: t.DLXExchange, Key: rk})
+	}
+	for _, typ := range t.DLQTypes {
+		dlq := t.TypeDLQName(typ)
+		d.Queues = append(d.Queues, QueueDecl{Name: dlq})
+		d.Bindings = append(d.Bindings, BindingDecl{Queue: dlq, Exchange: t.DLXExchange, Key: typ})
+	}
+
+	// retries, depending on the mode:
+	switch t.RetryMode {
+	case RetryTiers:
+		// one queue per priority and tier, fixed x-message-ttl
+		for _, rk := range t.RoutingKeys {
+			for _, tier := range t.RetryTiers {
+				d.Queues = append(d.Queues, QueueDecl{Name: t.TierQueueName(rk, tier), Args: t.TierQueueArgs(rk, tier)})
+			}
+		}
+	case RetryDelayed:
+		// plugin exchange that holds messages for x-delay, then routes like the main exchange
+		d.Exchanges = append(d.Exchanges, ExchangeDecl{
+			Name: t.DelayedExchange,
+			Kind: "x-delayed-message",
+			Args: amqp.Table{"x-delayed-type": t.MainKind},
+		})
+		for _, rk := range t.RoutingKeys {
+			d.Bindings = append(d.Bindings, BindingDecl{Queue: t.FullQueueName(rk), Exchange: t.DelayedExchange, Key: rk})
+		}
+	default:
+		// retry queues (one per priority)... per-message TTL is set at publish time
+		// these queues dead-letter back to the main exchange with the same routing key
+		for _, rk := range t.RoutingKeys {
+			d.Queues = append(d.Queues, QueueDecl{Name: t.RetryQueueName(rk), Args: t.RetryQueueArgs(rk)})
+		}
+	}
+
+	// optional event log stream, fed by a fanout exchange
+	if t.EventStream != "" {
+		d.Exchanges = append(d.Exchanges, ExchangeDecl{Name: t.EventExchange, Kind: "fanout"})
+		d.Queues = append(d.Queues, QueueDecl{Name: t.EventStream, Args: t.EventStreamArgs()})
+		d.Bindings = append(d.Bindings, BindingDecl{Queue: t.EventStream, Exchange: t.EventExchange})
+	}
+
+	return d
+}
+
+// Apply declares every exchange, queue and binding. declares are idempotent;
+// a queue that exists with different arguments fails with PRECONDITION_FAILED.
+func (d Declarations) Apply(ch *amqp.Channel) error {
+	for _, e := range d.Exchanges {
+		if err := ch.ExchangeDeclare(e.Name, e.Kind, true, false, false, false, e.Args); err != nil {
+			return fmt.Errorf("declare %s: %w", e.Name, err)
+		}
+	}
+	for _, q := range d.Queues {
+		if _, err := ch.QueueDeclare(q.Name, true, false, false, false, q.Args); err != nil {
+			return fmt.Errorf("declare queue %s: %w", q.Name, err)
+		}
+	}
+	for _, b := range d.Bindings {
+		if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, nil); err != nil {
+			return fmt.Errorf("bind %s <- %s[%s]: %w", b.Queue, b.Exchange, b.Key, err)
+		}
+	}
+	return nil
+}
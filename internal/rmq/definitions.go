@@ -0,0 +1,69 @@
+package rmq
+
+import "encoding/json"
+
+// Definitions is the subset of a RabbitMQ definitions file (as loaded by
+// management.load_definitions) that describes topology. other top-level keys
+// (users, permissions, vhosts, ...) are carried through untouched.
+func (d Declarations) Definitions(vhost string) map[string]any {
+	exchanges := []map[string]any{}
+	for _, e := range d.Exchanges {
+		exchanges = append(exchanges, map[string]any{
+			"name":        e.Name,
+			"vhost":       vhost,
+			"type":        e.Kind,
+			"durable":     true,
+			"auto_delete": false,
+			"internal":    false,
+			"arguments":   argsOrEmpty(e.Args),
+		})
+	}
+	queues := []map[string]any{}
+	for _, q := range d.Queues {
+		queues = append(queues, map[string]any{
+			"name":        q.Name,
+			"vhost":       vhost,
+			"durable":     true,
+			"auto_delete": false,
+			"arguments":   argsOrEmpty(q.Args),
+		})
+	}
+	bindings := []map[string]any{}
+	for _, b := range d.Bindings {
+		bindings = append(bindings, map[string]any{
+			"source":           b.Exchange,
+			"vhost":            vhost,
+			"destination":      b.Queue,
+			"destination_type": "queue",
+			"routing_key":      b.Key,
+			"arguments":        map[string]any{},
+		})
+	}
+	return map[string]any{"exchanges": exchanges, "queues": queues, "bindings": bindings}
+}
+
+// MergeDefinitions replaces the topology keys of an existing definitions
+// document (may be empty) and returns it indented.
+func (d Declarations) MergeDefinitions(existing []byte, vhost string) ([]byte, error) {
+	doc := map[string]any{}
+	if len(existing) > 0 {
+		if err := json.Unmarshal(existing, &doc); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range d.Definitions(vhost) {
+		doc[k] = v
+	}
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+func argsOrEmpty(a map[string]any) map[string]any {
+	if a == nil {
+		return map[string]any{}
+	}
+	return a
+}
@@ -0,0 +1,40 @@
+package rmq
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Event mirrors a task_events row on the optional event stream.
+type Event struct {
+	TaskID string    `json:"task_id"`
+	Type   string    `json:"type"`
+	Queue  string    `json:"queue"`
+	Event  string    `json:"event"` // ENQUEUED|SUCCEEDED|FAILED|RETRY
+	Note   string    `json:"note,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// PublishEvent appends ev to the event stream. no-op when the stream is disabled.
+// the stream is an audit aid, callers treat errors as non-fatal.
+func PublishEvent(ctx context.Context, ch *amqp.Channel, t Topology, ev Event) error {
+	if t.EventExchange == "" {
+		return nil
+	}
+	if ev.At.IsZero() {
+		ev.At = time.Now().UTC()
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return ch.PublishWithContext(ctx, t.EventExchange, "", false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    ev.At,
+		Body:         body,
+	})
+}
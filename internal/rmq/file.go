@@ -0,0 +1,145 @@
+package rmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.yaml.in/yaml/v2"
+)
+
+// topologyFile is the on-disk (YAML or JSON) description of a topology.
+// names are still derived from the namespace; see deploy/rabbitmq/topology.yaml.
+type topologyFile struct {
+	Namespace   string      `json:"namespace" yaml:"namespace"`
+	MaxPriority uint8       `json:"max_priority" yaml:"max_priority"`
+	Queues      []fileQueue `json:"queues" yaml:"queues"`
+	DLQTypes    []string    `json:"dlq_types" yaml:"dlq_types"`
+	Retry       *fileRetry  `json:"retry" yaml:"retry"`
+	Events      *fileEvents `json:"events" yaml:"events"`
+}
+
+type fileQueue struct {
+	Name          string         `json:"name" yaml:"name"` // routing key
+	Type          string         `json:"type" yaml:"type"`
+	DeliveryLimit int            `json:"delivery_limit" yaml:"delivery_limit"`
+	MaxLength     int            `json:"max_length" yaml:"max_length"`
+	Overflow      string         `json:"overflow" yaml:"overflow"`
+	Arguments     map[string]any `json:"arguments" yaml:"arguments"`
+	DLQ           bool           `json:"dlq" yaml:"dlq"`
+	Retry         struct {
+		MaxLength int            `json:"max_length" yaml:"max_length"`
+		Arguments map[string]any `json:"arguments" yaml:"arguments"`
+	} `json:"retry" yaml:"retry"`
+}
+
+type fileRetry struct {
+	Mode  string   `json:"mode" yaml:"mode"`   // ttl | tiers | delayed
+	Tiers []string `json:"tiers" yaml:"tiers"` // ex: ["5s", "30s", "2m"]
+}
+
+type fileEvents struct {
+	MaxAge string `json:"max_age" yaml:"max_age"`
+}
+
+// LoadFile reads a topology file; .yaml/.yml are parsed as YAML, anything else as JSON.
+func LoadFile(path string) (Topology, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, fmt.Errorf("topology file: %w", err)
+	}
+
+	var f topologyFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(raw, &f)
+	default:
+		dec := json.NewDecoder(strings.NewReader(string(raw)))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	}
+	if err != nil {
+		return Topology{}, fmt.Errorf("topology file %s: %w", path, err)
+	}
+
+	var rks []string
+	for _, q := range f.Queues {
+		rks = append(rks, strings.TrimSpace(q.Name))
+	}
+	t := newTopology(strings.TrimSpace(f.Namespace), rks)
+	t.MaxPriority = f.MaxPriority
+	t.DLQTypes = f.DLQTypes
+	if f.Retry != nil {
+		if err := t.setRetry(f.Retry.Mode, f.Retry.Tiers); err != nil {
+			return Topology{}, fmt.Errorf("topology file %s: %w", path, err)
+		}
+	}
+
+	for _, q := range f.Queues {
+		name := strings.TrimSpace(q.Name)
+		if _, dup := t.Queues[name]; dup || name == "" {
+			return Topology{}, fmt.Errorf("topology file %s: empty or duplicate queue %q", path, name)
+		}
+		args, err := tableOf(q.Arguments)
+		if err != nil {
+			return Topology{}, fmt.Errorf("queue %q arguments: %w", name, err)
+		}
+		retryArgs, err := tableOf(q.Retry.Arguments)
+		if err != nil {
+			return Topology{}, fmt.Errorf("queue %q retry arguments: %w", name, err)
+		}
+		typ := q.Type
+		if typ == "" {
+			typ = QueueClassic
+		}
+		t.Queues[name] = QueueSpec{
+			Type:           typ,
+			DeliveryLimit:  q.DeliveryLimit,
+			MaxLength:      q.MaxLength,
+			Overflow:       q.Overflow,
+			Args:           args,
+			DLQ:            q.DLQ,
+			RetryMaxLength: q.Retry.MaxLength,
+			RetryArgs:      retryArgs,
+		}
+	}
+
+	if f.Events != nil {
+		t.EventExchange = t.Namespace + ".events"
+		t.EventStream = t.Namespace + ".events"
+		t.EventMaxAge = f.Events.MaxAge
+		if t.EventMaxAge == "" {
+			t.EventMaxAge = "7D"
+		}
+	}
+
+	if err := t.Validate(); err != nil {
+		return Topology{}, err
+	}
+	return t, nil
+}
+
+// tableOf converts decoded JSON/YAML values into AMQP field types. numbers
+// become int64 when integral: the broker rejects floats for lengths and TTLs.
+func tableOf(m map[string]any) (amqp.Table, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	t := amqp.Table{}
+	for k, v := range m {
+		switch n := v.(type) {
+		case float64:
+			if n == math.Trunc(n) {
+				v = int64(n)
+			}
+		case int:
+			v = int64(n)
+		}
+		t[k] = v
+	}
+	return t, t.Validate()
+}
@@ -0,0 +1,132 @@
+package rmq_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+)
+
+// writeFile puts body in a temp file called name and returns its path.
+func writeFile(t *testing.T, name, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFileYAML(t *testing.T) {
+	topo, err := rmq.LoadFile(writeFile(t, "topology.yaml", `
+namespace: jobs
+queues:
+  - name: default
+    type: quorum
+    delivery_limit: 10
+    max_length: 1000
+    overflow: reject-publish
+    dlq: true
+    retry:
+      max_length: 500
+    arguments:
+      x-single-active-consumer: true
+      x-message-ttl: 60000
+  - name: bulk
+    type: lazy
+retry:
+  mode: tiers
+  tiers: [30s, 5s]
+dlq_types: [email.send.v1]
+events: {}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topo.MainExchange != "jobs.direct" || topo.DLQName != "jobs.dlq" || !slices.Equal(topo.RoutingKeys, []string{"default", "bulk"}) {
+		t.Fatalf("names: %+v", topo)
+	}
+	spec := topo.Spec("default")
+	if spec.Type != rmq.QueueQuorum || spec.DeliveryLimit != 10 || spec.MaxLength != 1000 || spec.Overflow != "reject-publish" || !spec.DLQ || spec.RetryMaxLength != 500 {
+		t.Fatalf("default spec: %+v", spec)
+	}
+	// integral numbers become int64, the broker refuses floats
+	if v, ok := spec.Args["x-message-ttl"].(int64); !ok || v != 60000 {
+		t.Fatalf("x-message-ttl = %v (%T)", spec.Args["x-message-ttl"], spec.Args["x-message-ttl"])
+	}
+	args := topo.QueueArgs("default")
+	if args["x-queue-type"] != "quorum" || args["x-delivery-limit"] != int32(10) || args["x-single-active-consumer"] != true {
+		t.Fatalf("default args: %v", args)
+	}
+	if topo.Spec("bulk").Type != rmq.QueueLazy || topo.QueueArgs("bulk")["x-queue-mode"] != "lazy" {
+		t.Fatalf("bulk: %+v", topo.Spec("bulk"))
+	}
+	if topo.RetryMode != rmq.RetryTiers || !slices.Equal(topo.RetryTiers, []time.Duration{5 * time.Second, 30 * time.Second}) {
+		t.Fatalf("retry: %s %v", topo.RetryMode, topo.RetryTiers)
+	}
+	if !slices.Equal(topo.DLQTypes, []string{"email.send.v1"}) {
+		t.Fatalf("dlq types: %v", topo.DLQTypes)
+	}
+	if topo.EventStream != "jobs.events" || topo.EventMaxAge != "7D" {
+		t.Fatalf("events: %q %q", topo.EventStream, topo.EventMaxAge)
+	}
+}
+
+func TestLoadFileJSONDefaults(t *testing.T) {
+	topo, err := rmq.LoadFile(writeFile(t, "topology.json", `{"namespace": "tasks", "queues": [{"name": "default"}, {"name": "high"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topo.Spec("high").Type != rmq.QueueClassic || topo.QueueArgs("high") != nil {
+		t.Fatalf("high: %+v args %v", topo.Spec("high"), topo.QueueArgs("high"))
+	}
+	if topo.RetryMode != rmq.RetryTTL || topo.MaxPriority != 0 || topo.EventStream != "" || len(topo.DLQTypes) != 0 {
+		t.Fatalf("defaults: %+v", topo)
+	}
+}
+
+func TestLoadFileShipped(t *testing.T) {
+	topo, err := rmq.LoadFile("../../deploy/rabbitmq/topology.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topo.Namespace != "tasks" || !slices.Equal(topo.RoutingKeys, []string{"default", "high"}) {
+		t.Fatalf("topology: %s %v", topo.Namespace, topo.RoutingKeys)
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	const queues = "queues: [{name: default}]\n"
+	for _, tc := range []struct {
+		name, file, body, want string
+	}{
+		{"unknown yaml key", "t.yaml", "namespace: tasks\nqueus: []\n", "queus"},
+		{"unknown json key", "t.json", `{"namespace": "tasks", "queues": [{"name": "default", "ttl": 5}]}`, "ttl"},
+		{"bad syntax", "t.yaml", "namespace: [\n", "topology file"},
+		{"no namespace", "t.yaml", queues, "namespace is required"},
+		{"no queues", "t.yaml", "namespace: tasks\n", "at least one queue"},
+		{"empty queue name", "t.yaml", "namespace: tasks\nqueues: [{name: ' '}]\n", "empty or duplicate"},
+		{"duplicate queue", "t.yaml", "namespace: tasks\nqueues: [{name: default}, {name: default}]\n", "empty or duplicate"},
+		{"unknown type", "t.yaml", "namespace: tasks\nqueues: [{name: default, type: stream}]\n", `unknown type "stream"`},
+		{"unknown overflow", "t.yaml", "namespace: tasks\nqueues: [{name: default, overflow: drop-tail}]\n", `unknown overflow "drop-tail"`},
+		{"quorum with priority", "t.yaml", "namespace: tasks\nmax_priority: 10\nqueues: [{name: default, type: quorum}]\n", "do not support x-max-priority"},
+		{"dlq type is a queue", "t.yaml", "namespace: tasks\n" + queues + "dlq_types: [default]\n", "equal to a queue name"},
+		{"empty dlq type", "t.yaml", "namespace: tasks\n" + queues + "dlq_types: ['']\n", "empty or equal"},
+		{"bad arguments", "t.yaml", "namespace: tasks\nqueues: [{name: default, arguments: {x-foo: [{a: 1}]}}]\n", "arguments"},
+		{"bad retry tier", "t.yaml", "namespace: tasks\n" + queues + "retry: {mode: tiers, tiers: [soon]}\n", `retry tier "soon"`},
+		{"unknown retry mode", "t.yaml", "namespace: tasks\n" + queues + "retry: {mode: later}\n", `unknown retry mode "later"`},
+	} {
+		_, err := rmq.LoadFile(writeFile(t, tc.file, tc.body))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err %v, want %q", tc.name, err, tc.want)
+		}
+	}
+
+	if _, err := rmq.LoadFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
@@ -0,0 +1,103 @@
+package rmq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Mgmt is a minimal client for the RabbitMQ management HTTP API, used where
+// AMQP can't answer (exchange kinds, queue arguments, bindings).
+type Mgmt struct {
+	BaseURL string // ex: http://localhost:15672
+	User    string
+	Pass    string
+	VHost   string
+	Client  *http.Client
+}
+
+// MgmtFromEnv returns nil when RMQ_MGMT_URL is not set; callers then fall
+// back to what AMQP alone can tell.
+func MgmtFromEnv() *Mgmt {
+	base := strings.TrimRight(strings.TrimSpace(os.Getenv("RMQ_MGMT_URL")), "/")
+	if base == "" {
+		return nil
+	}
+	vhost := strings.TrimSpace(os.Getenv("RMQ_VHOST"))
+	if vhost == "" {
+		vhost = "/"
+	}
+	return &Mgmt{
+		BaseURL: base,
+		User:    os.Getenv("RMQ_USER"),
+		Pass:    os.Getenv("RMQ_PASS"),
+		VHost:   vhost,
+		Client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+type QueueInfo struct {
+	Name      string         `json:"name"`
+	Type      string         `json:"type"` // classic | quorum | stream
+	Arguments map[string]any `json:"arguments"`
+	Messages  int            `json:"messages"`
+	Consumers int            `json:"consumers"`
+}
+
+type ExchangeInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // direct | fanout | topic | headers | x-delayed-message ...
+}
+
+type BindingInfo struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	RoutingKey  string `json:"routing_key"`
+}
+
+// ErrNotFound is returned for queues/exchanges the broker doesn't have.
+var ErrNotFound = fmt.Errorf("not found")
+
+func (m *Mgmt) Queue(ctx context.Context, name string) (QueueInfo, error) {
+	var q QueueInfo
+	err := m.get(ctx, "/api/queues/"+url.PathEscape(m.VHost)+"/"+url.PathEscape(name), &q)
+	return q, err
+}
+
+func (m *Mgmt) Exchange(ctx context.Context, name string) (ExchangeInfo, error) {
+	var e ExchangeInfo
+	err := m.get(ctx, "/api/exchanges/"+url.PathEscape(m.VHost)+"/"+url.PathEscape(name), &e)
+	return e, err
+}
+
+// Bindings lists the bindings whose destination is queue.
+func (m *Mgmt) Bindings(ctx context.Context, queue string) ([]BindingInfo, error) {
+	var bs []BindingInfo
+	err := m.get(ctx, "/api/queues/"+url.PathEscape(m.VHost)+"/"+url.PathEscape(queue)+"/bindings", &bs)
+	return bs, err
+}
+
+func (m *Mgmt) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(m.User, m.Pass)
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("mgmt %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
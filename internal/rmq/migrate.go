@@ -0,0 +1,206 @@
+package rmq
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// migration step operations
+const (
+	StepDeclare = "declare"
+	StepBind    = "bind"
+	StepUnbind  = "unbind"
+	StepShovel  = "shovel"
+	StepDelete  = "delete"
+)
+
+// MigrationStep is one broker operation of a queue migration.
+type MigrationStep struct {
+	Op       string
+	Queue    string
+	Args     amqp.Table // declare
+	Exchange string     // bind, unbind
+	Key      string     // bind, unbind
+	To       string     // shovel destination
+	IfUnused bool       // delete: refuse while the queue has consumers
+	Hint     string     // added to the error if the step fails
+}
+
+func (s MigrationStep) String() string {
+	switch s.Op {
+	case StepBind, StepUnbind:
+		return fmt.Sprintf("%s %s <- %s[%s]", s.Op, s.Queue, s.Exchange, s.Key)
+	case StepShovel:
+		return fmt.Sprintf("shovel %s -> %s", s.Queue, s.To)
+	}
+	return s.Op + " " + s.Queue
+}
+
+// MigrationSteps is how MigrateQueue recreates queue name with its declared
+// arguments without losing messages:
+//
+//  1. declare <name>.migrate, bind it like name, unbind name (new publishes land in the temp queue)
+//  2. shovel every message name -> temp (publisher confirms, ack after confirm)
+//  3. delete name (only if empty and without consumers), declare it with the new arguments, bind it
+//  4. unbind temp, shovel temp -> name, delete temp
+//
+// consumers of name must be stopped first or step 3 refuses. messages
+// published straight to the queue (retry queues) during step 3 are unroutable,
+// so pause workers while migrating retry queues. per-message TTLs restart.
+func (d Declarations) MigrationSteps(name string) ([]MigrationStep, error) {
+	var q *QueueDecl
+	for i := range d.Queues {
+		if d.Queues[i].Name == name {
+			q = &d.Queues[i]
+		}
+	}
+	if q == nil {
+		return nil, fmt.Errorf("queue %s is not part of the topology", name)
+	}
+	if q.Args["x-queue-type"] == "stream" {
+		return nil, fmt.Errorf("queue %s: streams can't be shovelled with basic.get; recreate it manually", name)
+	}
+	var binds []BindingDecl
+	for _, b := range d.Bindings {
+		if b.Queue == name {
+			binds = append(binds, b)
+		}
+	}
+
+	// the temp queue keeps dead-letter routing so retry messages that expire
+	// mid-migration still flow back to the main exchange
+	tmp := name + ".migrate"
+	tmpArgs := amqp.Table{}
+	for _, k := range []string{"x-dead-letter-exchange", "x-dead-letter-routing-key"} {
+		if v, ok := q.Args[k]; ok {
+			tmpArgs[k] = v
+		}
+	}
+
+	steps := []MigrationStep{{Op: StepDeclare, Queue: tmp, Args: tmpArgs}}
+	for _, b := range binds {
+		steps = append(steps,
+			MigrationStep{Op: StepBind, Queue: tmp, Exchange: b.Exchange, Key: b.Key},
+			MigrationStep{Op: StepUnbind, Queue: name, Exchange: b.Exchange, Key: b.Key},
+		)
+	}
+	steps = append(steps,
+		MigrationStep{Op: StepShovel, Queue: name, To: tmp},
+		MigrationStep{Op: StepDelete, Queue: name, IfUnused: true, Hint: "stop its consumers; messages so far are safe in " + tmp},
+		MigrationStep{Op: StepDeclare, Queue: name, Args: q.Args, Hint: "messages are in " + tmp},
+	)
+	for _, b := range binds {
+		steps = append(steps,
+			MigrationStep{Op: StepBind, Queue: name, Exchange: b.Exchange, Key: b.Key},
+			MigrationStep{Op: StepUnbind, Queue: tmp, Exchange: b.Exchange, Key: b.Key},
+		)
+	}
+	return append(steps,
+		MigrationStep{Op: StepShovel, Queue: tmp, To: name},
+		MigrationStep{Op: StepDelete, Queue: tmp},
+	), nil
+}
+
+// MigrateQueue runs the MigrationSteps of queue name on one confirm channel.
+func (d Declarations) MigrateQueue(ctx context.Context, conn *amqp.Connection, name string) error {
+	steps, err := d.MigrationSteps(name)
+	if err != nil {
+		return err
+	}
+
+	ch, err := confirmChannel(conn)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, s := range steps {
+		var err error
+		switch s.Op {
+		case StepDeclare:
+			_, err = ch.QueueDeclare(s.Queue, true, false, false, false, s.Args)
+		case StepBind:
+			err = ch.QueueBind(s.Queue, s.Key, s.Exchange, false, nil)
+		case StepUnbind:
+			err = ch.QueueUnbind(s.Queue, s.Key, s.Exchange, nil)
+		case StepDelete:
+			_, err = ch.QueueDelete(s.Queue, s.IfUnused, true, false)
+		case StepShovel:
+			var n int
+			n, err = shovel(ctx, ch, s.Queue, s.To)
+			if err != nil {
+				err = fmt.Errorf("after %d messages: %w", n, err)
+				break
+			}
+			log.Printf("migrate %s: moved %d messages %s -> %s", name, n, s.Queue, s.To)
+		default:
+			err = fmt.Errorf("unknown step")
+		}
+		if err != nil {
+			if s.Hint != "" {
+				return fmt.Errorf("%s (%s): %w", s, s.Hint, err)
+			}
+			return fmt.Errorf("%s: %w", s, err)
+		}
+	}
+	log.Printf("migrate %s: recreated", name)
+	return nil
+}
+
+// shovel moves every ready message from -> to through the default exchange,
+// acking each source message only after the broker confirmed the copy.
+func shovel(ctx context.Context, ch *amqp.Channel, from, to string) (int, error) {
+	n := 0
+	for {
+		d, ok, err := ch.Get(from, false)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			return n, nil
+		}
+		conf, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", to, false, false, amqp.Publishing{
+			Headers:         d.Headers,
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			DeliveryMode:    d.DeliveryMode,
+			Priority:        d.Priority,
+			CorrelationId:   d.CorrelationId,
+			ReplyTo:         d.ReplyTo,
+			Expiration:      d.Expiration,
+			MessageId:       d.MessageId,
+			Timestamp:       d.Timestamp,
+			Type:            d.Type,
+			UserId:          d.UserId,
+			AppId:           d.AppId,
+			Body:            d.Body,
+		})
+		if err != nil {
+			_ = d.Nack(false, true)
+			return n, err
+		}
+		if ok, err := conf.WaitContext(ctx); err != nil || !ok {
+			_ = d.Nack(false, true)
+			return n, fmt.Errorf("publish to %s not confirmed: %v", to, err)
+		}
+		if err := d.Ack(false); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func confirmChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("amqp channel: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("amqp confirm: %w", err)
+	}
+	return ch, nil
+}
@@ -0,0 +1,207 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// plan actions
+const (
+	ActionOK       = "ok"       // matches
+	ActionCreate   = "create"   // missing, a plain declare fixes it
+	ActionRecreate = "recreate" // exists with other type/arguments; needs a migration
+)
+
+// Change is one line of a topology plan.
+type Change struct {
+	Kind   string // exchange | queue | binding
+	Name   string
+	Action string
+	Detail string
+}
+
+func (c Change) String() string {
+	mark := map[string]string{ActionOK: "=", ActionCreate: "+", ActionRecreate: "~"}[c.Action]
+	s := fmt.Sprintf("%s %s %s", mark, c.Kind, c.Name)
+	if c.Detail != "" {
+		s += ": " + c.Detail
+	}
+	return s
+}
+
+// Plan compares the declarations with the broker. existence and equivalence
+// are probed with (passive) declares on throwaway channels; when m is not nil
+// the management API adds exchange kinds, argument-level diffs and binding
+// checks.
+func (d Declarations) Plan(ctx context.Context, conn *amqp.Connection, m *Mgmt) ([]Change, error) {
+	var out []Change
+
+	for _, e := range d.Exchanges {
+		c := Change{Kind: "exchange", Name: e.Name, Action: ActionOK}
+		err := probe(conn, func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclarePassive(e.Name, e.Kind, true, false, false, false, nil)
+		})
+		switch {
+		case isCode(err, amqp.NotFound):
+			c.Action = ActionCreate
+		case err != nil:
+			return nil, fmt.Errorf("exchange %s: %w", e.Name, err)
+		case m != nil:
+			// a passive declare ignores the kind; only the management API has it
+			info, err := m.Exchange(ctx, e.Name)
+			if err != nil {
+				return nil, fmt.Errorf("mgmt exchange %s: %w", e.Name, err)
+			}
+			if diff := DiffExchange(e, info); diff != "" {
+				c.Action, c.Detail = ActionRecreate, diff
+			}
+		default:
+			c.Detail = "kind not verified without RMQ_MGMT_URL"
+		}
+		out = append(out, c)
+	}
+
+	for _, q := range d.Queues {
+		c := Change{Kind: "queue", Name: q.Name, Action: ActionOK}
+		err := probe(conn, func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclarePassive(q.Name, true, false, false, false, nil)
+			return err
+		})
+		if isCode(err, amqp.NotFound) {
+			c.Action = ActionCreate
+			out = append(out, c)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("queue %s: %w", q.Name, err)
+		}
+
+		if m != nil {
+			info, err := m.Queue(ctx, q.Name)
+			if err != nil {
+				return nil, fmt.Errorf("mgmt queue %s: %w", q.Name, err)
+			}
+			if diff := DiffArgs(q.Args, info); diff != "" {
+				c.Action, c.Detail = ActionRecreate, diff
+			}
+		} else {
+			// no management API: an active declare with the wanted args is a
+			// no-op when they match and PRECONDITION_FAILED when they don't
+			err := probe(conn, func(ch *amqp.Channel) error {
+				_, err := ch.QueueDeclare(q.Name, true, false, false, false, q.Args)
+				return err
+			})
+			if isCode(err, amqp.PreconditionFailed) {
+				var aerr *amqp.Error
+				errors.As(err, &aerr)
+				c.Action, c.Detail = ActionRecreate, aerr.Reason
+			} else if err != nil {
+				return nil, fmt.Errorf("queue %s: %w", q.Name, err)
+			}
+		}
+		out = append(out, c)
+	}
+
+	for _, b := range d.Bindings {
+		name := fmt.Sprintf("%s <- %s[%s]", b.Queue, b.Exchange, b.Key)
+		c := Change{Kind: "binding", Name: name, Action: ActionCreate}
+		if m != nil {
+			bs, err := m.Bindings(ctx, b.Queue)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return nil, fmt.Errorf("mgmt bindings %s: %w", b.Queue, err)
+			}
+			for _, have := range bs {
+				if have.Source == b.Exchange && have.RoutingKey == b.Key {
+					c.Action = ActionOK
+				}
+			}
+		} else {
+			c.Detail = "unverified without RMQ_MGMT_URL (binding is idempotent)"
+		}
+		out = append(out, c)
+	}
+
+	return out, nil
+}
+
+// DiffExchange describes how the broker's exchange differs from want, "" if
+// equal. it compares the kind, which a passive declare can't see.
+func DiffExchange(want ExchangeDecl, have ExchangeInfo) string {
+	if have.Type != want.Kind {
+		return fmt.Sprintf("kind %s -> %s", have.Type, want.Kind)
+	}
+	return ""
+}
+
+// DiffArgs describes how the broker's queue differs from want, "" if equal.
+func DiffArgs(want amqp.Table, have QueueInfo) string {
+	wantType := QueueClassic
+	if v, ok := want["x-queue-type"].(string); ok {
+		wantType = v
+	}
+	haveType := have.Type
+	if haveType == "" {
+		haveType = QueueClassic
+	}
+
+	var diffs []string
+	if wantType != haveType {
+		diffs = append(diffs, fmt.Sprintf("type %s -> %s", haveType, wantType))
+	}
+
+	keys := map[string]bool{}
+	for k := range want {
+		keys[k] = true
+	}
+	for k := range have.Arguments {
+		keys[k] = true
+	}
+	delete(keys, "x-queue-type") // compared above; newer brokers report it on every queue
+
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		w, h := argString(want[k]), argString(have.Arguments[k])
+		if w != h {
+			diffs = append(diffs, fmt.Sprintf("%s %s -> %s", k, h, w))
+		}
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// argString normalises AMQP and JSON numbers so 10, int32(10) and 10.0 compare equal.
+func argString(v any) string {
+	switch n := v.(type) {
+	case nil:
+		return "<none>"
+	case float64:
+		if n == float64(int64(n)) {
+			return fmt.Sprint(int64(n))
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// probe runs fn on a short-lived channel; a failed declare closes the channel
+// it ran on, so checks must not share one.
+func probe(conn *amqp.Connection, fn func(*amqp.Channel) error) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+func isCode(err error, code int) bool {
+	var aerr *amqp.Error
+	return errors.As(err, &aerr) && aerr.Code == code
+}
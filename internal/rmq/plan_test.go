@@ -0,0 +1,125 @@
+package rmq_test
+
+import (
+	"slices"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+)
+
+func TestDiffArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want amqp.Table
+		have rmq.QueueInfo
+		diff string
+	}{
+		{"both plain", nil, rmq.QueueInfo{}, ""},
+		{"json numbers equal amqp ints", amqp.Table{"x-max-priority": int32(10)},
+			rmq.QueueInfo{Type: "classic", Arguments: map[string]any{"x-max-priority": 10.0}}, ""},
+		{"type reported on every queue", amqp.Table{"x-queue-type": "quorum"},
+			rmq.QueueInfo{Type: "quorum", Arguments: map[string]any{"x-queue-type": "quorum"}}, ""},
+		{"changed", amqp.Table{"x-max-length": int32(100)},
+			rmq.QueueInfo{Arguments: map[string]any{"x-max-length": 50.0}}, "x-max-length 50 -> 100"},
+		{"added", amqp.Table{"x-overflow": "reject-publish"},
+			rmq.QueueInfo{}, "x-overflow <none> -> reject-publish"},
+		{"removed", nil,
+			rmq.QueueInfo{Arguments: map[string]any{"x-dead-letter-exchange": "tasks.dlx"}}, "x-dead-letter-exchange tasks.dlx -> <none>"},
+		{"type change", amqp.Table{"x-queue-type": "quorum", "x-delivery-limit": int32(10)},
+			rmq.QueueInfo{Type: "classic", Arguments: map[string]any{"x-queue-mode": "lazy"}},
+			"type classic -> quorum, x-delivery-limit <none> -> 10, x-queue-mode lazy -> <none>"},
+	} {
+		if got := rmq.DiffArgs(tc.want, tc.have); got != tc.diff {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.diff)
+		}
+	}
+}
+
+func TestDiffExchange(t *testing.T) {
+	want := rmq.ExchangeDecl{Name: "tasks.delayed", Kind: "x-delayed-message"}
+	if got := rmq.DiffExchange(want, rmq.ExchangeInfo{Name: "tasks.delayed", Type: "x-delayed-message"}); got != "" {
+		t.Errorf("same kind: %q", got)
+	}
+	if got := rmq.DiffExchange(want, rmq.ExchangeInfo{Name: "tasks.delayed", Type: "direct"}); got != "kind direct -> x-delayed-message" {
+		t.Errorf("kind change: %q", got)
+	}
+}
+
+func TestMigrationSteps(t *testing.T) {
+	topo := rmq.New("tasks", "default", "high")
+	topo.RetryMode, topo.DelayedExchange = rmq.RetryDelayed, "tasks.delayed"
+	steps, err := topo.Declarations().MigrationSteps("tasks.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range steps {
+		got = append(got, s.String())
+	}
+	// every binding moves to the temp queue before the shovel and back
+	// before the return shovel, so no publish is lost in between
+	want := []string{
+		"declare tasks.default.migrate",
+		"bind tasks.default.migrate <- tasks.direct[default]",
+		"unbind tasks.default <- tasks.direct[default]",
+		"bind tasks.default.migrate <- tasks.delayed[default]",
+		"unbind tasks.default <- tasks.delayed[default]",
+		"shovel tasks.default -> tasks.default.migrate",
+		"delete tasks.default",
+		"declare tasks.default",
+		"bind tasks.default <- tasks.direct[default]",
+		"unbind tasks.default.migrate <- tasks.direct[default]",
+		"bind tasks.default <- tasks.delayed[default]",
+		"unbind tasks.default.migrate <- tasks.delayed[default]",
+		"shovel tasks.default.migrate -> tasks.default",
+		"delete tasks.default.migrate",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("steps:\n%v\nwant:\n%v", got, want)
+	}
+	// the original goes only when unused, the temp one regardless
+	if !steps[6].IfUnused || steps[13].IfUnused {
+		t.Fatalf("delete guards: %+v / %+v", steps[6], steps[13])
+	}
+}
+
+func TestMigrationStepsRetryQueue(t *testing.T) {
+	topo := rmq.New("tasks", "default")
+	topo.Queues["default"] = rmq.QueueSpec{RetryMaxLength: 100}
+	steps, err := topo.Declarations().MigrationSteps("tasks.retry.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the temp queue keeps only the dead-letter routing, so retries that
+	// expire mid-migration still go back to the main queue
+	tmp := steps[0]
+	if tmp.Op != rmq.StepDeclare || tmp.Queue != "tasks.retry.default.migrate" || len(tmp.Args) != 2 ||
+		tmp.Args["x-dead-letter-exchange"] != "tasks.direct" || tmp.Args["x-dead-letter-routing-key"] != "default" {
+		t.Fatalf("temp queue: %+v", tmp)
+	}
+	// a retry queue has no bindings: shovel out, recreate, shovel back
+	var ops []string
+	for _, s := range steps {
+		ops = append(ops, s.Op)
+	}
+	if want := []string{"declare", "shovel", "delete", "declare", "shovel", "delete"}; !slices.Equal(ops, want) {
+		t.Fatalf("ops %v, want %v", ops, want)
+	}
+	if steps[3].Args["x-max-length"] != int32(100) {
+		t.Fatalf("recreated with %v", steps[3].Args)
+	}
+}
+
+func TestMigrationStepsErrors(t *testing.T) {
+	topo := rmq.New("tasks", "default")
+	topo.EventExchange, topo.EventStream, topo.EventMaxAge = "tasks.events", "tasks.events", "7D"
+	d := topo.Declarations()
+	if _, err := d.MigrationSteps("tasks.nope"); err == nil {
+		t.Error("unknown queue: no error")
+	}
+	if _, err := d.MigrationSteps("tasks.events"); err == nil {
+		t.Error("stream: no error")
+	}
+}
@@ -0,0 +1,140 @@
+package rmq
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// retry modes
+const (
+	// RetryTTL: one retry queue per routing key, delay as per-message TTL.
+	// RabbitMQ only expires the message at the head, so a long delay blocks
+	// shorter ones queued behind it.
+	RetryTTL = "ttl"
+	// RetryTiers: one queue per routing key and fixed delay (x-message-ttl);
+	// every message in a tier has the same TTL, so none blocks another.
+	RetryTiers = "tiers"
+	// RetryDelayed: the rabbitmq_delayed_message_exchange plugin holds each
+	// message for its x-delay and then routes it to the main queue.
+	RetryDelayed = "delayed"
+)
+
+var defaultTiers = []time.Duration{
+	5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute, time.Hour,
+}
+
+// RetryTarget is where to publish a message that should re-enter queue rk after Delay.
+type RetryTarget struct {
+	Exchange string
+	Key      string
+	Delay    time.Duration // what will actually elapse (tiers round up)
+	Headers  amqp.Table    // x-delay for RetryDelayed
+	Expiry   string        // per-message TTL for RetryTTL
+}
+
+// RetryTarget resolves the retry publish for rk and the wanted delay.
+func (t Topology) RetryTarget(rk string, delay time.Duration) RetryTarget {
+	switch t.RetryMode {
+	case RetryTiers:
+		tier := t.tierFor(delay)
+		return RetryTarget{Key: t.TierQueueName(rk, tier), Delay: tier}
+	case RetryDelayed:
+		return RetryTarget{
+			Exchange: t.DelayedExchange,
+			Key:      rk,
+			Delay:    delay,
+			Headers:  amqp.Table{"x-delay": delay.Milliseconds()},
+		}
+	default:
+		return RetryTarget{
+			Key:    t.RetryQueueName(rk),
+			Delay:  delay,
+			Expiry: strconv.FormatInt(delay.Milliseconds(), 10), // TTL in ms
+		}
+	}
+}
+
+// tierFor rounds delay up to the next tier so a retry never fires early;
+// delays beyond the largest tier use the largest.
+func (t Topology) tierFor(delay time.Duration) time.Duration {
+	for _, tier := range t.RetryTiers {
+		if delay <= tier {
+			return tier
+		}
+	}
+	return t.RetryTiers[len(t.RetryTiers)-1]
+}
+
+// TierQueueName ex: "tasks.retry.default.30s"
+func (t Topology) TierQueueName(rk string, tier time.Duration) string {
+	return t.RetryQueueName(rk) + "." + tierName(tier)
+}
+
+// TierQueueArgs: like RetryQueueArgs plus the tier's fixed x-message-ttl.
+func (t Topology) TierQueueArgs(rk string, tier time.Duration) amqp.Table {
+	args := t.RetryQueueArgs(rk)
+	args["x-message-ttl"] = tier.Milliseconds()
+	return args
+}
+
+// tierName keeps queue names short: 5s, 2m, 1h instead of 2m0s.
+func tierName(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
+
+// retryFromEnv reads RETRY_MODE (ttl|tiers|delayed) and RETRY_TIERS.
+func (t *Topology) retryFromEnv() error {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("RETRY_MODE")))
+	var tiers []string
+	for _, s := range strings.Split(os.Getenv("RETRY_TIERS"), ",") {
+		if v := strings.TrimSpace(s); v != "" {
+			tiers = append(tiers, v)
+		}
+	}
+	return t.setRetry(mode, tiers)
+}
+
+func (t *Topology) setRetry(mode string, tiers []string) error {
+	if mode == "" {
+		mode = RetryTTL
+	}
+	t.RetryMode = mode
+	switch mode {
+	case RetryTTL:
+	case RetryTiers:
+		t.RetryTiers = nil
+		for _, s := range tiers {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("retry tier %q: want a positive duration", s)
+			}
+			t.RetryTiers = append(t.RetryTiers, d)
+		}
+		if len(t.RetryTiers) == 0 {
+			t.RetryTiers = append(t.RetryTiers, defaultTiers...)
+		}
+		// ascending and unique: tierFor takes the first that fits, and a
+		// repeated tier ("30s,30000ms") would declare its queue twice
+		slices.Sort(t.RetryTiers)
+		t.RetryTiers = slices.Compact(t.RetryTiers)
+	case RetryDelayed:
+		t.DelayedExchange = t.Namespace + ".delayed"
+	default:
+		return fmt.Errorf("unknown retry mode %q (ttl|tiers|delayed)", mode)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package rmq_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+)
+
+// load reads the env-configured topology over the default/high queues.
+func load(t *testing.T, env map[string]string) (rmq.Topology, error) {
+	t.Helper()
+	t.Setenv("RMQ_TOPOLOGY_FILE", "")
+	t.Setenv("RMQ_NAMESPACE", "tasks")
+	t.Setenv("QUEUES", "default,high")
+	for _, k := range []string{"RETRY_MODE", "RETRY_TIERS", "QUEUE_TYPES", "QUEUE_DELIVERY_LIMIT", "DLQ_PER_QUEUE", "DLQ_TYPES", "RMQ_MAX_PRIORITY", "RMQ_EVENTS_STREAM"} {
+		t.Setenv(k, "")
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	return rmq.Load()
+}
+
+func TestRetryTiersSortedAndDeduped(t *testing.T) {
+	topo, err := load(t, map[string]string{"RETRY_MODE": "tiers", "RETRY_TIERS": "2m, 5s,30s,5s,120s,30000ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute}
+	if !slices.Equal(topo.RetryTiers, want) {
+		t.Fatalf("tiers = %v, want %v", topo.RetryTiers, want)
+	}
+
+	topo, err = load(t, map[string]string{"RETRY_MODE": "tiers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topo.RetryTiers) != 5 || topo.RetryTiers[0] != 5*time.Second || topo.RetryTiers[4] != time.Hour {
+		t.Fatalf("default tiers = %v", topo.RetryTiers)
+	}
+}
+
+func TestRetryConfigErrors(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"RETRY_MODE": "sometimes"},
+		{"RETRY_MODE": "tiers", "RETRY_TIERS": "5s,soon"},
+		{"RETRY_MODE": "tiers", "RETRY_TIERS": "0s"},
+		{"RETRY_MODE": "tiers", "RETRY_TIERS": "-5s"},
+	} {
+		if _, err := load(t, env); err == nil {
+			t.Errorf("%v: no error", env)
+		}
+	}
+}
+
+func TestRetryTargetRoundsUpToTier(t *testing.T) {
+	topo, err := load(t, map[string]string{"RETRY_MODE": "tiers", "RETRY_TIERS": "1h,5s,30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		delay time.Duration
+		tier  time.Duration
+		key   string
+	}{
+		{0, 5 * time.Second, "tasks.retry.default.5s"},
+		{time.Second, 5 * time.Second, "tasks.retry.default.5s"},
+		{5 * time.Second, 5 * time.Second, "tasks.retry.default.5s"},
+		{5*time.Second + time.Millisecond, 30 * time.Second, "tasks.retry.default.30s"},
+		{10 * time.Minute, time.Hour, "tasks.retry.default.1h"},
+		// above the top tier: the top tier, the longest wait there is
+		{3 * time.Hour, time.Hour, "tasks.retry.default.1h"},
+	} {
+		got := topo.RetryTarget("default", tc.delay)
+		if got.Delay != tc.tier || got.Key != tc.key || got.Exchange != "" || got.Expiry != "" || got.Headers != nil {
+			t.Errorf("%s: got %+v, want %s on %s", tc.delay, got, tc.tier, tc.key)
+		}
+	}
+}
+
+func TestRetryTargetModes(t *testing.T) {
+	const delay = 1500 * time.Millisecond
+	for _, tc := range []struct {
+		mode     string
+		exchange string
+		key      string
+		expiry   string
+		xDelay   any
+	}{
+		// per-message TTL on the retry queue, dead-lettered back to the main queue
+		{"ttl", "", "tasks.retry.high", "1500", nil},
+		// the plugin's exchange holds it and routes by the main routing key
+		{"delayed", "tasks.delayed", "high", "", int64(1500)},
+	} {
+		topo, err := load(t, map[string]string{"RETRY_MODE": tc.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := topo.RetryTarget("high", delay)
+		if got.Exchange != tc.exchange || got.Key != tc.key || got.Expiry != tc.expiry || got.Delay != delay {
+			t.Errorf("%s: got %+v", tc.mode, got)
+		}
+		if x := got.Headers["x-delay"]; x != tc.xDelay {
+			t.Errorf("%s: x-delay %v (%T), want %v", tc.mode, x, x, tc.xDelay)
+		}
+	}
+}
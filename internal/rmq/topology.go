@@ -1,7 +1,13 @@
 package rmq
 
 import (
+	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
 
 	"github.com/henok3878/distributed-task-queue/internal/config"
 )
@@ -13,11 +19,51 @@ type Topology struct {
 	DLXExchange  string   // "<ns>.dlx"
 	DLXKind      string   // "direct"
 	QueuePrefix  string   // "<ns>"
-	DLQName      string   // "<ns>.dlq"
+	DLQName      string   // "<ns>.dlq" (shared)
 	RoutingKeys  []string // e.g. ["default","high"]
+	MaxPriority  uint8    // x-max-priority on main queues; 0 = plain FIFO queues
+
+	Queues map[string]QueueSpec // per routing key; missing = classic
+
+	// DLQTypes get a dedicated "<ns>.dlq.<type>" bound on the DLX with the
+	// type as routing key; it wins over the queue's (shared or own) DLQ.
+	DLQTypes []string
+
+	RetryMode       string          // ttl (default) | tiers | delayed, see retry.go
+	RetryTiers      []time.Duration // tiers mode, ascending
+	DelayedExchange string          // delayed mode: "<ns>.delayed" (x-delayed-message)
+
+	EventExchange string // "<ns>.events" fanout feeding EventStream; "" = disabled
+	EventStream   string // "<ns>.events" stream queue (task event log)
+	EventMaxAge   string // x-max-age of the stream, e.g. "7D"
+}
+
+// queue types a main queue can be declared as
+const (
+	QueueClassic = "classic"
+	QueueLazy    = "lazy" // classic with x-queue-mode=lazy
+	QueueQuorum  = "quorum"
+)
+
+type QueueSpec struct {
+	Type          string     // classic (default) | lazy | quorum
+	DeliveryLimit int        // quorum only: x-delivery-limit, 0 = broker default
+	MaxLength     int        // x-max-length, 0 = unbounded
+	Overflow      string     // x-overflow: drop-head (default) | reject-publish | reject-publish-dlx
+	Args          amqp.Table // extra raw arguments
+	DLQ           bool       // dedicated "<ns>.dlq.<rk>" instead of the shared DLQ
+
+	RetryMaxLength int        // x-max-length of the retry queue
+	RetryArgs      amqp.Table // extra raw arguments of the retry queue
 }
 
+// Load reads the topology from RMQ_TOPOLOGY_FILE when set, otherwise from
+// RMQ_NAMESPACE/QUEUES and the optional per-feature env vars.
 func Load() (Topology, error) {
+	if path := strings.TrimSpace(os.Getenv("RMQ_TOPOLOGY_FILE")); path != "" {
+		return LoadFile(path)
+	}
+
 	ns, err := config.GetFromEnv("RMQ_NAMESPACE")
 	if err != nil {
 		return Topology{}, err
@@ -35,7 +81,84 @@ func Load() (Topology, error) {
 		}
 	}
 
-	t := Topology{
+	// optional: real AMQP message priorities (RMQ_MAX_PRIORITY=1..255, 10 is plenty)
+	var maxPrio uint8
+	if raw := strings.TrimSpace(os.Getenv("RMQ_MAX_PRIORITY")); raw != "" {
+		n, err := strconv.ParseUint(raw, 10, 8)
+		if err != nil {
+			return Topology{}, fmt.Errorf("RMQ_MAX_PRIORITY must be 0..255: %w", err)
+		}
+		maxPrio = uint8(n)
+	}
+
+	// optional: per routing key queue types, ex: "default:quorum,high:lazy"
+	specs := map[string]QueueSpec{}
+	if raw := strings.TrimSpace(os.Getenv("QUEUE_TYPES")); raw != "" {
+		deliveryLimit := 0
+		if v := strings.TrimSpace(os.Getenv("QUEUE_DELIVERY_LIMIT")); v != "" {
+			if deliveryLimit, err = strconv.Atoi(v); err != nil || deliveryLimit < 0 {
+				return Topology{}, fmt.Errorf("QUEUE_DELIVERY_LIMIT must be a non-negative integer")
+			}
+		}
+		for _, part := range strings.Split(raw, ",") {
+			rk, typ, ok := strings.Cut(strings.TrimSpace(part), ":")
+			if !ok {
+				return Topology{}, fmt.Errorf("QUEUE_TYPES entry %q: want <queue>:<type>", part)
+			}
+			spec := QueueSpec{Type: strings.TrimSpace(typ)}
+			if spec.Type == QueueQuorum {
+				spec.DeliveryLimit = deliveryLimit
+			}
+			specs[strings.TrimSpace(rk)] = spec
+		}
+	}
+
+	// optional: dead-letter routing, ex: DLQ_PER_QUEUE=true, DLQ_TYPES="email.send.v1"
+	if on, _ := strconv.ParseBool(strings.TrimSpace(os.Getenv("DLQ_PER_QUEUE"))); on {
+		for _, rk := range rks {
+			spec := specs[rk]
+			spec.DLQ = true
+			specs[rk] = spec
+		}
+	}
+
+	t := newTopology(ns, rks)
+	t.MaxPriority = maxPrio
+	t.Queues = specs
+	if err := t.retryFromEnv(); err != nil {
+		return Topology{}, err
+	}
+	for _, typ := range strings.Split(os.Getenv("DLQ_TYPES"), ",") {
+		if v := strings.TrimSpace(typ); v != "" {
+			t.DLQTypes = append(t.DLQTypes, v)
+		}
+	}
+
+	// optional: stream mirroring task events, ex: RMQ_EVENTS_STREAM=true
+	if on, _ := strconv.ParseBool(strings.TrimSpace(os.Getenv("RMQ_EVENTS_STREAM"))); on {
+		t.EventExchange = ns + ".events"
+		t.EventStream = ns + ".events"
+		t.EventMaxAge = strings.TrimSpace(os.Getenv("RMQ_EVENTS_MAX_AGE"))
+		if t.EventMaxAge == "" {
+			t.EventMaxAge = "7D"
+		}
+	}
+
+	if err := t.Validate(); err != nil {
+		return Topology{}, err
+	}
+	return t, nil
+}
+
+// New is the plain topology for ns and routing keys rks: classic queues, a
+// shared DLQ and TTL retries, as with only RMQ_NAMESPACE/QUEUES set.
+func New(ns string, rks ...string) Topology {
+	return newTopology(ns, rks)
+}
+
+// newTopology derives every name from the namespace.
+func newTopology(ns string, rks []string) Topology {
+	return Topology{
 		Namespace:    ns,
 		MainExchange: ns + ".direct",
 		MainKind:     "direct",
@@ -44,14 +167,187 @@ func Load() (Topology, error) {
 		QueuePrefix:  ns,
 		DLQName:      ns + ".dlq",
 		RoutingKeys:  rks,
+		Queues:       map[string]QueueSpec{},
+		RetryMode:    RetryTTL,
 	}
-	return t, nil
+}
+
+// Validate rejects combinations the broker would refuse at declare time.
+func (t Topology) Validate() error {
+	if t.Namespace == "" {
+		return fmt.Errorf("topology: namespace is required")
+	}
+	if len(t.RoutingKeys) == 0 {
+		return fmt.Errorf("topology: at least one queue is required")
+	}
+	for rk, spec := range t.Queues {
+		switch spec.Overflow {
+		case "", "drop-head", "reject-publish", "reject-publish-dlx":
+		default:
+			return fmt.Errorf("queue %q: unknown overflow %q (drop-head|reject-publish|reject-publish-dlx)", rk, spec.Overflow)
+		}
+		if !contains(t.RoutingKeys, rk) {
+			return fmt.Errorf("queue %q has a type but is not a routing key %v", rk, t.RoutingKeys)
+		}
+		switch spec.Type {
+		case "", QueueClassic, QueueLazy:
+		case QueueQuorum:
+			if t.MaxPriority > 0 {
+				return fmt.Errorf("queue %q: quorum queues do not support x-max-priority", rk)
+			}
+		default:
+			return fmt.Errorf("queue %q: unknown type %q (classic|lazy|quorum)", rk, spec.Type)
+		}
+	}
+	for _, typ := range t.DLQTypes {
+		// type keys share the DLX with routing keys, so they must not collide
+		if typ == "" || contains(t.RoutingKeys, typ) {
+			return fmt.Errorf("dlq type %q: empty or equal to a queue name", typ)
+		}
+	}
+	return nil
+}
+
+// Spec returns the declared spec for rk, classic when unset.
+func (t Topology) Spec(rk string) QueueSpec {
+	s, ok := t.Queues[rk]
+	if !ok || s.Type == "" {
+		s.Type = QueueClassic
+	}
+	return s
 }
 
 func (t Topology) FullQueueName(rk string) string {
 	return t.QueuePrefix + "." + rk
 }
 
+// QueueArgs are the declare arguments of the main queue for rk.
+func (t Topology) QueueArgs(rk string) amqp.Table {
+	args := amqp.Table{}
+	spec := t.Spec(rk)
+	switch spec.Type {
+	case QueueLazy:
+		args["x-queue-mode"] = "lazy"
+	case QueueQuorum:
+		args["x-queue-type"] = QueueQuorum
+		if spec.DeliveryLimit > 0 {
+			// no DLX on purpose: the worker fails the task on its last
+			// delivery (x-delivery-count), so the row, the per-type DLQ and
+			// the FAILED event stay in step. one the broker dead-lettered
+			// itself would stay RUNNING/ENQUEUED.
+			args["x-delivery-limit"] = int32(spec.DeliveryLimit)
+		}
+	}
+	if t.MaxPriority > 0 {
+		args["x-max-priority"] = int32(t.MaxPriority)
+	}
+	if spec.MaxLength > 0 {
+		args["x-max-length"] = int32(spec.MaxLength)
+	}
+	if spec.Overflow != "" {
+		args["x-overflow"] = spec.Overflow
+	}
+	for k, v := range spec.Args {
+		args[k] = v
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// RetryQueueArgs are the declare arguments of the retry queue for rk. it
+// dead-letters back to the main exchange with the original routing key.
+func (t Topology) RetryQueueArgs(rk string) amqp.Table {
+	spec := t.Spec(rk)
+	args := amqp.Table{
+		"x-dead-letter-exchange":    t.MainExchange,
+		"x-dead-letter-routing-key": rk,
+	}
+	if spec.RetryMaxLength > 0 {
+		args["x-max-length"] = int32(spec.RetryMaxLength)
+	}
+	for k, v := range spec.RetryArgs {
+		args[k] = v
+	}
+	return args
+}
+
+// DeadLetterQueue is where messages dead-lettered with routing key rk end
+// up: the queue's own DLQ, or the shared one.
+func (t Topology) DeadLetterQueue(rk string) string {
+	if t.Spec(rk).DLQ {
+		return t.DLQName + "." + rk
+	}
+	return t.DLQName
+}
+
+// TypeDLQName is the dedicated DLQ of a type listed in DLQTypes.
+func (t Topology) TypeDLQName(typ string) string {
+	return t.DLQName + "." + typ
+}
+
+// DeadLetterQueueFor is the DLQ a terminal failure of typ from rk lands in.
+func (t Topology) DeadLetterQueueFor(rk, typ string) string {
+	if contains(t.DLQTypes, typ) {
+		return t.TypeDLQName(typ)
+	}
+	return t.DeadLetterQueue(rk)
+}
+
+// DeadLetterKey is the DLX routing key for a terminal failure of typ from
+// queue rk: the type when it has its own DLQ, otherwise rk.
+func (t Topology) DeadLetterKey(rk, typ string) string {
+	if contains(t.DLQTypes, typ) {
+		return typ
+	}
+	return rk
+}
+
+// EventStreamArgs are the declare arguments of the event stream.
+func (t Topology) EventStreamArgs() amqp.Table {
+	return amqp.Table{
+		"x-queue-type": "stream",
+		"x-max-age":    t.EventMaxAge,
+	}
+}
+
 func (t Topology) RetryQueueName(rk string) string {
 	return t.Namespace + ".retry." + rk
 }
+
+// QueuesByKind lists the declared task queues: main queues, the retry queues
+// of the retry mode (none with the delayed exchange) and every DLQ.
+func (t Topology) QueuesByKind() (main, retry, dead []string) {
+	for _, rk := range t.RoutingKeys {
+		main = append(main, t.FullQueueName(rk))
+		switch t.RetryMode {
+		case RetryTiers:
+			for _, tier := range t.RetryTiers {
+				retry = append(retry, t.TierQueueName(rk, tier))
+			}
+		case RetryDelayed:
+		default:
+			retry = append(retry, t.RetryQueueName(rk))
+		}
+	}
+	dead = append(dead, t.DLQName)
+	for _, rk := range t.RoutingKeys {
+		if dlq := t.DeadLetterQueue(rk); dlq != t.DLQName {
+			dead = append(dead, dlq)
+		}
+	}
+	for _, typ := range t.DLQTypes {
+		dead = append(dead, t.TypeDLQName(typ))
+	}
+	return main, retry, dead
+}
+
+func contains(xs []string, want string) bool {
+	for _, x := range xs {
+		if x == want {
+			return true
+		}
+	}
+	return false
+}
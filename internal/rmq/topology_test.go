@@ -0,0 +1,100 @@
+package rmq_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+)
+
+func TestLoadEnv(t *testing.T) {
+	topo, err := load(t, map[string]string{
+		"QUEUE_TYPES":          "default:quorum, high:lazy",
+		"QUEUE_DELIVERY_LIMIT": "5",
+		"DLQ_PER_QUEUE":        "true",
+		"DLQ_TYPES":            "email.send.v1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := topo.Spec("default"); s.Type != "quorum" || s.DeliveryLimit != 5 || !s.DLQ {
+		t.Fatalf("default: %+v", s)
+	}
+	// the delivery limit is a quorum argument only
+	if s := topo.Spec("high"); s.Type != "lazy" || s.DeliveryLimit != 0 || !s.DLQ {
+		t.Fatalf("high: %+v", s)
+	}
+	if len(topo.DLQTypes) != 1 || topo.DLQTypes[0] != "email.send.v1" {
+		t.Fatalf("dlq types: %v", topo.DLQTypes)
+	}
+}
+
+func TestLoadEnvErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"no namespace", map[string]string{"RMQ_NAMESPACE": ""}, "RMQ_NAMESPACE"},
+		{"no queues", map[string]string{"QUEUES": " , "}, "at least one queue"},
+		{"bad priority", map[string]string{"RMQ_MAX_PRIORITY": "300"}, "RMQ_MAX_PRIORITY"},
+		{"bad queue type entry", map[string]string{"QUEUE_TYPES": "default"}, "want <queue>:<type>"},
+		{"unknown queue type", map[string]string{"QUEUE_TYPES": "default:stream"}, `unknown type "stream"`},
+		{"type for unknown queue", map[string]string{"QUEUE_TYPES": "bulk:lazy"}, "not a routing key"},
+		{"bad delivery limit", map[string]string{"QUEUE_TYPES": "default:quorum", "QUEUE_DELIVERY_LIMIT": "-1"}, "QUEUE_DELIVERY_LIMIT"},
+		{"quorum with priority", map[string]string{"QUEUE_TYPES": "default:quorum", "RMQ_MAX_PRIORITY": "10"}, "do not support x-max-priority"},
+		{"dlq type is a queue", map[string]string{"DLQ_TYPES": "high"}, "equal to a queue name"},
+	} {
+		_, err := load(t, tc.env)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestDeadLetterRouting(t *testing.T) {
+	topo := rmq.New("tasks", "default", "high")
+	topo.Queues["default"] = rmq.QueueSpec{DLQ: true}
+	topo.DLQTypes = []string{"report.v1"}
+	d := topo.Declarations()
+
+	// where the DLX delivers key: what the declared bindings say
+	routed := func(key string) []string {
+		var qs []string
+		for _, b := range d.Bindings {
+			if b.Exchange == topo.DLXExchange && b.Key == key {
+				qs = append(qs, b.Queue)
+			}
+		}
+		return qs
+	}
+
+	for _, tc := range []struct {
+		rk, typ  string
+		key, dlq string
+	}{
+		{"default", "email.send.v1", "default", "tasks.dlq.default"}, // per-queue
+		{"high", "email.send.v1", "high", "tasks.dlq"},               // shared
+		{"default", "report.v1", "report.v1", "tasks.dlq.report.v1"}, // per-type wins over per-queue
+		{"high", "report.v1", "report.v1", "tasks.dlq.report.v1"},    // and over shared
+	} {
+		key, dlq := topo.DeadLetterKey(tc.rk, tc.typ), topo.DeadLetterQueueFor(tc.rk, tc.typ)
+		if key != tc.key || dlq != tc.dlq {
+			t.Errorf("%s/%s: key %s -> %s, want %s -> %s", tc.rk, tc.typ, key, dlq, tc.key, tc.dlq)
+		}
+		if qs := routed(key); len(qs) != 1 || qs[0] != dlq {
+			t.Errorf("%s/%s: dlx routes %s to %v, want [%s]", tc.rk, tc.typ, key, qs, dlq)
+		}
+	}
+
+	var dlqs []string
+	for _, q := range d.Queues {
+		if strings.HasPrefix(q.Name, topo.DLQName) {
+			dlqs = append(dlqs, q.Name)
+		}
+	}
+	if want := []string{"tasks.dlq", "tasks.dlq.default", "tasks.dlq.report.v1"}; !slices.Equal(dlqs, want) {
+		t.Fatalf("dlqs %v, want %v", dlqs, want)
+	}
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// NotifyChannel carries the task id of every new task_events row
+// (migration 0010).
+const NotifyChannel = "task_events"
+
+// Watcher wakes callers when a task may have changed. a wake carries no
+// data: the caller re-reads the task or its events, so wakes coalesce.
+type Watcher interface {
+	Watch(id string) (wake <-chan struct{}, stop func())
+}
+
+// Listener is the Postgres Watcher: one connection LISTENing on
+// NotifyChannel, fanned out by task id. Run it for the life of the process.
+type Listener struct {
+	DB *pgxpool.Pool
+
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+var _ Watcher = (*Listener)(nil)
+
+func NewListener(db *pgxpool.Pool) *Listener {
+	return &Listener{DB: db, subs: map[string]map[chan struct{}]struct{}{}}
+}
+
+func (l *Listener) Watch(id string) (<-chan struct{}, func()) {
+	c := make(chan struct{}, 1)
+	l.mu.Lock()
+	if l.subs[id] == nil {
+		l.subs[id] = map[chan struct{}]struct{}{}
+	}
+	l.subs[id][c] = struct{}{}
+	l.mu.Unlock()
+
+	return c, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.subs[id], c)
+		if len(l.subs[id]) == 0 {
+			delete(l.subs, id)
+		}
+	}
+}
+
+// Run listens until ctx is done, reconnecting after errors. every watcher is
+// woken on (re)connect, since notifications sent meanwhile are lost.
+func (l *Listener) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := l.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("task events listener", "err", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (l *Listener) listen(ctx context.Context) error {
+	pc, err := l.DB.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// a LISTENing conn must not go back to the pool
+	conn := pc.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+NotifyChannel); err != nil {
+		return err
+	}
+	l.wakeAll()
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		l.wake(n.Payload)
+	}
+}
+
+func (l *Listener) wake(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for c := range l.subs[id] {
+		notify(c)
+	}
+}
+
+func (l *Listener) wakeAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, cs := range l.subs {
+		for c := range cs {
+			notify(c)
+		}
+	}
+}
+
+// notify sends without blocking; a pending wake already covers this one.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
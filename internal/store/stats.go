@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TaskStats is a snapshot of the tasks table for the backlog gauges.
+type TaskStats struct {
+	ByStatus       map[string]int       // status -> tasks; terminal ones estimated (GetTaskStats)
+	OldestEnqueued map[string]time.Time // queue -> created_at of its oldest ENQUEUED task
+}
+
+// GetTaskStats counts the live statuses (ENQUEUED, RUNNING) exactly over
+// tasks_active_idx and finds the oldest ENQUEUED task of each queue
+// (tasks_enqueued_idx). terminal statuses grow without bound, so they are
+// estimated from planner statistics (row estimate times the status's
+// frequency, as of the last ANALYZE) instead of scanning the table.
+func GetTaskStats(ctx context.Context, db *pgxpool.Pool) (TaskStats, error) {
+	st := TaskStats{ByStatus: map[string]int{}, OldestEnqueued: map[string]time.Time{}}
+
+	rows, err := db.Query(ctx, `
+		SELECT status, count(*)
+		  FROM tasks
+		 WHERE status IN ('ENQUEUED', 'RUNNING')
+		 GROUP BY status
+		UNION ALL
+		SELECT s.status, (greatest(c.reltuples, 0) * s.freq)::bigint
+		  FROM pg_class c,
+		       pg_stats p,
+		       unnest(p.most_common_vals::text::text[], p.most_common_freqs) AS s(status, freq)
+		 WHERE c.oid = 'tasks'::regclass
+		   AND p.schemaname = current_schema() AND p.tablename = 'tasks' AND p.attname = 'status'
+		   AND s.status NOT IN ('ENQUEUED', 'RUNNING')
+	`)
+	if err != nil {
+		return st, err
+	}
+	for rows.Next() {
+		var (
+			status string
+			n      int
+		)
+		if err := rows.Scan(&status, &n); err != nil {
+			rows.Close()
+			return st, err
+		}
+		st.ByStatus[status] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return st, err
+	}
+
+	rows, err = db.Query(ctx, `
+		SELECT queue, min(created_at)
+		  FROM tasks
+		 WHERE status = 'ENQUEUED'
+		 GROUP BY queue
+	`)
+	if err != nil {
+		return st, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			queue  string
+			oldest time.Time
+		)
+		if err := rows.Scan(&queue, &oldest); err != nil {
+			return st, err
+		}
+		st.OldestEnqueued[queue] = oldest
+	}
+	return st, rows.Err()
+}
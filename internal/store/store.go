@@ -0,0 +1,154 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Store is what the API and the worker runtime need from persistence.
+// Postgres is the real implementation; internal/testkit has an in-memory one.
+// lookups of missing rows return pgx.ErrNoRows in both.
+type Store interface {
+	UpsertEnqueue(ctx context.Context, t NewTask) (outID, outStatus, outQueue string, outPriority int, err error)
+	GetTask(ctx context.Context, id string) (TaskRow, error)
+	ListTaskEvents(ctx context.Context, id string, after int64) ([]TaskEvent, error)
+	GetTypeLimits(ctx context.Context, typ string) (TypeLimits, error)
+	TakeRateToken(ctx context.Context, typ string, ratePerSec float64, burst int) (time.Duration, error)
+	RefundRateToken(ctx context.Context, typ string, ratePerSec float64) error
+	TaskStats(ctx context.Context) (TaskStats, error)
+	ListWebhooks(ctx context.Context, taskID string) ([]WebhookDelivery, error)
+	ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error)
+	FinishWebhook(ctx context.Context, d WebhookDelivery, retryIn time.Duration) error
+	Ping(ctx context.Context) error
+	Begin(ctx context.Context) (Tx, error)
+
+	// task type registry
+	ListTypes(ctx context.Context) ([]TaskType, error)
+	GetType(ctx context.Context, typ string) (TaskType, error)
+	CreateType(ctx context.Context, t TaskType, actor string) error
+	UpdateType(ctx context.Context, typ, actor string, fn func(*TaskType) error) (TaskType, error)
+	ListTypeAudit(ctx context.Context, typ string) ([]TypeAudit, error)
+}
+
+// Tx is the per-message unit of work of the worker: the task row lock and
+// concurrency slot are held until Commit or Rollback.
+type Tx interface {
+	LockTaskForWork(ctx context.Context, id string) (WorkerTask, error)
+	TryAcquireSlot(ctx context.Context, typ string, max int) (bool, error)
+	MarkRunning(ctx context.Context, id string) error
+	MarkSucceeded(ctx context.Context, id string, result []byte, resultRef string) error
+	MarkFailed(ctx context.Context, id string, lastErr string) error
+	MarkRetry(ctx context.Context, id string, lastErr string) error
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+// querier is a pool or a transaction.
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Postgres adapts the package functions to Store.
+type Postgres struct {
+	DB *pgxpool.Pool
+}
+
+func NewPostgres(db *pgxpool.Pool) *Postgres { return &Postgres{DB: db} }
+
+func (p *Postgres) UpsertEnqueue(ctx context.Context, t NewTask) (string, string, string, int, error) {
+	return UpsertEnqueue(ctx, p.DB, t)
+}
+
+func (p *Postgres) GetTask(ctx context.Context, id string) (TaskRow, error) {
+	return GetTask(ctx, p.DB, id)
+}
+
+func (p *Postgres) ListTaskEvents(ctx context.Context, id string, after int64) ([]TaskEvent, error) {
+	return ListTaskEvents(ctx, p.DB, id, after)
+}
+
+func (p *Postgres) GetTypeLimits(ctx context.Context, typ string) (TypeLimits, error) {
+	return GetTypeLimits(ctx, p.DB, typ)
+}
+
+func (p *Postgres) TakeRateToken(ctx context.Context, typ string, ratePerSec float64, burst int) (time.Duration, error) {
+	return TakeRateToken(ctx, p.DB, typ, ratePerSec, burst)
+}
+
+func (p *Postgres) RefundRateToken(ctx context.Context, typ string, ratePerSec float64) error {
+	return RefundRateToken(ctx, p.DB, typ, ratePerSec)
+}
+
+func (p *Postgres) TaskStats(ctx context.Context) (TaskStats, error) { return GetTaskStats(ctx, p.DB) }
+
+func (p *Postgres) ListWebhooks(ctx context.Context, taskID string) ([]WebhookDelivery, error) {
+	return ListWebhooks(ctx, p.DB, taskID)
+}
+
+func (p *Postgres) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	return ClaimWebhooks(ctx, p.DB, limit, lease)
+}
+
+func (p *Postgres) FinishWebhook(ctx context.Context, d WebhookDelivery, retryIn time.Duration) error {
+	return FinishWebhook(ctx, p.DB, d, retryIn)
+}
+
+func (p *Postgres) Ping(ctx context.Context) error { return p.DB.Ping(ctx) }
+
+func (p *Postgres) ListTypes(ctx context.Context) ([]TaskType, error) { return ListTypes(ctx, p.DB) }
+
+func (p *Postgres) GetType(ctx context.Context, typ string) (TaskType, error) {
+	return GetType(ctx, p.DB, typ)
+}
+
+func (p *Postgres) CreateType(ctx context.Context, t TaskType, actor string) error {
+	return CreateType(ctx, p.DB, t, actor)
+}
+
+func (p *Postgres) UpdateType(ctx context.Context, typ, actor string, fn func(*TaskType) error) (TaskType, error) {
+	return UpdateType(ctx, p.DB, typ, actor, fn)
+}
+
+func (p *Postgres) ListTypeAudit(ctx context.Context, typ string) ([]TypeAudit, error) {
+	return ListTypeAudit(ctx, p.DB, typ)
+}
+
+func (p *Postgres) Begin(ctx context.Context) (Tx, error) {
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pgTx{tx}, nil
+}
+
+type pgTx struct {
+	tx pgx.Tx
+}
+
+func (t pgTx) LockTaskForWork(ctx context.Context, id string) (WorkerTask, error) {
+	return LockTaskForWork(ctx, t.tx, id)
+}
+
+func (t pgTx) TryAcquireSlot(ctx context.Context, typ string, max int) (bool, error) {
+	return TryAcquireSlot(ctx, t.tx, typ, max)
+}
+
+func (t pgTx) MarkRunning(ctx context.Context, id string) error { return MarkRunning(ctx, t.tx, id) }
+
+func (t pgTx) MarkSucceeded(ctx context.Context, id string, result []byte, resultRef string) error {
+	return MarkSucceeded(ctx, t.tx, id, result, resultRef)
+}
+
+func (t pgTx) MarkFailed(ctx context.Context, id string, lastErr string) error {
+	return MarkFailed(ctx, t.tx, id, lastErr)
+}
+
+func (t pgTx) MarkRetry(ctx context.Context, id string, lastErr string) error {
+	return MarkRetry(ctx, t.tx, id, lastErr)
+}
+
+func (t pgTx) Commit(ctx context.Context) error   { return t.tx.Commit(ctx) }
+func (t pgTx) Rollback(ctx context.Context) error { return t.tx.Rollback(ctx) }
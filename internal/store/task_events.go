@@ -0,0 +1,50 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TaskEvent is a task_events row: ENQUEUED, RUNNING, SUCCEEDED, FAILED,
+// RETRY or DLQ, with the task's last_error as note.
+type TaskEvent struct {
+	ID     int64     `json:"id"`
+	TaskID string    `json:"task_id"`
+	Event  string    `json:"event"`
+	Note   *string   `json:"note,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Terminal reports whether a task in status is done for good.
+func Terminal(status string) bool {
+	switch status {
+	case "SUCCEEDED", "FAILED", "DLQ":
+		return true
+	}
+	return false
+}
+
+// ListTaskEvents returns id's events with an id greater than after, oldest first.
+func ListTaskEvents(ctx context.Context, db *pgxpool.Pool, id string, after int64) ([]TaskEvent, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, task_id, event, note, at
+		  FROM task_events
+		 WHERE task_id = $1 AND id > $2
+		 ORDER BY id
+	`, id, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []TaskEvent{}
+	for rows.Next() {
+		var e TaskEvent
+		if err := rows.Scan(&e.ID, &e.TaskID, &e.Event, &e.Note, &e.At); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TaskType is a task_type row. nil limits are unlimited.
+type TaskType struct {
+	Type               string          `json:"type"`
+	Family             string          `json:"family"`  // email.send for email.send.v2
+	Version            int             `json:"version"` // 2 for email.send.v2
+	Active             bool            `json:"active"`
+	DefaultQueue       string          `json:"default_queue"`
+	DefaultMaxAttempts int             `json:"default_max_attempts"`
+	PayloadSchema      json.RawMessage `json:"payload_schema,omitempty"`
+	MaxConcurrency     *int            `json:"max_concurrency,omitempty"`
+	RateLimitPerSec    *float64        `json:"rate_limit_per_sec,omitempty"`
+	RateLimitBurst     *int            `json:"rate_limit_burst,omitempty"`
+	CallbackURL        *string         `json:"callback_url,omitempty"` // default for tasks enqueued without one
+	Encrypt            bool            `json:"encrypt"`                // seal payloads/results of new tasks
+
+	// a deprecated type still accepts tasks, but enqueue warns the caller
+	// (and names ReplacedBy, when set)
+	DeprecatedAt *time.Time `json:"deprecated_at,omitempty"`
+	ReplacedBy   *string    `json:"replaced_by,omitempty"`
+}
+
+var versioned = regexp.MustCompile(`^(.+)\.v([1-9][0-9]{0,5})$`)
+
+// ParseTypeName splits a versioned type name: email.send.v2 is version 2 of
+// email.send. names without a .vN suffix are version 1 of themselves.
+func ParseTypeName(typ string) (family string, version int) {
+	m := versioned.FindStringSubmatch(typ)
+	if m == nil {
+		return typ, 1
+	}
+	v, _ := strconv.Atoi(m[2])
+	return m[1], v
+}
+
+// TypeAudit is one task_type_audit row.
+type TypeAudit struct {
+	ID     int64           `json:"id"`
+	Type   string          `json:"type"`
+	Action string          `json:"action"` // CREATE | UPDATE | DEACTIVATE | DEPRECATE
+	Actor  *string         `json:"actor"`
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+	At     time.Time       `json:"at"`
+}
+
+// audit actions
+const (
+	AuditCreate     = "CREATE"
+	AuditUpdate     = "UPDATE"
+	AuditDeactivate = "DEACTIVATE"
+	AuditDeprecate  = "DEPRECATE"
+)
+
+var ErrTypeExists = errors.New("task type already exists")
+
+const typeColumns = `type, family, version, active, default_queue, default_max_attempts, payload_schema,
+	       max_concurrency, rate_limit_per_sec, rate_limit_burst, callback_url, encrypt, deprecated_at, replaced_by`
+
+func scanType(row pgx.Row) (TaskType, error) {
+	var t TaskType
+	err := row.Scan(&t.Type, &t.Family, &t.Version, &t.Active, &t.DefaultQueue, &t.DefaultMaxAttempts, &t.PayloadSchema,
+		&t.MaxConcurrency, &t.RateLimitPerSec, &t.RateLimitBurst, &t.CallbackURL, &t.Encrypt, &t.DeprecatedAt, &t.ReplacedBy)
+	return t, err
+}
+
+func ListTypes(ctx context.Context, db *pgxpool.Pool) ([]TaskType, error) {
+	rows, err := db.Query(ctx, `SELECT `+typeColumns+` FROM task_type ORDER BY family, version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []TaskType{}
+	for rows.Next() {
+		t, err := scanType(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func GetType(ctx context.Context, db *pgxpool.Pool, typ string) (TaskType, error) {
+	return scanType(db.QueryRow(ctx, `SELECT `+typeColumns+` FROM task_type WHERE type = $1`, typ))
+}
+
+// CreateType inserts t and its CREATE audit row. ErrTypeExists when the name
+// or its family/version is taken.
+func CreateType(ctx context.Context, db *pgxpool.Pool, t TaskType, actor string) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO task_type (type, family, version, active, default_queue, default_max_attempts, payload_schema,
+			                       max_concurrency, rate_limit_per_sec, rate_limit_burst, callback_url, encrypt, deprecated_at, replaced_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		`, t.Type, t.Family, t.Version, t.Active, t.DefaultQueue, t.DefaultMaxAttempts, nullJSON(t.PayloadSchema),
+			t.MaxConcurrency, t.RateLimitPerSec, t.RateLimitBurst, t.CallbackURL, t.Encrypt, t.DeprecatedAt, t.ReplacedBy)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
+			return ErrTypeExists
+		}
+		if err != nil {
+			return err
+		}
+		return insertAudit(ctx, tx, t.Type, AuditCreate, actor, nil, &t)
+	})
+}
+
+// UpdateType locks typ, lets fn change it and writes it back with an audit
+// row: DEACTIVATE when fn turned it inactive, DEPRECATE when fn deprecated
+// it, else UPDATE. an error from fn aborts without writing. pgx.ErrNoRows
+// when typ doesn't exist.
+func UpdateType(ctx context.Context, db *pgxpool.Pool, typ, actor string, fn func(*TaskType) error) (TaskType, error) {
+	var after TaskType
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		before, err := scanType(tx.QueryRow(ctx, `SELECT `+typeColumns+` FROM task_type WHERE type = $1 FOR UPDATE`, typ))
+		if err != nil {
+			return err
+		}
+		after = before
+		if err := fn(&after); err != nil {
+			return err
+		}
+		after.Type, after.Family, after.Version = before.Type, before.Family, before.Version // derived from the key
+
+		if _, err := tx.Exec(ctx, `
+			UPDATE task_type
+			   SET active = $2, default_queue = $3, default_max_attempts = $4, payload_schema = $5,
+			       max_concurrency = $6, rate_limit_per_sec = $7, rate_limit_burst = $8,
+			       callback_url = $9, encrypt = $10, deprecated_at = $11, replaced_by = $12
+			 WHERE type = $1
+		`, typ, after.Active, after.DefaultQueue, after.DefaultMaxAttempts, nullJSON(after.PayloadSchema),
+			after.MaxConcurrency, after.RateLimitPerSec, after.RateLimitBurst,
+			after.CallbackURL, after.Encrypt, after.DeprecatedAt, after.ReplacedBy); err != nil {
+			return err
+		}
+		return insertAudit(ctx, tx, typ, AuditAction(before, after), actor, &before, &after)
+	})
+	return after, err
+}
+
+// AuditAction names the change from before to after for the audit log.
+func AuditAction(before, after TaskType) string {
+	switch {
+	case before.Active && !after.Active:
+		return AuditDeactivate
+	case before.DeprecatedAt == nil && after.DeprecatedAt != nil:
+		return AuditDeprecate
+	}
+	return AuditUpdate
+}
+
+// ListTypeAudit returns typ's change log, oldest first.
+func ListTypeAudit(ctx context.Context, db *pgxpool.Pool, typ string) ([]TypeAudit, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, type, action, actor, before, after, at
+		  FROM task_type_audit
+		 WHERE type = $1
+		 ORDER BY id
+	`, typ)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []TypeAudit{}
+	for rows.Next() {
+		var a TypeAudit
+		if err := rows.Scan(&a.ID, &a.Type, &a.Action, &a.Actor, &a.Before, &a.After, &a.At); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+func insertAudit(ctx context.Context, tx pgx.Tx, typ, action, actor string, before, after *TaskType) error {
+	var beforeJSON []byte
+	if before != nil {
+		beforeJSON, _ = json.Marshal(before)
+	}
+	afterJSON, _ := json.Marshal(after)
+	_, err := tx.Exec(ctx, `
+		INSERT INTO task_type_audit (type, action, actor, before, after)
+		VALUES ($1, $2, nullif($3, ''), $4, $5)
+	`, typ, action, actor, beforeJSON, afterJSON)
+	return err
+}
+
+// nullJSON maps an empty or JSON null document to SQL NULL.
+func nullJSON(raw json.RawMessage) any {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	return []byte(raw)
+}
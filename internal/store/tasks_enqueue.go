@@ -2,36 +2,56 @@ package store
 
 import (
 	"context"
-	"errors"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// registry defaults for a type. the type must be active
-func GetTypeDefaults(ctx context.Context, db *pgxpool.Pool, typ string) (active bool, queue string, maxAttempts int, err error) {
-	err = db.QueryRow(ctx, `
-		select active, default_queue, default_max_attempts
-		  from task_type
-		 where type = $1
-	`, typ).Scan(&active, &queue, &maxAttempts)
-	if errors.Is(err, pgx.ErrNoRows) {
-		return false, "", 0, err
+// NewTask is an ENQUEUED task to insert. "" strings are NULL.
+type NewTask struct {
+	ID             string
+	Type           string
+	Queue          string
+	Payload        []byte // JSON; null when offloaded to PayloadRef
+	PayloadRef     string // blob key of the payload
+	IdempotencyKey string
+	MaxAttempts    int
+	Priority       int
+	CallbackURL    string
+	Encrypted      bool // Payload (or the blob) is an envelope
+
+	// Publish, when set, runs in the insert's transaction with the canonical
+	// id/queue/priority (the Postgres broker's PublishTx), so the message and
+	// the row commit together.
+	Publish func(ctx context.Context, tx pgx.Tx, id, queue string, priority int) error
+}
+
+// insert ENQUEUED task; idempotent on idempotency_key.
+// returns canonical id/status/queue/priority.
+func UpsertEnqueue(ctx context.Context, db *pgxpool.Pool, t NewTask) (outID, outStatus, outQueue string, outPriority int, err error) {
+	if t.Publish == nil {
+		return upsertTask(ctx, db, t)
 	}
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if outID, outStatus, outQueue, outPriority, err = upsertTask(ctx, tx, t); err != nil {
+			return err
+		}
+		return t.Publish(ctx, tx, outID, outQueue, outPriority)
+	})
 	return
 }
 
-// insert ENQUEUED task; idempotent on idempotency_key.
-// returns canonical id/status/queue.
-func UpsertEnqueue(ctx context.Context, db *pgxpool.Pool,
-	id, typ, queue string, payload []byte, idemKey string, maxAttempts int,
-) (outID, outStatus, outQueue string, err error) {
+func upsertTask(ctx context.Context, db querier, t NewTask) (outID, outStatus, outQueue string, outPriority int, err error) {
+	payload := t.Payload
+	if payload == nil {
+		payload = []byte("null")
+	}
 	err = db.QueryRow(ctx, `
-		insert into tasks (id, type, queue, status, payload, idempotency_key, max_attempts)
-		values ($1, $2, $3, 'ENQUEUED', $4, nullif($5,''), $6)
+		insert into tasks (id, type, queue, status, payload, payload_ref, idempotency_key, max_attempts, priority, callback_url, encrypted)
+		values ($1, $2, $3, 'ENQUEUED', $4, nullif($5,''), nullif($6,''), $7, $8, nullif($9,''), $10)
 		on conflict (idempotency_key) do update
 		  set updated_at = now()
-		returning id, status, queue
-	`, id, typ, queue, payload, idemKey, maxAttempts).Scan(&outID, &outStatus, &outQueue)
+		returning id, status, queue, priority
+	`, t.ID, t.Type, t.Queue, payload, t.PayloadRef, t.IdempotencyKey, t.MaxAttempts, t.Priority, t.CallbackURL, t.Encrypted).Scan(&outID, &outStatus, &outQueue, &outPriority)
 	return
 }
@@ -14,8 +14,12 @@ type TaskRow struct {
 	Status      string
 	Attempts    int
 	MaxAttempts int
+	Priority    int
 	LastError   *string
 	ResultJSON  []byte
+	ResultRef   *string // blob key when the result was offloaded
+	CallbackURL *string
+	Encrypted   bool // result (once set) is an envelope
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
 }
@@ -24,12 +28,12 @@ func GetTask(ctx context.Context, db *pgxpool.Pool, id string) (TaskRow, error)
 	var t TaskRow
 	err := db.QueryRow(ctx, `
 		select id, type, queue, status, attempts, max_attempts,
-		       last_error,
-		       coalesce(result, '{}'::jsonb) as result,
+		       priority, last_error,
+		       coalesce(result, '{}'::jsonb) as result, result_ref, callback_url, encrypted,
 		       created_at, updated_at
 		  from tasks
 		 where id = $1
 	`, id).Scan(&t.ID, &t.Type, &t.Queue, &t.Status, &t.Attempts, &t.MaxAttempts,
-		&t.LastError, &t.ResultJSON, &t.CreatedAt, &t.UpdatedAt)
+		&t.Priority, &t.LastError, &t.ResultJSON, &t.ResultRef, &t.CallbackURL, &t.Encrypted, &t.CreatedAt, &t.UpdatedAt)
 	return t, err
 }
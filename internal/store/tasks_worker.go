@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 )
@@ -13,17 +14,21 @@ type WorkerTask struct {
 	Status      string
 	Attempts    int
 	MaxAttempts int
+	Priority    int
 	Payload     []byte
+	PayloadRef  *string // blob key when the payload was offloaded
+	Encrypted   bool    // payload is an envelope; the result must be sealed too
+	CreatedAt   time.Time
 }
 
 func LockTaskForWork(ctx context.Context, tx pgx.Tx, id string) (WorkerTask, error) {
 	var t WorkerTask
 	err := tx.QueryRow(ctx, `
-		SELECT id, type, queue, status, attempts, max_attempts, payload
+		SELECT id, type, queue, status, attempts, max_attempts, priority, payload, payload_ref, encrypted, created_at
 		  FROM tasks
 		 WHERE id = $1
 		 FOR UPDATE
-	`, id).Scan(&t.ID, &t.Type, &t.Queue, &t.Status, &t.Attempts, &t.MaxAttempts, &t.Payload)
+	`, id).Scan(&t.ID, &t.Type, &t.Queue, &t.Status, &t.Attempts, &t.MaxAttempts, &t.Priority, &t.Payload, &t.PayloadRef, &t.Encrypted, &t.CreatedAt)
 	return t, err
 }
 
@@ -39,14 +44,17 @@ func MarkRunning(ctx context.Context, tx pgx.Tx, id string) error {
 	return err
 }
 
-func MarkSucceeded(ctx context.Context, tx pgx.Tx, id string, result []byte) error {
+// MarkSucceeded stores result, or with resultRef != "" the key of the
+// offloaded result (and a NULL result).
+func MarkSucceeded(ctx context.Context, tx pgx.Tx, id string, result []byte, resultRef string) error {
 	_, err := tx.Exec(ctx, `
 		UPDATE tasks
 		   SET status     = 'SUCCEEDED',
 		       result     = $2,
+		       result_ref = nullif($3, ''),
 		       updated_at = now()
 		 WHERE id = $1
-	`, id, result)
+	`, id, result, resultRef)
 	return err
 }
 
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// runtime limits configured on task_type. zero means unlimited.
+type TypeLimits struct {
+	MaxConcurrency int
+	RatePerSec     float64
+	RateBurst      int
+}
+
+func GetTypeLimits(ctx context.Context, db querier, typ string) (TypeLimits, error) {
+	var l TypeLimits
+	err := db.QueryRow(ctx, `
+		SELECT coalesce(max_concurrency, 0),
+		       coalesce(rate_limit_per_sec, 0),
+		       coalesce(rate_limit_burst, 1)
+		  FROM task_type
+		 WHERE type = $1
+	`, typ).Scan(&l.MaxConcurrency, &l.RatePerSec, &l.RateBurst)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// unregistered types are not limited
+		return TypeLimits{}, nil
+	}
+	return l, err
+}
+
+// TryAcquireSlot takes one of max transaction-scoped advisory locks for typ.
+// the slot is released when tx commits or rolls back, so it is held for
+// exactly as long as the task row lock. returns false when all slots are busy.
+// one round trip: the scan stops at the first slot whose try-lock succeeds,
+// so at most one lock is taken.
+func TryAcquireSlot(ctx context.Context, tx pgx.Tx, typ string, max int) (bool, error) {
+	var slot int
+	err := tx.QueryRow(ctx, `
+		SELECT s FROM generate_series(0, $2 - 1) s
+		 WHERE pg_try_advisory_xact_lock(hashtext('dq.concurrency:' || $1), s)
+		 LIMIT 1
+	`, typ, max).Scan(&slot)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// TakeRateToken consults the shared GCRA limiter for typ (see dq_rate_take).
+// it runs on its own connection, outside any task tx, so the limiter row is
+// only locked for the duration of the call; the worker takes it before it
+// begins the task tx, so a delivery never holds one connection while waiting
+// for another. returns 0 when the task may run, otherwise how long to wait
+// before trying again.
+func TakeRateToken(ctx context.Context, db *pgxpool.Pool, typ string, ratePerSec float64, burst int) (time.Duration, error) {
+	var wait float64
+	err := db.QueryRow(ctx, `SELECT dq_rate_take($1, $2, $3)`, typ, ratePerSec, burst).Scan(&wait)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait * float64(time.Second)), nil
+}
+
+// RefundRateToken gives back a token taken by a task that didn't run after
+// all (see dq_rate_refund).
+func RefundRateToken(ctx context.Context, db *pgxpool.Pool, typ string, ratePerSec float64) error {
+	_, err := db.Exec(ctx, `SELECT dq_rate_refund($1, $2)`, typ, ratePerSec)
+	return err
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// WebhookDelivery is one webhook_deliveries row: one attempt at POSTing a
+// finished task to its callback_url.
+type WebhookDelivery struct {
+	ID         int64      `json:"id"`
+	TaskID     string     `json:"task_id"`
+	URL        string     `json:"url"`
+	Event      string     `json:"event"` // the task's terminal status
+	Attempt    int        `json:"attempt"`
+	State      string     `json:"state"`
+	RunAfter   time.Time  `json:"run_after"`
+	StatusCode *int       `json:"status_code,omitempty"`
+	Error      *string    `json:"error,omitempty"`
+	DurationMS *int       `json:"duration_ms,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DoneAt     *time.Time `json:"done_at,omitempty"`
+}
+
+// delivery states. RETRY is a failed attempt followed by another one,
+// FAILED the last one.
+const (
+	WebhookPending   = "PENDING"
+	WebhookDelivered = "DELIVERED"
+	WebhookRetry     = "RETRY"
+	WebhookFailed    = "FAILED"
+)
+
+const webhookColumns = `id, task_id, url, event, attempt, state, run_after,
+	       status_code, error, duration_ms, created_at, done_at`
+
+func scanWebhooks(rows pgx.Rows) ([]WebhookDelivery, error) {
+	defer rows.Close()
+	out := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.TaskID, &d.URL, &d.Event, &d.Attempt, &d.State, &d.RunAfter,
+			&d.StatusCode, &d.Error, &d.DurationMS, &d.CreatedAt, &d.DoneAt); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// ListWebhooks returns the delivery attempts for taskID, oldest first.
+func ListWebhooks(ctx context.Context, db *pgxpool.Pool, taskID string) ([]WebhookDelivery, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+webhookColumns+`
+		  FROM webhook_deliveries
+		 WHERE task_id = $1
+		 ORDER BY id
+	`, taskID)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhooks(rows)
+}
+
+// ClaimWebhooks takes up to limit due PENDING deliveries and hides them for
+// lease, so a dispatcher that dies mid-request has them retried.
+func ClaimWebhooks(ctx context.Context, db *pgxpool.Pool, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE webhook_deliveries
+		   SET run_after = now() + $2 * interval '1 millisecond'
+		 WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			 WHERE state = 'PENDING' AND run_after <= now()
+			 ORDER BY run_after, id
+			 LIMIT $1
+			   FOR UPDATE SKIP LOCKED)
+		RETURNING `+webhookColumns+`
+	`, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhooks(rows)
+}
+
+// ErrWebhookDone is FinishWebhook on an attempt another dispatcher already
+// recorded (it claimed the row again after the lease ran out).
+var ErrWebhookDone = errors.New("webhook delivery already finished")
+
+// FinishWebhook records the outcome of attempt d (State, StatusCode, Error,
+// DurationMS). a RETRY also queues attempt d.Attempt+1 to run in retryIn.
+// only the first outcome for an attempt counts: later ones get
+// ErrWebhookDone and queue nothing.
+func FinishWebhook(ctx context.Context, db *pgxpool.Pool, d WebhookDelivery, retryIn time.Duration) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `
+			UPDATE webhook_deliveries
+			   SET state = $2, status_code = $3, error = $4, duration_ms = $5, done_at = now()
+			 WHERE id = $1 AND state = 'PENDING'
+		`, d.ID, d.State, d.StatusCode, d.Error, d.DurationMS)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() != 1 {
+			return ErrWebhookDone
+		}
+		if d.State != WebhookRetry {
+			return nil
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO webhook_deliveries (task_id, url, event, attempt, run_after)
+			VALUES ($1, $2, $3, $4, now() + $5 * interval '1 millisecond')
+		`, d.TaskID, d.URL, d.Event, d.Attempt+1, retryIn.Milliseconds())
+		return err
+	})
+}
@@ -0,0 +1,285 @@
+package testkit
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/henok3878/distributed-task-queue/internal/broker"
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/internal/tracing"
+)
+
+// Broker is an in-memory broker.Broker on a fake clock. Consume only
+// registers the handler; messages are delivered synchronously by Deliver, so
+// a test decides exactly when work happens.
+type Broker struct {
+	clock *Clock
+	topo  rmq.Topology
+
+	mu        sync.Mutex
+	seq       int
+	ready     []*queued // published or retried, possibly not due yet
+	dead      []Dead
+	events    []rmq.Event
+	published []broker.Message
+	consumers []consumer
+	hasCons   chan struct{} // closed by the first Consume
+}
+
+// Dead is a dead-lettered message and the DLQ the topology routes it to.
+type Dead struct {
+	broker.Message
+	DLQ string
+}
+
+type queued struct {
+	m   broker.Message
+	due time.Time
+	seq int
+}
+
+type consumer struct {
+	queues []string
+	handle broker.HandleFunc
+}
+
+var _ broker.Broker = (*Broker)(nil)
+
+func NewBroker(clock *Clock, topo rmq.Topology) *Broker {
+	return &Broker{clock: clock, topo: topo, hasCons: make(chan struct{})}
+}
+
+func (b *Broker) Publish(ctx context.Context, m broker.Message) error {
+	m = traced(ctx, m)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, m)
+	b.push(m, 0)
+	return nil
+}
+
+// Retry holds m for the delay the topology's retry mode would apply.
+func (b *Broker) Retry(ctx context.Context, m broker.Message, delay time.Duration) (time.Duration, error) {
+	m = traced(ctx, m)
+	actual := b.topo.RetryTarget(m.Queue, delay).Delay
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.push(m, actual)
+	return actual, nil
+}
+
+func (b *Broker) DeadLetter(ctx context.Context, m broker.Message) error {
+	m = traced(ctx, m)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dead = append(b.dead, Dead{Message: m, DLQ: b.topo.DeadLetterQueueFor(m.Queue, m.Type)})
+	return nil
+}
+
+func (b *Broker) Event(_ context.Context, ev rmq.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, ev)
+	return nil
+}
+
+func (b *Broker) Check(context.Context) error { return nil }
+
+// Depths counts pending messages like the Postgres broker: due ones in the
+// main queue, not yet due ones in the retry queue.
+func (b *Broker) Depths(context.Context) ([]broker.QueueDepth, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	n := map[string]int{}
+	for _, q := range b.ready {
+		if q.due.After(now) {
+			n[b.topo.RetryQueueName(q.m.Queue)]++
+		} else {
+			n[b.topo.FullQueueName(q.m.Queue)]++
+		}
+	}
+	for _, d := range b.dead {
+		n[d.DLQ]++
+	}
+
+	var out []broker.QueueDepth
+	for _, rk := range b.topo.RoutingKeys {
+		consumers := 0
+		for _, c := range b.consumers {
+			if slices.Contains(c.queues, rk) {
+				consumers++
+			}
+		}
+		out = append(out,
+			broker.QueueDepth{Queue: b.topo.FullQueueName(rk), Kind: broker.KindMain, Messages: n[b.topo.FullQueueName(rk)], Consumers: consumers},
+			broker.QueueDepth{Queue: b.topo.RetryQueueName(rk), Kind: broker.KindRetry, Messages: n[b.topo.RetryQueueName(rk)], Consumers: -1},
+		)
+	}
+	_, _, dead := b.topo.QueuesByKind()
+	for _, q := range dead {
+		out = append(out, broker.QueueDepth{Queue: q, Kind: broker.KindDead, Messages: n[q], Consumers: -1})
+	}
+	return out, nil
+}
+func (b *Broker) Close() error { return nil }
+
+// Consume registers handle for queues and blocks until ctx is done.
+func (b *Broker) Consume(ctx context.Context, queues []string, handle broker.HandleFunc) error {
+	b.mu.Lock()
+	b.consumers = append(b.consumers, consumer{queues: queues, handle: handle})
+	if len(b.consumers) == 1 {
+		close(b.hasCons)
+	}
+	b.mu.Unlock()
+	<-ctx.Done()
+	return nil
+}
+
+// WaitConsumer blocks until some Consume call registered a handler.
+func (b *Broker) WaitConsumer(ctx context.Context) error {
+	select {
+	case <-b.hasCons:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Deliver hands every due message to its consumer, one at a time and in
+// priority order, until none is left. messages settled back as due (requeued,
+// zero-delay retries) are delivered in the same call. returns how many
+// deliveries were made.
+func (b *Broker) Deliver(ctx context.Context) int {
+	n := 0
+	for ctx.Err() == nil {
+		q, h := b.next()
+		if q == nil {
+			break
+		}
+		h(ctx, &memDelivery{b: b, q: q})
+		n++
+	}
+	return n
+}
+
+// next pops the first due message some consumer reads.
+func (b *Broker) next() (*queued, broker.HandleFunc) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	sort.SliceStable(b.ready, func(i, j int) bool {
+		x, y := b.ready[i], b.ready[j]
+		if x.m.Priority != y.m.Priority {
+			return x.m.Priority > y.m.Priority
+		}
+		if !x.due.Equal(y.due) {
+			return x.due.Before(y.due)
+		}
+		return x.seq < y.seq
+	})
+	for i, q := range b.ready {
+		if q.due.After(now) {
+			continue
+		}
+		for _, c := range b.consumers {
+			if contains(c.queues, q.m.Queue) {
+				b.ready = append(b.ready[:i], b.ready[i+1:]...)
+				return q, c.handle
+			}
+		}
+	}
+	return nil, nil
+}
+
+// traced carries ctx's trace context in m's headers, like the real brokers.
+func traced(ctx context.Context, m broker.Message) broker.Message {
+	headers := map[string]any{}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	tracing.Inject(ctx, headers)
+	m.Headers = headers
+	return m
+}
+
+func (b *Broker) push(m broker.Message, delay time.Duration) {
+	b.seq++
+	b.ready = append(b.ready, &queued{m: m, due: b.clock.Now().Add(delay), seq: b.seq})
+}
+
+// Pending is the number of messages not yet delivered, due or not.
+func (b *Broker) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.ready)
+}
+
+// NextDue is when the earliest pending message becomes due; false when none.
+func (b *Broker) NextDue() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var first time.Time
+	for _, q := range b.ready {
+		if first.IsZero() || q.due.Before(first) {
+			first = q.due
+		}
+	}
+	return first, !first.IsZero()
+}
+
+func (b *Broker) Published() []broker.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]broker.Message(nil), b.published...)
+}
+
+func (b *Broker) Dead() []Dead {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Dead(nil), b.dead...)
+}
+
+func (b *Broker) Events() []rmq.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]rmq.Event(nil), b.events...)
+}
+
+type memDelivery struct {
+	b       *Broker
+	q       *queued
+	settled bool
+}
+
+func (d *memDelivery) Message() broker.Message { return d.q.m }
+
+func (d *memDelivery) Ack() error {
+	d.settled = true
+	return nil
+}
+
+// Requeue makes the message due again right away.
+func (d *memDelivery) Requeue() error {
+	if d.settled {
+		return nil
+	}
+	d.settled = true
+	d.b.mu.Lock()
+	defer d.b.mu.Unlock()
+	d.q.due = d.b.clock.Now()
+	d.b.ready = append(d.b.ready, d.q)
+	return nil
+}
+
+func contains(xs []string, want string) bool {
+	for _, x := range xs {
+		if x == want {
+			return true
+		}
+	}
+	return false
+}
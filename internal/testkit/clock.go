@@ -0,0 +1,28 @@
+package testkit
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a manually advanced clock shared by the in-memory broker and
+// store, so delayed retries and rate limits only move when a test says so.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewClock(start time.Time) *Clock { return &Clock{now: start} }
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
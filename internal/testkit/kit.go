@@ -0,0 +1,140 @@
+// Package testkit runs the API handlers and the worker runtime in-process on
+// an in-memory store and broker with a fake clock, so tests of handlers,
+// retries and backoff need neither Postgres nor RabbitMQ.
+//
+//	k := testkit.New(rmq.New("tasks", "default"), worker.Config{Backoff: backoff.Fixed(time.Minute)})
+//	k.Store.AddType("email.send.v1", testkit.Type{Active: true, Queue: "default", MaxAttempts: 3})
+//	k.Worker.Handle("email.send.v1", handler)
+//	k.Start(t)
+//	res, _ := k.Enqueue(api.EnqueueRequest{Type: "email.send.v1", Payload: payload})
+//	k.Deliver()              // first attempt
+//	k.Advance(time.Minute)   // retry comes due and runs
+package testkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/henok3878/distributed-task-queue/internal/api"
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/pkg/worker"
+)
+
+// ReadToken is the API's ENCRYPTION_READ_TOKEN.
+const ReadToken = "testkit-read-token"
+
+// Epoch is where the fake clock starts.
+var Epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type Kit struct {
+	Clock    *Clock
+	Store    *Store
+	Broker   *Broker
+	Topology rmq.Topology
+	Worker   *worker.Worker
+	API      http.Handler // /enqueue, /tasks/{id}, /types, /healthz
+}
+
+// New wires the fakes into the API and a worker. cfg's Store, Broker and
+// Topology are filled in; everything else is passed through to worker.New.
+// the API shares cfg.Blobs and cfg.Keys, and decrypts for ReadToken.
+func New(topo rmq.Topology, cfg worker.Config) *Kit {
+	clock := NewClock(Epoch)
+	k := &Kit{
+		Clock:    clock,
+		Store:    NewStore(clock),
+		Broker:   NewBroker(clock, topo),
+		Topology: topo,
+	}
+	cfg.Store, cfg.Broker, cfg.Topology = k.Store, k.Broker, topo
+	k.Worker = worker.New(cfg)
+
+	mux := http.NewServeMux()
+	deps := api.Deps{Store: k.Store, Broker: k.Broker, Topology: topo, Watcher: k.Store, Blobs: cfg.Blobs, Keys: cfg.Keys, ReadToken: ReadToken,
+		Webhooks: true, // callbacks are accepted; run a webhook.Dispatcher over Store to send them
+	}
+	api.RegisterHealth(mux, deps)
+	api.RegisterEnqueue(mux, deps)
+	api.RegisterTasks(mux, deps)
+	api.RegisterTypes(mux, deps)
+	k.API = api.RequestLog(mux)
+	return k
+}
+
+// Start runs the worker until the test ends. register handlers first.
+func (k *Kit) Start(t testing.TB) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- k.Worker.Run(ctx) }()
+
+	wait, cancelWait := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelWait()
+	if err := k.Broker.WaitConsumer(wait); err != nil {
+		cancel()
+		t.Fatalf("testkit: worker did not start: %v", <-done)
+	}
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("testkit: worker: %v", err)
+		}
+	})
+}
+
+// Deliver runs every message that is due now; see Broker.Deliver.
+func (k *Kit) Deliver() int {
+	return k.Broker.Deliver(context.Background())
+}
+
+// Advance moves the clock by d and runs whatever came due.
+func (k *Kit) Advance(d time.Duration) int {
+	k.Clock.Advance(d)
+	return k.Deliver()
+}
+
+// Drain runs due messages and jumps the clock to the next pending one until
+// nothing is pending or limit has elapsed. returns the total time skipped.
+func (k *Kit) Drain(limit time.Duration) time.Duration {
+	start := k.Clock.Now()
+	k.Deliver()
+	for {
+		due, ok := k.Broker.NextDue()
+		if !ok || due.Sub(start) > limit {
+			return k.Clock.Now().Sub(start)
+		}
+		if d := due.Sub(k.Clock.Now()); d > 0 {
+			k.Clock.Advance(d)
+		}
+		k.Deliver()
+	}
+}
+
+// Do sends a request to the API handlers.
+func (k *Kit) Do(method, path string, body any) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+	rec := httptest.NewRecorder()
+	k.API.ServeHTTP(rec, httptest.NewRequest(method, path, &buf))
+	return rec
+}
+
+// Enqueue posts req to /enqueue. a non-201 answer is returned as an error
+// carrying the status and body.
+func (k *Kit) Enqueue(req api.EnqueueRequest) (api.EnqueueResponse, error) {
+	rec := k.Do(http.MethodPost, "/enqueue", req)
+	if rec.Code != http.StatusCreated {
+		return api.EnqueueResponse{}, fmt.Errorf("enqueue: %d %s", rec.Code, bytes.TrimSpace(rec.Body.Bytes()))
+	}
+	var res api.EnqueueResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &res)
+	return res, err
+}
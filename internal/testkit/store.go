@@ -0,0 +1,548 @@
+package testkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/henok3878/distributed-task-queue/internal/store"
+)
+
+// Type is a task_type row of the in-memory store.
+type Type struct {
+	Active      bool
+	Queue       string // default_queue (routing key)
+	MaxAttempts int    // default_max_attempts
+	Encrypt     bool
+	Limits      store.TypeLimits
+}
+
+// Store is an in-memory store.Store. a Tx holds the task "row lock" until it
+// ends; writes are applied on Commit and dropped on Rollback, like Postgres.
+type Store struct {
+	clock *Clock
+
+	mu      sync.Mutex
+	unlock  *sync.Cond // signalled when a row lock is released
+	types   map[string]store.TaskType
+	audit   []store.TypeAudit
+	tasks   map[string]*store.TaskRow
+	payload map[string][]byte
+	refs    map[string]string // payload_ref
+	idem    map[string]string // idempotency_key -> id
+	locked  map[string]bool
+	slots   map[string]int       // held concurrency slots per type
+	tat     map[string]time.Time // GCRA state per type
+	history map[string][]string  // status transitions per task, oldest first
+	events  []store.TaskEvent
+	hooks   []store.WebhookDelivery
+	watch   map[string][]chan struct{}
+}
+
+var (
+	_ store.Store   = (*Store)(nil)
+	_ store.Watcher = (*Store)(nil)
+)
+
+func NewStore(clock *Clock) *Store {
+	s := &Store{
+		clock:   clock,
+		types:   map[string]store.TaskType{},
+		tasks:   map[string]*store.TaskRow{},
+		payload: map[string][]byte{},
+		refs:    map[string]string{},
+		idem:    map[string]string{},
+		locked:  map[string]bool{},
+		slots:   map[string]int{},
+		tat:     map[string]time.Time{},
+		history: map[string][]string{},
+		watch:   map[string][]chan struct{}{},
+	}
+	s.unlock = sync.NewCond(&s.mu)
+	return s
+}
+
+// AddType registers (or replaces) a task type, bypassing the audit log.
+func (s *Store) AddType(name string, t Type) {
+	tt := store.TaskType{Type: name, Active: t.Active, DefaultQueue: t.Queue, DefaultMaxAttempts: t.MaxAttempts, Encrypt: t.Encrypt}
+	tt.Family, tt.Version = store.ParseTypeName(name)
+	if l := t.Limits; l.MaxConcurrency > 0 {
+		tt.MaxConcurrency = &l.MaxConcurrency
+	}
+	if l := t.Limits; l.RatePerSec > 0 {
+		tt.RateLimitPerSec = &l.RatePerSec
+		if l.RateBurst > 0 {
+			tt.RateLimitBurst = &l.RateBurst
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.types[name] = tt
+}
+
+// Task returns a copy of the task row, false when missing.
+func (s *Store) Task(id string) (store.TaskRow, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return store.TaskRow{}, false
+	}
+	return *t, true
+}
+
+// History lists the statuses id went through, like task_events.
+func (s *Store) History(id string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.history[id]...)
+}
+
+// SetStatus overwrites a task's status, for arranging edge cases (e.g. a
+// redelivered SUCCEEDED task).
+func (s *Store) SetStatus(id, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok {
+		t.Status = status
+	}
+}
+
+func (s *Store) UpsertEnqueue(_ context.Context, nt store.NewTask) (string, string, string, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now, id := s.clock.Now(), nt.ID
+	if nt.IdempotencyKey != "" {
+		if prev, ok := s.idem[nt.IdempotencyKey]; ok {
+			t := s.tasks[prev]
+			t.UpdatedAt = now
+			return t.ID, t.Status, t.Queue, t.Priority, nil
+		}
+		s.idem[nt.IdempotencyKey] = id
+	}
+	s.tasks[id] = &store.TaskRow{
+		ID: id, Type: nt.Type, Queue: nt.Queue, Status: "ENQUEUED",
+		MaxAttempts: nt.MaxAttempts, Priority: nt.Priority, Encrypted: nt.Encrypted,
+		CreatedAt: now, UpdatedAt: now,
+	}
+	if nt.CallbackURL != "" {
+		s.tasks[id].CallbackURL = &nt.CallbackURL
+	}
+	s.payload[id] = append([]byte(nil), nt.Payload...)
+	if nt.PayloadRef != "" {
+		s.refs[id] = nt.PayloadRef
+	}
+	s.history[id] = append(s.history[id], "ENQUEUED")
+	s.addEvents(store.TaskEvent{TaskID: id, Event: "ENQUEUED", At: now})
+	return id, "ENQUEUED", nt.Queue, nt.Priority, nil
+}
+
+// Payload returns the stored payload and payload_ref of a task.
+func (s *Store) Payload(id string) ([]byte, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.payload[id]...), s.refs[id]
+}
+
+func (s *Store) GetTask(_ context.Context, id string) (store.TaskRow, error) {
+	if t, ok := s.Task(id); ok {
+		if t.ResultJSON == nil {
+			t.ResultJSON = []byte("{}") // coalesce(result, '{}')
+		}
+		return t, nil
+	}
+	return store.TaskRow{}, pgx.ErrNoRows
+}
+
+func (s *Store) ListTaskEvents(_ context.Context, id string, after int64) ([]store.TaskEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []store.TaskEvent{}
+	for _, e := range s.events {
+		if e.TaskID == id && e.ID > after {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// Watch wakes on every event of id, like store.Listener.
+func (s *Store) Watch(id string) (<-chan struct{}, func()) {
+	c := make(chan struct{}, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watch[id] = append(s.watch[id], c)
+	return c, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.watch[id] = slices.DeleteFunc(s.watch[id], func(o chan struct{}) bool { return o == c })
+	}
+}
+
+// addEvents numbers and records events, as the task_events triggers do, and
+// wakes the watchers of their tasks. a terminal event queues the task's
+// webhook, like trg_task_webhook. s.mu must be held.
+func (s *Store) addEvents(evs ...store.TaskEvent) {
+	for _, e := range evs {
+		e.ID = int64(len(s.events) + 1)
+		s.events = append(s.events, e)
+		if t := s.tasks[e.TaskID]; store.Terminal(e.Event) && t.CallbackURL != nil {
+			s.addWebhook(store.WebhookDelivery{TaskID: t.ID, URL: *t.CallbackURL, Event: e.Event, Attempt: 1, RunAfter: e.At})
+		}
+		for _, c := range s.watch[e.TaskID] {
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Webhooks returns every delivery attempt, oldest first.
+func (s *Store) Webhooks() []store.WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]store.WebhookDelivery(nil), s.hooks...)
+}
+
+func (s *Store) ListWebhooks(_ context.Context, taskID string) ([]store.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []store.WebhookDelivery{}
+	for _, d := range s.hooks {
+		if d.TaskID == taskID {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+func (s *Store) ClaimWebhooks(_ context.Context, limit int, lease time.Duration) ([]store.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	out := []store.WebhookDelivery{}
+	for i := range s.hooks {
+		d := &s.hooks[i]
+		if len(out) == limit {
+			break
+		}
+		if d.State == store.WebhookPending && !d.RunAfter.After(now) {
+			d.RunAfter = now.Add(lease)
+			out = append(out, *d)
+		}
+	}
+	return out, nil
+}
+
+func (s *Store) FinishWebhook(_ context.Context, d store.WebhookDelivery, retryIn time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := int(d.ID) - 1
+	if i < 0 || i >= len(s.hooks) {
+		return pgx.ErrNoRows
+	}
+	now := s.clock.Now()
+	row := &s.hooks[i]
+	if row.State != store.WebhookPending {
+		return store.ErrWebhookDone
+	}
+	row.State, row.StatusCode, row.Error, row.DurationMS, row.DoneAt = d.State, d.StatusCode, d.Error, d.DurationMS, &now
+	if d.State == store.WebhookRetry {
+		s.addWebhook(store.WebhookDelivery{TaskID: d.TaskID, URL: d.URL, Event: d.Event, Attempt: d.Attempt + 1, RunAfter: now.Add(retryIn)})
+	}
+	return nil
+}
+
+// addWebhook appends a PENDING delivery. s.mu must be held.
+func (s *Store) addWebhook(d store.WebhookDelivery) {
+	d.ID = int64(len(s.hooks) + 1)
+	d.State = store.WebhookPending
+	d.CreatedAt = s.clock.Now()
+	s.hooks = append(s.hooks, d)
+}
+
+// TakeRateToken is dq_rate_take (GCRA) on the fake clock.
+func (s *Store) TakeRateToken(_ context.Context, typ string, ratePerSec float64, burst int) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	emission := time.Duration(float64(time.Second) / ratePerSec)
+	tolerance := time.Duration(float64(max(burst, 1)-1) * float64(time.Second) / ratePerSec)
+
+	cur := s.tat[typ]
+	if cur.Before(now) {
+		cur = now
+	}
+	if wait := cur.Sub(now) - tolerance; wait > 0 {
+		return wait, nil
+	}
+	s.tat[typ] = cur.Add(emission)
+	return 0, nil
+}
+
+func (s *Store) GetTypeLimits(_ context.Context, typ string) (store.TypeLimits, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.types[typ]
+	l := store.TypeLimits{RateBurst: 1}
+	if t.MaxConcurrency != nil {
+		l.MaxConcurrency = *t.MaxConcurrency
+	}
+	if t.RateLimitPerSec != nil {
+		l.RatePerSec = *t.RateLimitPerSec
+	}
+	if t.RateLimitBurst != nil {
+		l.RateBurst = *t.RateLimitBurst
+	}
+	return l, nil
+}
+
+// RefundRateToken is dq_rate_refund on the fake clock.
+func (s *Store) RefundRateToken(_ context.Context, typ string, ratePerSec float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tat, ok := s.tat[typ]; ok {
+		s.tat[typ] = tat.Add(-time.Duration(float64(time.Second) / ratePerSec))
+	}
+	return nil
+}
+
+func (s *Store) TaskStats(context.Context) (store.TaskStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := store.TaskStats{ByStatus: map[string]int{}, OldestEnqueued: map[string]time.Time{}}
+	for _, t := range s.tasks {
+		st.ByStatus[t.Status]++
+		if old, ok := st.OldestEnqueued[t.Queue]; t.Status == "ENQUEUED" && (!ok || t.CreatedAt.Before(old)) {
+			st.OldestEnqueued[t.Queue] = t.CreatedAt
+		}
+	}
+	return st, nil
+}
+
+func (s *Store) Ping(context.Context) error { return nil }
+
+func (s *Store) ListTypes(context.Context) ([]store.TaskType, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []store.TaskType{}
+	for _, t := range s.types {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Family != out[j].Family {
+			return out[i].Family < out[j].Family
+		}
+		return out[i].Version < out[j].Version
+	})
+	return out, nil
+}
+
+func (s *Store) GetType(_ context.Context, typ string) (store.TaskType, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.types[typ]
+	if !ok {
+		return store.TaskType{}, pgx.ErrNoRows
+	}
+	return t, nil
+}
+
+func (s *Store) CreateType(_ context.Context, t store.TaskType, actor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.types {
+		if o.Type == t.Type || (o.Family == t.Family && o.Version == t.Version) {
+			return store.ErrTypeExists
+		}
+	}
+	s.types[t.Type] = t
+	s.addAudit(t.Type, store.AuditCreate, actor, nil, &t)
+	return nil
+}
+
+func (s *Store) UpdateType(_ context.Context, typ, actor string, fn func(*store.TaskType) error) (store.TaskType, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before, ok := s.types[typ]
+	if !ok {
+		return store.TaskType{}, pgx.ErrNoRows
+	}
+	after := before
+	if err := fn(&after); err != nil {
+		return store.TaskType{}, err
+	}
+	after.Type, after.Family, after.Version = typ, before.Family, before.Version
+	s.types[typ] = after
+	s.addAudit(typ, store.AuditAction(before, after), actor, &before, &after)
+	return after, nil
+}
+
+func (s *Store) ListTypeAudit(_ context.Context, typ string) ([]store.TypeAudit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []store.TypeAudit{}
+	for _, a := range s.audit {
+		if a.Type == typ {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+func (s *Store) addAudit(typ, action, actor string, before, after *store.TaskType) {
+	a := store.TypeAudit{ID: int64(len(s.audit) + 1), Type: typ, Action: action, At: s.clock.Now()}
+	if actor != "" {
+		a.Actor = &actor
+	}
+	if before != nil {
+		a.Before, _ = json.Marshal(before)
+	}
+	a.After, _ = json.Marshal(after)
+	s.audit = append(s.audit, a)
+}
+
+func (s *Store) Begin(context.Context) (store.Tx, error) {
+	return &memTx{s: s, slots: map[string]int{}}, nil
+}
+
+type memTx struct {
+	s     *Store
+	done  bool
+	id    string // locked row
+	row   store.TaskRow
+	dirty bool
+	seen  []string // statuses set in this tx, recorded on commit
+	evs   []store.TaskEvent
+	slots map[string]int
+}
+
+func (tx *memTx) LockTaskForWork(ctx context.Context, id string) (store.WorkerTask, error) {
+	s := tx.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return store.WorkerTask{}, pgx.ErrNoRows
+	}
+	for s.locked[id] {
+		if err := ctx.Err(); err != nil {
+			return store.WorkerTask{}, err
+		}
+		s.unlock.Wait()
+	}
+	s.locked[id] = true
+	tx.id, tx.row = id, *t
+	return store.WorkerTask{
+		ID: t.ID, Type: t.Type, Queue: t.Queue, Status: t.Status,
+		Attempts: t.Attempts, MaxAttempts: t.MaxAttempts, Priority: t.Priority,
+		Payload: append([]byte(nil), s.payload[id]...), PayloadRef: ptr(s.refs[id]), Encrypted: t.Encrypted, CreatedAt: t.CreatedAt,
+	}, nil
+}
+
+func (tx *memTx) TryAcquireSlot(_ context.Context, typ string, max int) (bool, error) {
+	tx.s.mu.Lock()
+	defer tx.s.mu.Unlock()
+	if tx.s.slots[typ] >= max {
+		return false, nil
+	}
+	tx.s.slots[typ]++
+	tx.slots[typ]++
+	return true, nil
+}
+
+func (tx *memTx) MarkRunning(_ context.Context, id string) error {
+	return tx.update(id, func(t *store.TaskRow) {
+		t.Status = "RUNNING"
+		t.Attempts++
+		t.LastError = nil
+	})
+}
+
+func (tx *memTx) MarkSucceeded(_ context.Context, id string, result []byte, resultRef string) error {
+	return tx.update(id, func(t *store.TaskRow) {
+		t.Status = "SUCCEEDED"
+		t.ResultJSON = append([]byte(nil), result...)
+		t.ResultRef = ptr(resultRef)
+	})
+}
+
+// ptr maps "" to NULL.
+func ptr(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (tx *memTx) MarkFailed(_ context.Context, id string, lastErr string) error {
+	return tx.update(id, func(t *store.TaskRow) {
+		t.Status = "FAILED"
+		t.LastError = &lastErr
+	})
+}
+
+func (tx *memTx) MarkRetry(_ context.Context, id string, lastErr string) error {
+	return tx.update(id, func(t *store.TaskRow) {
+		t.Status = "ENQUEUED"
+		t.LastError = &lastErr
+	})
+}
+
+// update changes the tx's copy of the locked row.
+func (tx *memTx) update(id string, fn func(*store.TaskRow)) error {
+	if tx.done || id != tx.id {
+		return fmt.Errorf("testkit: task %s not locked by this tx", id)
+	}
+	prev := tx.row.Status
+	fn(&tx.row)
+	tx.row.UpdatedAt = tx.s.clock.Now()
+	tx.dirty = true
+	tx.seen = append(tx.seen, tx.row.Status)
+	// trg_task_events_update: only status changes, RUNNING -> ENQUEUED is a retry
+	if ev := tx.row.Status; ev != prev {
+		if prev == "RUNNING" && ev == "ENQUEUED" {
+			ev = "RETRY"
+		}
+		tx.evs = append(tx.evs, store.TaskEvent{TaskID: id, Event: ev, Note: tx.row.LastError, At: tx.row.UpdatedAt})
+	}
+	return nil
+}
+
+func (tx *memTx) Commit(context.Context) error {
+	return tx.end(true)
+}
+
+func (tx *memTx) Rollback(context.Context) error {
+	return tx.end(false)
+}
+
+func (tx *memTx) end(commit bool) error {
+	s := tx.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tx.done {
+		return pgx.ErrTxClosed
+	}
+	tx.done = true
+	if tx.id != "" {
+		if commit && tx.dirty {
+			*s.tasks[tx.id] = tx.row
+			s.history[tx.id] = append(s.history[tx.id], tx.seen...)
+			s.addEvents(tx.evs...)
+		}
+		delete(s.locked, tx.id)
+		s.unlock.Broadcast()
+	}
+	for typ, n := range tx.slots {
+		s.slots[typ] -= n
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PgxTracer turns pgx queries into client spans. set it as
+// pgxpool.Config.ConnConfig.Tracer. only queries under an existing span are
+// traced (the Postgres broker's polling would otherwise flood the backend),
+// and query arguments are never recorded: they carry task payloads.
+type PgxTracer struct{}
+
+var _ pgx.QueryTracer = PgxTracer{}
+
+func (PgxTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	op := operation(data.SQL)
+	ctx, _ = Tracer().Start(ctx, op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemNamePostgreSQL,
+		semconv.DBOperationName(op),
+		semconv.DBQueryText(strings.Join(strings.Fields(data.SQL), " ")),
+	))
+	return ctx
+}
+
+func (PgxTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	err := data.Err
+	if errors.Is(err, pgx.ErrNoRows) { // a lookup miss, not a failure
+		err = nil
+	}
+	End(span, err)
+}
+
+// operation is the SQL verb, ex: SELECT.
+func operation(sql string) string {
+	f := strings.Fields(sql)
+	if len(f) == 0 {
+		return "query"
+	}
+	return strings.ToUpper(f[0])
+}
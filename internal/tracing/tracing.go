@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const name = "github.com/henok3878/distributed-task-queue"
+
+// Tracer is the tracer of every span this module creates. until FromEnv
+// installs a provider it is a no-op.
+func Tracer() trace.Tracer { return otel.Tracer(name) }
+
+// FromEnv installs the global tracer provider and the W3C trace context
+// propagator. OTEL_TRACES_EXPORTER picks the exporter:
+//
+//	none (default)    spans are not recorded, but trace context still propagates
+//	otlp              OTLP over HTTP; OTEL_EXPORTER_OTLP_ENDPOINT etc. configure it
+//	stdout | console  pretty-printed to stdout, for local use
+//
+// service names the resource unless OTEL_SERVICE_NAME is set. call shutdown
+// before exit to flush buffered spans.
+func FromEnv(ctx context.Context, service string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	switch kind := strings.ToLower(strings.TrimSpace(os.Getenv("OTEL_TRACES_EXPORTER"))); kind {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q (none|otlp|stdout)", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(service)))
+	if err != nil {
+		return nil, err
+	}
+	if env, err := resource.New(ctx, resource.WithFromEnv()); err == nil { // OTEL_SERVICE_NAME, OTEL_RESOURCE_ATTRIBUTES
+		res, _ = resource.Merge(res, env)
+	}
+
+	// the sampler follows OTEL_TRACES_SAMPLER (default: parent-based, always on)
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Inject writes ctx's trace context (traceparent, tracestate, baggage) into
+// message headers.
+func Inject(ctx context.Context, headers map[string]any) {
+	otel.GetTextMapPropagator().Inject(ctx, Headers(headers))
+}
+
+// Extract returns ctx carrying the trace context found in message headers.
+func Extract(ctx context.Context, headers map[string]any) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, Headers(headers))
+}
+
+// Headers adapts message headers (amqp.Table, JSON headers of the Postgres
+// broker) to a propagation.TextMapCarrier.
+type Headers map[string]any
+
+func (h Headers) Get(key string) string {
+	s, _ := h[key].(string)
+	return s
+}
+
+func (h Headers) Set(key, value string) { h[key] = value }
+
+func (h Headers) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// End records err (if any) on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
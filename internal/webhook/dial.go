@@ -0,0 +1,105 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddr is a callback URL that resolved to an internal address.
+var ErrBlockedAddr = errors.New("webhook: address not allowed")
+
+// blocked are the ranges a callback may not reach unless allowed: the
+// checks below plus those without a netip predicate.
+var blocked = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved, broadcast
+}
+
+// internal reports whether ip is loopback, private, link-local (cloud
+// metadata lives at 169.254.169.254), multicast or otherwise not public.
+func internal(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, p := range blocked {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddr is a net.Dialer Control: it runs after DNS resolution, on the
+// address actually dialed, so a hostname can't be pointed at an internal
+// address later (DNS rebinding).
+func checkAddr(allow []netip.Prefix) func(network, address string, _ syscall.RawConn) error {
+	return func(network, address string, _ syscall.RawConn) error {
+		ap, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrBlockedAddr, address)
+		}
+		ip := ap.Addr().Unmap()
+		for _, p := range allow {
+			if p.Contains(ip) {
+				return nil
+			}
+		}
+		if internal(ip) {
+			return fmt.Errorf("%w: %s is internal (WEBHOOK_ALLOW_NETS)", ErrBlockedAddr, ip)
+		}
+		return nil
+	}
+}
+
+// newClient is the default Client: no proxy (it would dial on our behalf),
+// no redirects, internal addresses refused unless in allow.
+func newClient(timeout time.Duration, allow []netip.Prefix) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: checkAddr(allow)}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		// a redirect is a failed attempt, not a new target
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// parseNets reads a CSV of CIDRs or single addresses.
+func parseNets(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip, err := netip.ParseAddr(part)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
@@ -0,0 +1,274 @@
+// Package webhook delivers completion webhooks. when a task with a
+// callback_url reaches SUCCEEDED, FAILED or DLQ, a webhook_deliveries row is
+// queued in the same transaction (migration 0011); the Dispatcher POSTs the
+// final task there, signed with HMAC-SHA256, and retries with a
+// backoff.Strategy until it gets a 2xx or MaxAttempts is spent.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henok3878/distributed-task-queue/internal/backoff"
+	"github.com/henok3878/distributed-task-queue/internal/blob"
+	"github.com/henok3878/distributed-task-queue/internal/metrics"
+	"github.com/henok3878/distributed-task-queue/internal/store"
+)
+
+// Payload is the JSON body POSTed to a callback URL. deliveries are at least
+// once: receivers should dedupe on Task.ID.
+type Payload struct {
+	DeliveryID int64  `json:"delivery_id"`
+	Event      string `json:"event"` // SUCCEEDED | FAILED | DLQ
+	Attempt    int    `json:"attempt"`
+	Task       Task   `json:"task"`
+}
+
+// Task is the final task state, as GET /tasks/{id} shows it without a read
+// token: the result of an encrypted task is null.
+type Task struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Queue       string          `json:"queue"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	Priority    int             `json:"priority"`
+	LastError   *string         `json:"last_error"`
+	Result      json.RawMessage `json:"result"`
+	Encrypted   bool            `json:"encrypted"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// request headers besides SignatureHeader
+const (
+	DeliveryHeader = "X-DQ-Delivery"
+	EventHeader    = "X-DQ-Event"
+)
+
+// Dispatcher sends due deliveries. several may run against one database;
+// deliveries are claimed with SKIP LOCKED and a lease.
+type Dispatcher struct {
+	Store       store.Store
+	Blobs       *blob.Offloader  // loads offloaded results; share the API's
+	Secret      []byte           // signing key, required
+	Backoff     backoff.Strategy // delay before attempt n+1, given n; default backoff.FromEnvPrefix("WEBHOOK_BACKOFF")
+	MaxAttempts int              // default 10
+	Timeout     time.Duration    // per request, default 10s
+	Interval    time.Duration    // poll interval when idle, default 1s
+	Batch       int              // deliveries claimed at once, sent concurrently; default 16
+	Allow       []netip.Prefix   // internal addresses callbacks may reach anyway
+	Client      *http.Client     // default: Timeout, no redirects, internal addresses outside Allow refused
+	Now         func() time.Time // signature timestamps, default time.Now
+}
+
+// FromEnv configures a Dispatcher over s:
+//
+//	WEBHOOK_SECRET          signing key; unset disables webhooks (nil, nil)
+//	WEBHOOK_MAX_ATTEMPTS    default 10
+//	WEBHOOK_TIMEOUT         per request, default 10s
+//	WEBHOOK_POLL_INTERVAL   default 1s
+//	WEBHOOK_BACKOFF_*       like BACKOFF_* (see backoff.FromEnv)
+//	WEBHOOK_ALLOW_NETS      CSV of CIDRs/addresses exempt from the internal
+//	                        address block, e.g. 10.1.0.0/16
+func FromEnv(s store.Store) (*Dispatcher, error) {
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" {
+		return nil, nil
+	}
+	d := &Dispatcher{Store: s, Secret: []byte(secret), Backoff: backoff.FromEnvPrefix("WEBHOOK_BACKOFF")}
+	if v := strings.TrimSpace(os.Getenv("WEBHOOK_MAX_ATTEMPTS")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("bad WEBHOOK_MAX_ATTEMPTS %q", v)
+		}
+		d.MaxAttempts = n
+	}
+	allow, err := parseNets(os.Getenv("WEBHOOK_ALLOW_NETS"))
+	if err != nil {
+		return nil, fmt.Errorf("bad WEBHOOK_ALLOW_NETS: %w", err)
+	}
+	d.Allow = allow
+	for name, dst := range map[string]*time.Duration{"WEBHOOK_TIMEOUT": &d.Timeout, "WEBHOOK_POLL_INTERVAL": &d.Interval} {
+		if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+			dur, err := time.ParseDuration(v)
+			if err != nil || dur <= 0 {
+				return nil, fmt.Errorf("bad %s %q", name, v)
+			}
+			*dst = dur
+		}
+	}
+	return d, nil
+}
+
+func (d *Dispatcher) defaults() {
+	if d.Backoff == nil {
+		d.Backoff = backoff.FromEnvPrefix("WEBHOOK_BACKOFF")
+	}
+	if d.MaxAttempts <= 0 {
+		d.MaxAttempts = 10
+	}
+	if d.Timeout <= 0 {
+		d.Timeout = 10 * time.Second
+	}
+	if d.Interval <= 0 {
+		d.Interval = time.Second
+	}
+	if d.Batch <= 0 {
+		d.Batch = 16
+	}
+	if d.Client == nil {
+		d.Client = newClient(d.Timeout, d.Allow)
+	}
+	if d.Now == nil {
+		d.Now = time.Now
+	}
+}
+
+// Run dispatches until ctx is done, polling every Interval while idle.
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.defaults()
+	for {
+		n, err := d.Dispatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("webhook dispatch", "err", err)
+		}
+		if n == d.Batch && err == nil {
+			continue // more may be due
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.Interval):
+		}
+	}
+}
+
+// Dispatch claims up to Batch due deliveries, sends them and records the
+// outcomes. it returns how many it claimed.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	d.defaults()
+	// the lease outlives the request, so nobody else picks it up meanwhile
+	claimed, err := d.Store.ClaimWebhooks(ctx, d.Batch, d.Timeout+30*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("claim: %w", err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(claimed))
+	for i, h := range claimed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = d.deliver(ctx, h)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return len(claimed), err
+		}
+	}
+	return len(claimed), nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, h store.WebhookDelivery) error {
+	t, err := d.Store.GetTask(ctx, h.TaskID)
+	if err != nil {
+		return fmt.Errorf("delivery %d: get task: %w", h.ID, err) // retried once the lease runs out
+	}
+	if t.Encrypted {
+		t.ResultJSON = nil // only workers and token-bearing reads decrypt
+	} else if t.ResultRef != nil {
+		if t.ResultJSON, err = d.Blobs.Load(ctx, nil, *t.ResultRef); err != nil {
+			return fmt.Errorf("delivery %d: %w", h.ID, err)
+		}
+	}
+	body, err := json.Marshal(Payload{DeliveryID: h.ID, Event: h.Event, Attempt: h.Attempt, Task: Task{
+		ID: t.ID, Type: t.Type, Queue: t.Queue, Status: t.Status,
+		Attempts: t.Attempts, MaxAttempts: t.MaxAttempts, Priority: t.Priority,
+		LastError: t.LastError, Result: t.ResultJSON, Encrypted: t.Encrypted, CreatedAt: t.CreatedAt, UpdatedAt: t.UpdatedAt,
+	}})
+	if err != nil {
+		return fmt.Errorf("delivery %d: %w", h.ID, err)
+	}
+
+	start := time.Now()
+	code, sendErr := d.post(ctx, h, body)
+	elapsed := time.Since(start)
+	ms := int(elapsed.Milliseconds())
+	h.DurationMS = &ms
+	if code != 0 {
+		h.StatusCode = &code
+	}
+
+	var retryIn time.Duration
+	switch {
+	case sendErr == nil:
+		h.State = store.WebhookDelivered
+	case h.Attempt < d.MaxAttempts:
+		h.State = store.WebhookRetry
+		retryIn = d.Backoff.NextDelay(h.Attempt)
+	default:
+		h.State = store.WebhookFailed
+	}
+	log := slog.With("task_id", h.TaskID, "delivery_id", h.ID, "attempt", h.Attempt, "state", h.State)
+	if sendErr != nil {
+		msg := sendErr.Error()
+		h.Error = &msg
+		log.Warn("webhook not delivered", "err", sendErr, "retry_in_ms", retryIn.Milliseconds())
+	} else {
+		log.Debug("webhook delivered", "status", code, "duration_ms", ms)
+	}
+	err = d.Store.FinishWebhook(ctx, h, retryIn)
+	if errors.Is(err, store.ErrWebhookDone) {
+		// our lease ran out and another dispatcher recorded this attempt
+		// (and queued any retry); the receiver got it twice
+		log.Warn("webhook attempt already recorded by another dispatcher")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delivery %d: finish: %w", h.ID, err)
+	}
+	state := strings.ToLower(h.State)
+	metrics.WebhookDeliveries.WithLabelValues(h.Event, state).Inc()
+	metrics.WebhookLatency.WithLabelValues(state).Observe(elapsed.Seconds())
+	return nil
+}
+
+// post sends body to h.URL. any answer but a 2xx is an error; code is 0
+// when there was no answer.
+func (d *Dispatcher) post(ctx context.Context, h store.WebhookDelivery, body []byte) (code int, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dq-webhook/1")
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(h.ID, 10))
+	req.Header.Set(EventHeader, h.Event)
+	req.Header.Set(SignatureHeader, Sign(d.Secret, d.Now(), body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // keep the conn reusable
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
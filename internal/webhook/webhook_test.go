@@ -0,0 +1,169 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henok3878/distributed-task-queue/internal/api"
+	"github.com/henok3878/distributed-task-queue/internal/backoff"
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/internal/store"
+	"github.com/henok3878/distributed-task-queue/internal/testkit"
+	"github.com/henok3878/distributed-task-queue/internal/webhook"
+	"github.com/henok3878/distributed-task-queue/pkg/worker"
+)
+
+var secret = []byte("s3cret")
+
+// receiver records signed requests and answers with codes, in order, then 204.
+type receiver struct {
+	mu     sync.Mutex
+	codes  []int
+	bodies []webhook.Payload
+	errs   []error
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.errs = append(rc.errs, webhook.Verify(secret, r.Header.Get(webhook.SignatureHeader), body, time.Now(), time.Minute))
+	var p webhook.Payload
+	_ = json.Unmarshal(body, &p)
+	rc.bodies = append(rc.bodies, p)
+	code := http.StatusNoContent
+	if len(rc.codes) > 0 {
+		code, rc.codes = rc.codes[0], rc.codes[1:]
+	}
+	w.WriteHeader(code)
+}
+
+func setup(t *testing.T, rc *receiver) (*testkit.Kit, *webhook.Dispatcher, string) {
+	t.Helper()
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+
+	k := testkit.New(rmq.New("tasks", "default"), worker.Config{})
+	k.Store.AddType("email.send.v1", testkit.Type{Active: true, Queue: "default", MaxAttempts: 1})
+	k.Worker.Handle("email.send.v1", func(context.Context, []byte) ([]byte, error) { return []byte(`{"sent":1}`), nil })
+	k.Start(t)
+	res, err := k.Enqueue(api.EnqueueRequest{Type: "email.send.v1", Payload: json.RawMessage(`{}`), CallbackURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Deliver()
+	d := &webhook.Dispatcher{Store: k.Store, Secret: secret, Backoff: backoff.Fixed(time.Minute), MaxAttempts: 2,
+		Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}} // httptest listens on loopback
+	return k, d, res.ID
+}
+
+func TestDeliverSigned(t *testing.T) {
+	rc := &receiver{}
+	k, d, id := setup(t, rc)
+	if n, err := d.Dispatch(context.Background()); n != 1 || err != nil {
+		t.Fatalf("dispatch = %d, %v", n, err)
+	}
+	if len(rc.bodies) != 1 || rc.errs[0] != nil {
+		t.Fatalf("received %d, verify: %v", len(rc.bodies), rc.errs)
+	}
+	if p := rc.bodies[0]; p.Event != "SUCCEEDED" || p.Task.ID != id || string(p.Task.Result) != `{"sent":1}` {
+		t.Fatalf("payload %+v", p)
+	}
+	hooks := k.Store.Webhooks()
+	if len(hooks) != 1 || hooks[0].State != store.WebhookDelivered || *hooks[0].StatusCode != http.StatusNoContent {
+		t.Fatalf("deliveries %+v", hooks)
+	}
+	// nothing left to send
+	if n, _ := d.Dispatch(context.Background()); n != 0 {
+		t.Fatalf("redispatched %d", n)
+	}
+}
+
+func TestRetryThenGiveUp(t *testing.T) {
+	rc := &receiver{codes: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	k, d, id := setup(t, rc)
+	ctx := context.Background()
+
+	d.Dispatch(ctx)
+	if n, _ := d.Dispatch(ctx); n != 0 {
+		t.Fatal("retry sent before its backoff")
+	}
+	k.Clock.Advance(time.Minute)
+	d.Dispatch(ctx)
+
+	rec := k.Do(http.MethodGet, "/tasks/"+id+"/webhooks", nil)
+	var out struct{ Deliveries []store.WebhookDelivery }
+	_ = json.Unmarshal(rec.Body.Bytes(), &out)
+	ds := out.Deliveries
+	if len(ds) != 2 || ds[0].State != store.WebhookRetry || ds[1].State != store.WebhookFailed ||
+		*ds[1].StatusCode != http.StatusBadGateway || *ds[1].Error != "status 502" || ds[1].Attempt != 2 {
+		t.Fatalf("deliveries %s", rec.Body)
+	}
+}
+
+func TestAttemptFinishedOnce(t *testing.T) {
+	k, _, _ := setup(t, &receiver{})
+	ctx := context.Background()
+	// lease 0: the row is due again at once, as if the first dispatcher stalled
+	first, _ := k.Store.ClaimWebhooks(ctx, 1, 0)
+	second, _ := k.Store.ClaimWebhooks(ctx, 1, 0)
+	if len(first) != 1 || len(second) != 1 || first[0].ID != second[0].ID {
+		t.Fatalf("claims %+v %+v", first, second)
+	}
+	for i, h := range []store.WebhookDelivery{first[0], second[0]} {
+		h.State = store.WebhookRetry
+		err := k.Store.FinishWebhook(ctx, h, time.Minute)
+		if want := []error{nil, store.ErrWebhookDone}[i]; !errors.Is(err, want) {
+			t.Fatalf("finish %d: %v, want %v", i+1, err, want)
+		}
+	}
+	if hooks := k.Store.Webhooks(); len(hooks) != 2 {
+		t.Fatalf("retry chain doubled: %+v", hooks)
+	}
+}
+
+func TestInternalAddressBlocked(t *testing.T) {
+	rc := &receiver{}
+	k, d, _ := setup(t, rc)
+	d.Allow = nil
+
+	if _, err := d.Dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.bodies) != 0 {
+		t.Fatal("loopback receiver was called")
+	}
+	if hooks := k.Store.Webhooks(); len(hooks) != 2 || hooks[0].State != store.WebhookRetry ||
+		!strings.Contains(*hooks[0].Error, "address not allowed") {
+		t.Fatalf("deliveries %+v", hooks)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"a":1}`)
+	h := webhook.Sign(secret, now, body)
+	if err := webhook.Verify(secret, h, body, now, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for name, err := range map[string]error{
+		"tampered":  webhook.Verify(secret, h, []byte(`{"a":2}`), now, time.Minute),
+		"wrong key": webhook.Verify([]byte("other"), h, body, now, time.Minute),
+		"replayed":  webhook.Verify(secret, h, body, now.Add(time.Hour), time.Minute),
+		"no header": webhook.Verify(secret, "", body, now, time.Minute),
+		"no mac":    webhook.Verify(secret, "t=1", body, now, time.Minute),
+	} {
+		if !errors.Is(err, webhook.ErrSignature) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
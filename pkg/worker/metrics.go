@@ -0,0 +1,32 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/henok3878/distributed-task-queue/internal/metrics"
+)
+
+// serveMetrics exposes metrics.Registry on addr until the returned stop is
+// called. a listen error is logged, not fatal: metrics are best-effort.
+func serveMetrics(addr string, log *slog.Logger) (stop func()) {
+	metrics.MustRegisterAll()
+	mux := http.NewServeMux()
+	metrics.Expose(mux, "GET /metrics")
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		log.Info("worker metrics listening", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("worker metrics", "err", err)
+		}
+	}()
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}
+}
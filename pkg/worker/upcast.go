@@ -0,0 +1,56 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+)
+
+// UpcastFunc rewrites a payload of one type version into the next one,
+// ex: email.send.v1 {"to":"a@b"} -> email.send.v2 {"to":["a@b"]}.
+type UpcastFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+type upcaster struct {
+	from, to string
+	fn       UpcastFunc
+}
+
+// Upcast registers fn to turn payloads of type from into payloads of type to,
+// so old versions keep working with only the newest handler registered.
+// a task whose type has no handler is upcast, through as many versions as it
+// takes (v1 -> v2 -> v3), to the first type that has one; the task row keeps
+// its original type. like Handle, it is ignored when Config.Types is set and
+// doesn't list from. Call before Run.
+func (w *Worker) Upcast(from, to string, fn UpcastFunc) {
+	if len(w.cfg.Types) > 0 && !contains(w.cfg.Types, from) {
+		return
+	}
+	w.upcasters[from] = upcaster{from: from, to: to, fn: fn}
+}
+
+// resolve finds the handler for typ and the upcasters to apply before it.
+func (w *Worker) resolve(typ string) (HandlerFunc, []upcaster, bool) {
+	var chain []upcaster
+	for len(chain) <= len(w.upcasters) { // longer means a cycle
+		if h, ok := w.handlers[typ]; ok {
+			return h, chain, true
+		}
+		u, ok := w.upcasters[typ]
+		if !ok {
+			break
+		}
+		chain = append(chain, u)
+		typ = u.to
+	}
+	return nil, nil, false
+}
+
+func upcast(ctx context.Context, chain []upcaster, payload []byte) ([]byte, error) {
+	for _, u := range chain {
+		out, err := u.fn(ctx, payload)
+		if err != nil {
+			return nil, fmt.Errorf("upcast %s -> %s: %w", u.from, u.to, err)
+		}
+		payload = out
+	}
+	return payload, nil
+}
@@ -0,0 +1,561 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/henok3878/distributed-task-queue/internal/backoff"
+	"github.com/henok3878/distributed-task-queue/internal/blob"
+	"github.com/henok3878/distributed-task-queue/internal/broker"
+	"github.com/henok3878/distributed-task-queue/internal/envelope"
+	"github.com/henok3878/distributed-task-queue/internal/logging"
+	"github.com/henok3878/distributed-task-queue/internal/metrics"
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/internal/store"
+	"github.com/henok3878/distributed-task-queue/internal/tracing"
+)
+
+// HandlerFunc executes one task and returns its JSON result.
+type HandlerFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+type Config struct {
+	Store    store.Store   // store.NewPostgres(pool) in production
+	Broker   broker.Broker // RabbitMQ or Postgres; consumption policy lives there
+	Topology rmq.Topology
+	Backoff  backoff.Strategy
+
+	// Queues is the subset of topology routing keys this worker consumes
+	// (default: all). Types, when set, limits which registered handlers are
+	// served; deliveries of any other type are handed back for other workers.
+	Queues []string
+	Types  []string
+
+	// UnhandledDelay is how long a delivery of a type this worker doesn't
+	// serve waits in the retry queue before another worker can pick it up.
+	// after MaxUnhandled hand-backs (default 360, ~30-45 minutes at the
+	// default delay) nobody is assumed to serve it: the task fails and is
+	// dead-lettered without spending an attempt.
+	UnhandledDelay time.Duration
+	MaxUnhandled   int
+
+	// HandlerTimeout bounds one delivery: the handler plus its task row
+	// updates (default 10s). with the Postgres broker the claim's
+	// visibility (broker.ConsumeConfig.Visibility) must be longer.
+	HandlerTimeout time.Duration
+
+	// LimitDelay is how long a delivery waits in the retry queue when its
+	// type is at its concurrency cap (jittered up to +50%).
+	LimitDelay time.Duration
+
+	// Blobs loads offloaded payloads before the handler runs and offloads
+	// results above its threshold; nil keeps results inline and fails tasks
+	// whose payload was offloaded. share the API's (blob.FromEnv).
+	Blobs *blob.Offloader
+
+	// Keys opens the payloads of encrypted tasks and seals their results;
+	// nil fails such tasks. holds the API's keys (envelope.FromEnv).
+	Keys *envelope.Keyring
+
+	// MetricsAddr, when set, serves metrics.Registry at GET /metrics on this
+	// address (ex: ":9102") for as long as Run runs.
+	MetricsAddr string
+
+	// Logger is the base logger (default slog.Default()); every line carries
+	// worker_id = ID (default <hostname>-<pid>). handlers get it, with the
+	// task's attributes, from Logger(ctx).
+	Logger *slog.Logger
+	ID     string
+}
+
+type Worker struct {
+	cfg       Config
+	log       *slog.Logger
+	handlers  map[string]HandlerFunc
+	upcasters map[string]upcaster // by source type
+}
+
+func New(cfg Config) *Worker {
+	if cfg.Backoff == nil {
+		cfg.Backoff = backoff.FromEnv()
+	}
+	if len(cfg.Queues) == 0 {
+		cfg.Queues = cfg.Topology.RoutingKeys
+	}
+	if cfg.UnhandledDelay <= 0 {
+		cfg.UnhandledDelay = 5 * time.Second
+	}
+	if cfg.MaxUnhandled <= 0 {
+		cfg.MaxUnhandled = 360
+	}
+	if cfg.HandlerTimeout <= 0 {
+		cfg.HandlerTimeout = 10 * time.Second
+	}
+	if cfg.LimitDelay <= 0 {
+		cfg.LimitDelay = 2 * time.Second
+	}
+	if cfg.ID == "" {
+		host, _ := os.Hostname()
+		cfg.ID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Worker{
+		cfg:       cfg,
+		log:       cfg.Logger.With("worker_id", cfg.ID),
+		handlers:  map[string]HandlerFunc{},
+		upcasters: map[string]upcaster{},
+	}
+}
+
+// Handle registers the handler for a task type. Call before Run.
+// if Config.Types is set and doesn't list typ, the handler is ignored.
+func (w *Worker) Handle(typ string, h HandlerFunc) {
+	if len(w.cfg.Types) > 0 && !contains(w.cfg.Types, typ) {
+		return
+	}
+	w.handlers[typ] = h
+}
+
+// Serves reports whether this worker has a handler for typ, directly or
+// through upcasters.
+func (w *Worker) Serves(typ string) bool {
+	_, _, ok := w.resolve(typ)
+	return ok
+}
+
+// Logger is the logger for code running a task: the worker's logger with the
+// task id, type, queue and attempt (and trace ids when tracing) attached.
+// outside a handler it is slog's default.
+func Logger(ctx context.Context) *slog.Logger { return logging.FromContext(ctx) }
+
+// Run consumes the configured queues until ctx is cancelled, then waits for
+// in-flight tasks.
+func (w *Worker) Run(ctx context.Context) error {
+	for _, rk := range w.cfg.Queues {
+		if !contains(w.cfg.Topology.RoutingKeys, rk) {
+			return fmt.Errorf("queue %q not in topology (one of %v)", rk, w.cfg.Topology.RoutingKeys)
+		}
+	}
+
+	// a claim that expires mid-task hands the task to a second worker
+	if p, ok := w.cfg.Broker.(*broker.Postgres); ok && p.Visibility() <= w.cfg.HandlerTimeout {
+		return fmt.Errorf("broker visibility %s must exceed the handler timeout %s", p.Visibility(), w.cfg.HandlerTimeout)
+	}
+
+	w.log.Info("worker started", "queues", w.cfg.Queues, "types", w.types())
+
+	if w.cfg.MetricsAddr != "" {
+		stop := serveMetrics(w.cfg.MetricsAddr, w.log)
+		defer stop()
+	}
+
+	go func() {
+		<-ctx.Done()
+		w.log.Info("worker shutting down")
+	}()
+	if err := w.cfg.Broker.Consume(ctx, w.cfg.Queues, w.process); err != nil {
+		return err
+	}
+	w.log.Info("worker stopped")
+	return nil
+}
+
+func (w *Worker) process(ctx context.Context, d broker.Delivery) {
+	env := d.Message()
+	start := time.Now()
+
+	// continue the producer's trace (traceparent in the message headers)
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, env.Headers), "process "+env.Queue,
+		trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+			semconv.MessagingOperationTypeProcess,
+			semconv.MessagingDestinationName(env.Queue),
+			semconv.MessagingMessageID(env.ID),
+			attribute.String("task.type", env.Type),
+		))
+	defer span.End()
+
+	// handlers and every line below log with the task's attributes
+	base := w.log.With("task_id", env.ID, "type", env.Type, "queue", env.Queue)
+	ctx = logging.WithContext(ctx, base)
+	log := logging.FromContext(ctx)
+
+	// per-message transactional scope
+	ctxMsg, cancelMsg := context.WithTimeout(ctx, w.cfg.HandlerTimeout)
+	defer cancelMsg()
+	// limits and the rate token come first, each on a connection of its own
+	// that is back in the pool before the task tx takes one: a delivery that
+	// held its tx connection while waiting for another could starve the pool
+	limits, err := w.cfg.Store.GetTypeLimits(ctxMsg, env.Type)
+	if err != nil {
+		log.Error("type limits", "err", err)
+		_ = d.Requeue()
+		return
+	}
+	// global per-type throughput cap. the token is refunded if the task
+	// doesn't run after all, so only tasks that run spend one
+	ran := false
+	if limits.RatePerSec > 0 {
+		wait, err := w.cfg.Store.TakeRateToken(ctxMsg, env.Type, limits.RatePerSec, limits.RateBurst)
+		if err != nil {
+			log.Error("rate limit", "err", err)
+			_ = d.Requeue()
+			return
+		}
+		if wait > 0 {
+			w.throttle(ctx, d, w.pending(env), jitter(wait), "rate")
+			return
+		}
+		defer func() {
+			if !ran {
+				if err := w.cfg.Store.RefundRateToken(ctx, env.Type, limits.RatePerSec); err != nil {
+					log.Warn("refund rate token", "err", err)
+				}
+			}
+		}()
+	}
+
+	tx, err := w.cfg.Store.Begin(ctxMsg)
+	if err != nil {
+		log.Error("begin tx", "err", err)
+		_ = d.Requeue()
+		return
+	}
+
+	t, err := tx.LockTaskForWork(ctxMsg, env.ID)
+	if err != nil {
+		_ = tx.Rollback(ctxMsg)
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Warn("task missing; ack")
+			_ = d.Ack()
+			return
+		}
+		log.Error("lock task", "err", err)
+		_ = d.Requeue()
+		return
+	}
+
+	// already completed? (idempotent)
+	if t.Status == "SUCCEEDED" {
+		_ = tx.Commit(ctxMsg)
+		_ = d.Ack()
+		return
+	}
+
+	// the broker's last delivery (quorum x-delivery-limit, or the Postgres
+	// broker's claim limit): earlier ones were requeued without an outcome,
+	// usually a worker dying mid-task, which rolls back MarkRunning so the
+	// attempts guard never sees them. fail it here so the row, the DLQ and
+	// the FAILED event agree; requeueing it once more would make a quorum
+	// queue drop it, and a Postgres row would be claimed forever.
+	if limit := w.deliveryLimit(t); limit > 0 && headerInt(env.Headers, headerDeliveryCount) >= limit {
+		w.bury(ctxMsg, tx, d, t, fmt.Sprintf("delivery limit (%d) reached: workers kept dying or timing out on it", limit))
+		return
+	}
+
+	// not ours: hand it back untouched so a worker that serves the type gets it
+	if !w.Serves(t.Type) {
+		bounces := headerInt(env.Headers, headerUnhandled) + 1
+		if bounces > w.cfg.MaxUnhandled {
+			w.bury(ctxMsg, tx, d, t, fmt.Sprintf("no worker serves type %q: handed back %d times", t.Type, bounces-1))
+			return
+		}
+		_ = tx.Rollback(ctxMsg)
+		metrics.UnhandledTotal.WithLabelValues(t.Type, w.routingKey(t)).Inc()
+		if bounces%10 == 0 {
+			log.Warn("task keeps bouncing; is any worker serving its type?", "bounces", bounces)
+		}
+		w.delay(ctx, d, t, jitter(w.cfg.UnhandledDelay), "unhandled", map[string]any{headerUnhandled: int32(bounces)})
+		return
+	}
+
+	// attempts guard
+	if t.Attempts >= t.MaxAttempts {
+		_ = tx.MarkFailed(ctxMsg, t.ID, "max attempts exceeded")
+		_ = tx.Commit(ctxMsg)
+		_ = d.Ack()
+		return
+	}
+
+	// global per-type concurrency cap; the slot is held until tx ends
+	if limits.MaxConcurrency > 0 {
+		ok, err := tx.TryAcquireSlot(ctxMsg, t.Type, limits.MaxConcurrency)
+		if err != nil {
+			_ = tx.Rollback(ctxMsg)
+			log.Error("acquire slot", "err", err)
+			_ = d.Requeue()
+			return
+		}
+		if !ok {
+			// over the cap: leave the row untouched (no attempt spent) and park it
+			_ = tx.Rollback(ctxMsg)
+			w.throttle(ctx, d, t, jitter(w.cfg.LimitDelay), "concurrency")
+			return
+		}
+	}
+
+	// RUNNING (+attempts)
+	if err := tx.MarkRunning(ctxMsg, t.ID); err != nil {
+		_ = tx.Rollback(ctxMsg)
+		_ = d.Requeue()
+		return
+	}
+	ran = true
+
+	// do work
+	rk := w.routingKey(t)
+	ready := env.Ready
+	if ready.IsZero() {
+		ready = t.CreatedAt
+	}
+	metrics.QueueWait.WithLabelValues(t.Type, rk).Observe(max(time.Since(ready).Seconds(), 0))
+	metrics.TaskAttempts.WithLabelValues(t.Type, rk).Inc()
+	inFlight := metrics.TasksInFlight.WithLabelValues(t.Type, rk)
+	inFlight.Inc()
+	runStart := time.Now()
+	base = base.With("attempt", t.Attempts+1)
+	ctx = logging.WithContext(ctx, base)
+	log = logging.FromContext(ctx)
+	hctx, hspan := tracing.Tracer().Start(logging.WithContext(ctxMsg, base), "handle "+t.Type, trace.WithAttributes(attribute.Int("task.attempt", t.Attempts+1)))
+	resultJSON, resultRef, handlerErr := w.handle(hctx, t)
+	tracing.End(hspan, handlerErr)
+	inFlight.Dec()
+	observe := func(outcome string) {
+		metrics.TaskDuration.WithLabelValues(t.Type, rk, outcome).Observe(metrics.ObserveDuration(runStart))
+		span.SetAttributes(attribute.String("task.outcome", outcome))
+	}
+
+	if handlerErr == nil {
+		observe("succeeded")
+		// write-before-ACK
+		if err := tx.MarkSucceeded(ctxMsg, t.ID, resultJSON, resultRef); err != nil {
+			_ = tx.Rollback(ctxMsg)
+			_ = d.Requeue()
+			return
+		}
+		if err := tx.Commit(ctxMsg); err != nil {
+			_ = d.Requeue()
+			return
+		}
+		_ = d.Ack()
+		w.event(ctx, t, "SUCCEEDED", "")
+		log.Info("task succeeded", "duration_ms", time.Since(start).Milliseconds())
+		return
+	}
+
+	// error: retry or final DLQ
+	// compute delay using the post increment attempt number
+	attemptAfter := t.Attempts + 1
+	if attemptAfter < t.MaxAttempts {
+		observe("retry")
+		// persist retry state (status back to ENQUEUED, record last_error)
+		if err := tx.MarkRetry(ctxMsg, t.ID, handlerErr.Error()); err != nil {
+			_ = tx.Rollback(ctxMsg)
+			_ = d.Requeue()
+			return
+		}
+		if err := tx.Commit(ctxMsg); err != nil {
+			_ = d.Requeue()
+			return
+		}
+
+		metrics.TaskRetries.WithLabelValues(t.Type, rk).Inc()
+		w.delay(ctx, d, t, w.cfg.Backoff.NextDelay(attemptAfter), "retry", nil)
+		w.event(ctx, t, "RETRY", handlerErr.Error())
+		return
+	}
+
+	// final failure -> mark FAILED and route to DLQ for inspection
+	observe("failed")
+	_ = tx.MarkFailed(ctxMsg, t.ID, handlerErr.Error())
+	_ = tx.Commit(ctxMsg)
+	w.deadLetter(ctx, d, t, handlerErr.Error())
+}
+
+// bury fails t without running it, so no attempt is spent, and dead-letters
+// it. ctx bounds tx.
+func (w *Worker) bury(ctx context.Context, tx store.Tx, d broker.Delivery, t store.WorkerTask, reason string) {
+	if err := tx.MarkFailed(ctx, t.ID, reason); err != nil {
+		_ = tx.Rollback(ctx)
+		logging.FromContext(ctx).Error("mark failed", "err", err)
+		_ = d.Requeue()
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		_ = d.Requeue()
+		return
+	}
+	w.deadLetter(ctx, d, t, reason)
+}
+
+// deadLetter routes a task already marked FAILED to its DLQ and acks.
+func (w *Worker) deadLetter(ctx context.Context, d broker.Delivery, t store.WorkerTask, reason string) {
+	log := logging.FromContext(ctx)
+	if err := w.cfg.Broker.DeadLetter(ctx, w.message(t, nil)); err != nil {
+		log.Error("dead-letter", "err", err)
+	} else {
+		metrics.TaskDLQ.WithLabelValues(t.Type, w.routingKey(t)).Inc()
+	}
+
+	_ = d.Ack()
+	w.event(ctx, t, "FAILED", reason)
+	log.Error("task failed", "err", reason)
+}
+
+// handle runs t's handler. an encrypted task's payload is opened just
+// before and its result sealed right after, so plaintext stays in memory.
+// blob store and key errors count as handler errors, so they are retried
+// like one.
+func (w *Worker) handle(ctx context.Context, t store.WorkerTask) (result []byte, resultRef string, err error) {
+	h, chain, ok := w.resolve(t.Type)
+	if !ok {
+		return nil, "", fmt.Errorf("no handler for type %q", t.Type)
+	}
+	payload := t.Payload
+	if t.PayloadRef != nil {
+		if payload, err = w.cfg.Blobs.Load(ctx, nil, *t.PayloadRef); err != nil {
+			return nil, "", err
+		}
+	}
+	if t.Encrypted {
+		if payload, err = w.cfg.Keys.Open(payload, blob.PayloadKey(t.ID)); err != nil {
+			return nil, "", fmt.Errorf("open payload: %w", err)
+		}
+	}
+	if payload, err = upcast(ctx, chain, payload); err != nil {
+		return nil, "", err
+	}
+	if result, err = h(ctx, payload); err != nil {
+		return nil, "", err
+	}
+	if t.Encrypted {
+		if result, err = w.cfg.Keys.Seal(result, blob.ResultKey(t.ID)); err != nil {
+			return nil, "", fmt.Errorf("seal result: %w", err)
+		}
+	}
+	return w.cfg.Blobs.Offload(ctx, blob.ResultKey(t.ID), result)
+}
+
+// delay hands the task back to the broker to be redelivered after delay and
+// acks the original delivery, in one step when the delivery can retry
+// itself. if that fails the delivery is requeued.
+func (w *Worker) delay(ctx context.Context, d broker.Delivery, t store.WorkerTask, delay time.Duration, reason string, headers map[string]any) {
+	var (
+		actual time.Duration
+		err    error
+	)
+	if r, ok := d.(broker.Retrier); ok {
+		actual, err = r.RetryAfter(ctx, w.message(t, headers), delay)
+	} else if actual, err = w.cfg.Broker.Retry(ctx, w.message(t, headers), delay); err == nil {
+		_ = d.Ack()
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("delay", "reason", reason, "err", err)
+		_ = d.Requeue()
+		return
+	}
+
+	logging.FromContext(ctx).Info("task delayed", "reason", reason, "delay_ms", actual.Milliseconds())
+}
+
+// message is the envelope for republishing t. priority is carried over.
+func (w *Worker) message(t store.WorkerTask, headers map[string]any) broker.Message {
+	return broker.Message{ID: t.ID, Type: t.Type, Queue: w.routingKey(t), Priority: uint8(t.Priority), Headers: headers}
+}
+
+// deliveryLimit is how many deliveries without an outcome t's queue allows;
+// 0 means no limit.
+func (w *Worker) deliveryLimit(t store.WorkerTask) int {
+	if p, ok := w.cfg.Broker.(*broker.Postgres); ok {
+		return p.DeliveryLimit()
+	}
+	return w.cfg.Topology.Spec(w.routingKey(t)).DeliveryLimit
+}
+
+// pending is the task as its message describes it, for parking a delivery
+// before the row is read.
+func (w *Worker) pending(env broker.Message) store.WorkerTask {
+	return store.WorkerTask{ID: env.ID, Type: env.Type, Queue: env.Queue, Priority: int(env.Priority)}
+}
+
+// throttle parks a task that may not run yet. it is not an attempt: the row
+// stays ENQUEUED and only the delivery is delayed.
+func (w *Worker) throttle(ctx context.Context, d broker.Delivery, t store.WorkerTask, delay time.Duration, reason string) {
+	metrics.ThrottledTotal.WithLabelValues(t.Type, reason).Inc()
+	metrics.ThrottleDelay.WithLabelValues(t.Type, reason).Observe(delay.Seconds())
+	w.delay(ctx, d, t, delay, reason+" limit", nil)
+}
+
+// event mirrors a committed transition onto the event stream, if configured.
+func (w *Worker) event(ctx context.Context, t store.WorkerTask, event, note string) {
+	ev := rmq.Event{TaskID: t.ID, Type: t.Type, Queue: t.Queue, Event: event, Note: note}
+	if err := w.cfg.Broker.Event(ctx, ev); err != nil {
+		logging.FromContext(ctx).Warn("event", "event", event, "err", err)
+	}
+}
+
+func (w *Worker) routingKey(t store.WorkerTask) string {
+	return strings.TrimPrefix(t.Queue, w.cfg.Topology.QueuePrefix+".") // "default" | "high"
+}
+
+// headerUnhandled counts how often a delivery was handed back because the
+// worker that received it had no handler for its type.
+const headerUnhandled = "x-dq-unhandled"
+
+// headerDeliveryCount is set by quorum queues (and the Postgres broker) on
+// redelivery: how many earlier deliveries were requeued.
+const headerDeliveryCount = "x-delivery-count"
+
+func headerInt(h map[string]any, key string) int {
+	switch v := h[key].(type) {
+	case float64: // JSON headers (Postgres broker)
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+func (w *Worker) types() []string {
+	ts := make([]string, 0, len(w.handlers)+len(w.upcasters))
+	for t := range w.handlers {
+		ts = append(ts, t)
+	}
+	for t, u := range w.upcasters {
+		if w.Serves(t) {
+			ts = append(ts, t+"->"+u.to)
+		}
+	}
+	sort.Strings(ts)
+	return ts
+}
+
+func contains(xs []string, want string) bool {
+	for _, x := range xs {
+		if x == want {
+			return true
+		}
+	}
+	return false
+}
+
+// jitter spreads d over [d, 1.5d) so parked deliveries don't return in lockstep
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
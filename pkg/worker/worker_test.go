@@ -0,0 +1,402 @@
+package worker_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/henok3878/distributed-task-queue/internal/api"
+	"github.com/henok3878/distributed-task-queue/internal/backoff"
+	"github.com/henok3878/distributed-task-queue/internal/blob"
+	"github.com/henok3878/distributed-task-queue/internal/broker"
+	"github.com/henok3878/distributed-task-queue/internal/metrics"
+	"github.com/henok3878/distributed-task-queue/internal/rmq"
+	"github.com/henok3878/distributed-task-queue/internal/store"
+	"github.com/henok3878/distributed-task-queue/internal/testkit"
+	"github.com/henok3878/distributed-task-queue/pkg/worker"
+)
+
+const typ = "email.send.v1"
+
+func newKit(t *testing.T, maxAttempts int, h worker.HandlerFunc) *testkit.Kit {
+	t.Helper()
+	k := testkit.New(rmq.New("tasks", "default", "high"), worker.Config{
+		Backoff: backoff.List(10*time.Second, time.Minute),
+	})
+	k.Store.AddType(typ, testkit.Type{Active: true, Queue: "default", MaxAttempts: maxAttempts})
+	if h != nil {
+		k.Worker.Handle(typ, h)
+	}
+	k.Start(t)
+	return k
+}
+
+func enqueue(t *testing.T, k *testkit.Kit) string {
+	t.Helper()
+	res, err := k.Enqueue(api.EnqueueRequest{Type: typ, Payload: json.RawMessage(`{"to":"a@b.c"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.ID
+}
+
+func task(t *testing.T, k *testkit.Kit, id string) store.TaskRow {
+	t.Helper()
+	row, ok := k.Store.Task(id)
+	if !ok {
+		t.Fatalf("task %s missing", id)
+	}
+	return row
+}
+
+// failing fails the first n calls.
+func failing(n int) worker.HandlerFunc {
+	calls := 0
+	return func(ctx context.Context, payload []byte) ([]byte, error) {
+		calls++
+		if calls <= n {
+			return nil, errors.New("smtp down")
+		}
+		return []byte(`{"ok":true}`), nil
+	}
+}
+
+func TestSuccess(t *testing.T) {
+	k := newKit(t, 3, failing(0))
+	id := enqueue(t, k)
+
+	if n := k.Deliver(); n != 1 {
+		t.Fatalf("deliveries = %d, want 1", n)
+	}
+	row := task(t, k, id)
+	if row.Status != "SUCCEEDED" || row.Attempts != 1 || string(row.ResultJSON) != `{"ok":true}` {
+		t.Fatalf("got %s attempts=%d result=%s", row.Status, row.Attempts, row.ResultJSON)
+	}
+	if h := k.Store.History(id); !slices.Equal(h, []string{"ENQUEUED", "RUNNING", "SUCCEEDED"}) {
+		t.Fatalf("history = %v", h)
+	}
+}
+
+func TestRetryFollowsBackoff(t *testing.T) {
+	k := newKit(t, 3, failing(2))
+	id := enqueue(t, k)
+
+	k.Deliver()
+	if row := task(t, k, id); row.Status != "ENQUEUED" || row.Attempts != 1 || row.LastError == nil {
+		t.Fatalf("after 1st failure: %s attempts=%d", row.Status, row.Attempts)
+	}
+
+	// first retry is due after 10s, not before
+	if n := k.Advance(9 * time.Second); n != 0 {
+		t.Fatalf("retry ran early (%d deliveries)", n)
+	}
+	if n := k.Advance(time.Second); n != 1 {
+		t.Fatalf("retry not run at 10s (%d deliveries)", n)
+	}
+
+	// second retry after 1m
+	if n := k.Advance(59 * time.Second); n != 0 {
+		t.Fatalf("2nd retry ran early (%d deliveries)", n)
+	}
+	k.Advance(time.Second)
+
+	row := task(t, k, id)
+	if row.Status != "SUCCEEDED" || row.Attempts != 3 {
+		t.Fatalf("got %s attempts=%d", row.Status, row.Attempts)
+	}
+}
+
+func TestFinalFailureDeadLetters(t *testing.T) {
+	k := newKit(t, 2, failing(10))
+	id := enqueue(t, k)
+
+	k.Drain(time.Hour)
+
+	row := task(t, k, id)
+	if row.Status != "FAILED" || row.Attempts != 2 || row.LastError == nil || *row.LastError != "smtp down" {
+		t.Fatalf("got %s attempts=%d", row.Status, row.Attempts)
+	}
+	dead := k.Broker.Dead()
+	if len(dead) != 1 || dead[0].ID != id || dead[0].DLQ != "tasks.dlq" {
+		t.Fatalf("dead letters = %+v", dead)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	counters := []*prometheus.CounterVec{metrics.TaskAttempts, metrics.TaskRetries, metrics.TaskDLQ}
+	before := make([]float64, len(counters))
+	for i, c := range counters {
+		before[i] = testutil.ToFloat64(c.WithLabelValues(typ, "default"))
+	}
+
+	k := newKit(t, 2, failing(10))
+	enqueue(t, k)
+	k.Drain(time.Hour)
+
+	for i, want := range []float64{2, 1, 1} { // attempts, retries, dlq
+		if got := testutil.ToFloat64(counters[i].WithLabelValues(typ, "default")) - before[i]; got != want {
+			t.Errorf("counter %d: +%v, want +%v", i, got, want)
+		}
+	}
+	if n := testutil.ToFloat64(metrics.TasksInFlight.WithLabelValues(typ, "default")); n != 0 {
+		t.Errorf("in flight = %v after drain", n)
+	}
+}
+
+func TestUnhandledTypeKeepsAttempts(t *testing.T) {
+	k := newKit(t, 3, nil)
+	id := enqueue(t, k)
+
+	k.Deliver()
+	row := task(t, k, id)
+	if row.Status != "ENQUEUED" || row.Attempts != 0 {
+		t.Fatalf("got %s attempts=%d", row.Status, row.Attempts)
+	}
+	if k.Broker.Pending() != 1 {
+		t.Fatalf("task was not handed back")
+	}
+}
+
+func TestUnhandledTypeDeadLettersAfterMaxBounces(t *testing.T) {
+	k := testkit.New(rmq.New("tasks", "default", "high"), worker.Config{MaxUnhandled: 3})
+	k.Store.AddType(typ, testkit.Type{Active: true, Queue: "default", MaxAttempts: 3})
+	k.Start(t)
+	before := testutil.ToFloat64(metrics.UnhandledTotal.WithLabelValues(typ, "default"))
+	id := enqueue(t, k)
+
+	k.Drain(time.Hour)
+
+	row := task(t, k, id)
+	if row.Status != "FAILED" || row.Attempts != 0 || row.LastError == nil || !strings.Contains(*row.LastError, "handed back 3 times") {
+		t.Fatalf("got %s attempts=%d err=%v", row.Status, row.Attempts, row.LastError)
+	}
+	if dead := k.Broker.Dead(); len(dead) != 1 || dead[0].ID != id {
+		t.Fatalf("dead letters = %+v", dead)
+	}
+	if n := testutil.ToFloat64(metrics.UnhandledTotal.WithLabelValues(typ, "default")) - before; n != 3 {
+		t.Fatalf("dq_unhandled_total +%v, want +3", n)
+	}
+}
+
+func TestDeliveryLimitDeadLetters(t *testing.T) {
+	topo := rmq.New("tasks", "default", "high")
+	topo.Queues = map[string]rmq.QueueSpec{"default": {Type: rmq.QueueQuorum, DeliveryLimit: 3}}
+	k := testkit.New(topo, worker.Config{})
+	k.Store.AddType(typ, testkit.Type{Active: true, Queue: "default", MaxAttempts: 5})
+	ran := false
+	k.Worker.Handle(typ, func(context.Context, []byte) ([]byte, error) { ran = true; return nil, nil })
+	k.Start(t)
+
+	// the broker's last delivery after three requeues (e.g. crashed workers)
+	ctx := context.Background()
+	id, _, _, _, _ := k.Store.UpsertEnqueue(ctx, store.NewTask{ID: "t1", Type: typ, Queue: "default", MaxAttempts: 5})
+	_ = k.Broker.Publish(ctx, broker.Message{ID: id, Type: typ, Queue: "default", Headers: map[string]any{"x-delivery-count": int64(3)}})
+	k.Deliver()
+
+	row := task(t, k, id)
+	if ran || row.Status != "FAILED" || row.Attempts != 0 || row.LastError == nil || !strings.HasPrefix(*row.LastError, "delivery limit (3)") {
+		t.Fatalf("ran=%v got %s attempts=%d err=%v", ran, row.Status, row.Attempts, row.LastError)
+	}
+	if dead := k.Broker.Dead(); len(dead) != 1 || dead[0].ID != id {
+		t.Fatalf("dead letters = %+v", dead)
+	}
+	evs := k.Broker.Events()
+	if len(evs) == 0 || evs[len(evs)-1].Event != "FAILED" {
+		t.Fatalf("events = %+v", evs)
+	}
+}
+
+func TestRateLimitDoesNotSpendAttempts(t *testing.T) {
+	k := newKit(t, 3, failing(0))
+	k.Store.AddType(typ, testkit.Type{Active: true, Queue: "default", MaxAttempts: 3,
+		Limits: store.TypeLimits{RatePerSec: 1, RateBurst: 1}})
+	first, second := enqueue(t, k), enqueue(t, k)
+
+	k.Deliver()
+	if row := task(t, k, first); row.Status != "SUCCEEDED" {
+		t.Fatalf("first: %s", row.Status)
+	}
+	if row := task(t, k, second); row.Status != "ENQUEUED" || row.Attempts != 0 {
+		t.Fatalf("second: %s attempts=%d", row.Status, row.Attempts)
+	}
+
+	k.Drain(time.Minute)
+	if row := task(t, k, second); row.Status != "SUCCEEDED" || row.Attempts != 1 {
+		t.Fatalf("second after wait: %s attempts=%d", row.Status, row.Attempts)
+	}
+}
+
+// a delivery that takes a token but doesn't run (here a duplicate of a
+// finished task) gives it back, so the next task isn't throttled for it.
+func TestRateTokenRefundedWhenTaskDoesNotRun(t *testing.T) {
+	k := newKit(t, 3, failing(0))
+	k.Store.AddType(typ, testkit.Type{Active: true, Queue: "default", MaxAttempts: 3,
+		Limits: store.TypeLimits{RatePerSec: 1, RateBurst: 1}})
+	first := enqueue(t, k)
+	k.Deliver()
+	k.Clock.Advance(time.Second)
+
+	dup := k.Broker.Published()[0]
+	if err := k.Broker.Publish(context.Background(), dup); err != nil {
+		t.Fatal(err)
+	}
+	second := enqueue(t, k)
+	k.Deliver()
+	if row := task(t, k, first); row.Attempts != 1 {
+		t.Fatalf("first ran again: attempts=%d", row.Attempts)
+	}
+	if row := task(t, k, second); row.Status != "SUCCEEDED" {
+		t.Fatalf("second: %s, want it to run on the refunded token", row.Status)
+	}
+}
+
+func TestUpcastToNewestHandler(t *testing.T) {
+	k := testkit.New(rmq.New("tasks", "default", "high"), worker.Config{})
+	k.Store.AddType(typ, testkit.Type{Active: true, Queue: "default", MaxAttempts: 1})
+	var got string
+	k.Worker.Handle("email.send.v3", func(ctx context.Context, payload []byte) ([]byte, error) {
+		got = string(payload)
+		return []byte(`{}`), nil
+	})
+	k.Worker.Upcast("email.send.v2", "email.send.v3", func(ctx context.Context, p []byte) ([]byte, error) {
+		return []byte(strings.Replace(string(p), `"to"`, `"recipients"`, 1)), nil
+	})
+	k.Worker.Upcast(typ, "email.send.v2", func(ctx context.Context, p []byte) ([]byte, error) {
+		var v1 struct{ To string }
+		if err := json.Unmarshal(p, &v1); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]any{"to": []string{v1.To}})
+	})
+	k.Start(t)
+
+	if !k.Worker.Serves(typ) || k.Worker.Serves("email.send.v0") {
+		t.Fatal("Serves doesn't follow upcasters")
+	}
+	id := enqueue(t, k)
+	k.Deliver()
+	if row := task(t, k, id); row.Status != "SUCCEEDED" || row.Type != typ {
+		t.Fatalf("got %s type=%s", row.Status, row.Type)
+	}
+	if got != `{"recipients":["a@b.c"]}` {
+		t.Fatalf("handler payload = %s", got)
+	}
+}
+
+func TestTraceFollowsTaskAcrossRetries(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	k := newKit(t, 3, failing(1))
+	enqueue(t, k)
+	k.Drain(time.Hour)
+
+	var enq trace.SpanID
+	var traceID trace.TraceID
+	var processed, handled int
+	for _, s := range rec.Ended() {
+		switch {
+		case s.Name() == "POST /enqueue":
+			enq, traceID = s.SpanContext().SpanID(), s.SpanContext().TraceID()
+		case strings.HasPrefix(s.Name(), "process "):
+			processed++
+		case strings.HasPrefix(s.Name(), "handle "):
+			handled++
+		}
+	}
+	if !enq.IsValid() || processed != 2 || handled != 2 {
+		t.Fatalf("enqueue span %v, %d process and %d handle spans", enq, processed, handled)
+	}
+	for _, s := range rec.Ended() {
+		if s.SpanContext().TraceID() != traceID {
+			t.Errorf("span %q is in another trace", s.Name())
+		}
+	}
+}
+
+func TestHandlerLoggerCarriesTask(t *testing.T) {
+	var buf bytes.Buffer
+	k := testkit.New(rmq.New("tasks", "default", "high"), worker.Config{
+		Logger: slog.New(slog.NewJSONHandler(&buf, nil)),
+		ID:     "w1",
+	})
+	k.Store.AddType(typ, testkit.Type{Active: true, Queue: "default", MaxAttempts: 3})
+	k.Worker.Handle(typ, func(ctx context.Context, payload []byte) ([]byte, error) {
+		worker.Logger(ctx).Info("sending")
+		return []byte(`{}`), nil
+	})
+	k.Start(t)
+	id := enqueue(t, k)
+	k.Deliver()
+
+	for _, line := range bytes.Split(buf.Bytes(), []byte("\n")) {
+		var rec map[string]any
+		if json.Unmarshal(line, &rec) != nil || rec["msg"] != "sending" {
+			continue
+		}
+		want := map[string]any{"worker_id": "w1", "task_id": id, "type": typ, "queue": "default", "attempt": float64(1)}
+		for k, v := range want {
+			if rec[k] != v {
+				t.Errorf("%s = %v, want %v", k, rec[k], v)
+			}
+		}
+		return
+	}
+	t.Fatalf("handler line not logged:\n%s", buf.String())
+}
+
+func TestLargePayloadAndResultAreOffloaded(t *testing.T) {
+	blobs := &blob.Offloader{Store: blob.NewDir(t.TempDir()), Threshold: 64, MaxSize: 1 << 20}
+	k := testkit.New(rmq.New("tasks", "default", "high"), worker.Config{Blobs: blobs})
+	k.Store.AddType(typ, testkit.Type{Active: true, Queue: "default", MaxAttempts: 1})
+	big := `{"to":"a@b.c","body":"` + strings.Repeat("x", 200) + `"}`
+	var got string
+	k.Worker.Handle(typ, func(ctx context.Context, payload []byte) ([]byte, error) {
+		got = string(payload)
+		return json.Marshal(map[string]string{"echo": strings.Repeat("y", 200)})
+	})
+	k.Start(t)
+
+	res, err := k.Enqueue(api.EnqueueRequest{Type: typ, Payload: json.RawMessage(big)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inline, ref := k.Store.Payload(res.ID); inline != nil || ref != blob.PayloadKey(res.ID) {
+		t.Fatalf("payload inline=%q ref=%q", inline, ref)
+	}
+	k.Deliver()
+	if got != big {
+		t.Fatalf("handler payload = %.40s…", got)
+	}
+	row := task(t, k, res.ID)
+	if row.Status != "SUCCEEDED" || row.ResultRef == nil || *row.ResultRef != blob.ResultKey(res.ID) {
+		t.Fatalf("got %s ref=%v", row.Status, row.ResultRef)
+	}
+
+	rec := k.Do(http.MethodGet, "/tasks/"+res.ID, nil)
+	var body struct{ Result map[string]string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || len(body.Result["echo"]) != 200 {
+		t.Fatalf("GET /tasks: %d %.80s", rec.Code, rec.Body.String())
+	}
+}